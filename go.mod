@@ -5,7 +5,9 @@ go 1.24.0
 toolchain go1.24.9
 
 require (
+	github.com/andybalholm/brotli v1.2.0
 	github.com/gorilla/websocket v1.5.3
+	github.com/klauspost/compress v1.18.0
 	github.com/shirou/gopsutil v3.21.11+incompatible
 	golang.org/x/crypto v0.43.0
 	golang.org/x/text v0.30.0
@@ -0,0 +1,410 @@
+// Package cache stores upstream HTTP responses for the proxy: an in-memory
+// LRU with a byte cap and an optional on-disk second tier. Freshness follows
+// Cache-Control / Expires, variants follow Vary.
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"router/internal/clog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMemoryMB = 256
+	defaultDiskMB   = 1024
+	fileSuffix      = ".cache"
+)
+
+// Entry is a stored upstream response. Entries are immutable once stored.
+type Entry struct {
+	Key    string
+	Status int
+	Header http.Header
+	Body   []byte
+	Stored time.Time // adjusted by the upstream Age header
+	Fresh  time.Duration
+	SWR    time.Duration // stale-while-revalidate window after Fresh
+	SIE    time.Duration // stale-if-error window after Fresh
+	Vary   []string
+}
+
+// Age returns how old the response is.
+func (e *Entry) Age(now time.Time) time.Duration {
+	return now.Sub(e.Stored)
+}
+
+// IsFresh reports whether the entry can be served without contacting the upstream.
+func (e *Entry) IsFresh(now time.Time) bool {
+	return e.Age(now) < e.Fresh
+}
+
+// CanRevalidateInBackground reports whether the stale entry may be served while refreshing.
+func (e *Entry) CanRevalidateInBackground(now time.Time) bool {
+	return e.Age(now) < e.Fresh+e.SWR
+}
+
+// CanServeOnError reports whether the entry may replace an upstream failure.
+func (e *Entry) CanServeOnError(now time.Time) bool {
+	return e.Age(now) < e.Fresh+e.SIE
+}
+
+func (e *Entry) size() int64 {
+	n := int64(len(e.Body) + len(e.Key))
+	for name, values := range e.Header {
+		n += int64(len(name))
+		for _, v := range values {
+			n += int64(len(v))
+		}
+	}
+	return n
+}
+
+// Store is safe for concurrent use.
+type Store struct {
+	mu       sync.Mutex
+	mem      *lru
+	disk     *lru // nil when the disk tier is disabled
+	dir      string
+	varies   map[string][]string // primary key -> Vary header names
+	maxEntry int64
+}
+
+// New creates a store with a memory cap in bytes. dir enables the disk tier
+// capped at diskBytes; existing files there are indexed.
+func New(memBytes int64, dir string, diskBytes int64) (*Store, error) {
+	s := &Store{
+		mem:      newLRU(memBytes),
+		varies:   make(map[string][]string),
+		maxEntry: memBytes / 8,
+	}
+	if dir == "" {
+		return s, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return s, err
+	}
+	s.dir = dir
+	s.disk = newLRU(diskBytes)
+	s.loadDisk()
+	return s, nil
+}
+
+// FromEnv builds a store from CACHE_MAX_MB (memory, 256 by default), CACHE_DIR
+// (disk tier, off when empty) and CACHE_DISK_MAX_MB (1024 by default).
+func FromEnv() (*Store, error) {
+	memMB := envMB("CACHE_MAX_MB", defaultMemoryMB)
+	diskMB := envMB("CACHE_DISK_MAX_MB", defaultDiskMB)
+	return New(memMB<<20, strings.TrimSpace(os.Getenv("CACHE_DIR")), diskMB<<20)
+}
+
+func envMB(key string, fallback int64) int64 {
+	v, err := strconv.ParseInt(strings.TrimSpace(os.Getenv(key)), 10, 64)
+	if err != nil || v <= 0 {
+		return fallback
+	}
+	return v
+}
+
+// MaxEntryBytes is the largest body the store accepts.
+func (s *Store) MaxEntryBytes() int64 {
+	return s.maxEntry
+}
+
+// Key returns the primary cache key of a request: host plus request URI.
+func Key(r *http.Request) string {
+	return strings.ToLower(r.Host) + r.URL.RequestURI()
+}
+
+func variantKey(primary string, vary []string, h http.Header) string {
+	if len(vary) == 0 {
+		return primary
+	}
+	var b strings.Builder
+	b.WriteString(primary)
+	for _, name := range vary {
+		b.WriteByte(0)
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strings.Join(h.Values(name), ","))
+	}
+	return b.String()
+}
+
+func primaryOf(key string) string {
+	if i := strings.IndexByte(key, 0); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// Lookup returns the stored variant matching r, or nil.
+func (s *Store) Lookup(r *http.Request) *Entry {
+	primary := Key(r)
+	s.mu.Lock()
+	key := variantKey(primary, s.varies[primary], r.Header)
+	if item, ok := s.mem.get(key); ok {
+		s.mu.Unlock()
+		return item.entry
+	}
+	onDisk := false
+	if s.disk != nil {
+		_, onDisk = s.disk.get(key)
+	}
+	s.mu.Unlock()
+	if !onDisk {
+		return nil
+	}
+
+	entry, err := readEntry(s.filePath(key))
+	if err != nil {
+		s.mu.Lock()
+		s.disk.remove(key)
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Lock()
+	s.mem.add(key, entry.size(), entry)
+	s.mu.Unlock()
+	return entry
+}
+
+// Put stores the response for r. Entries larger than MaxEntryBytes are ignored.
+func (s *Store) Put(r *http.Request, entry *Entry) {
+	primary := Key(r)
+	entry.Key = variantKey(primary, entry.Vary, r.Header)
+	size := entry.size()
+	if size > s.maxEntry {
+		return
+	}
+
+	s.mu.Lock()
+	if len(entry.Vary) > 0 {
+		s.varies[primary] = entry.Vary
+	} else {
+		delete(s.varies, primary)
+	}
+	s.mem.add(entry.Key, size, entry)
+	var evicted []string
+	if s.disk != nil {
+		evicted = s.disk.add(entry.Key, size, nil)
+	}
+	s.mu.Unlock()
+
+	if s.disk == nil {
+		return
+	}
+	if err := writeEntry(s.filePath(entry.Key), entry); err != nil {
+		clog.Warnf("[cache] write %s failed: %v", entry.Key, err)
+		s.mu.Lock()
+		s.disk.remove(entry.Key)
+		s.mu.Unlock()
+	}
+	for _, key := range evicted {
+		_ = os.Remove(s.filePath(key))
+	}
+}
+
+// Purge removes a URL (scheme optional) or, with prefix, everything under it.
+// It returns the number of removed entries.
+func (s *Store) Purge(target string, prefix bool) int {
+	target = strings.TrimSpace(target)
+	target = strings.TrimPrefix(strings.TrimPrefix(target, "https://"), "http://")
+	if target == "" {
+		return 0
+	}
+	if host, rest, found := strings.Cut(target, "/"); found {
+		target = strings.ToLower(host) + "/" + rest
+	} else {
+		target = strings.ToLower(target)
+		if !prefix {
+			target += "/"
+		}
+	}
+	match := func(key string) bool {
+		if prefix {
+			return strings.HasPrefix(key, target)
+		}
+		return primaryOf(key) == target
+	}
+
+	s.mu.Lock()
+	removed := make(map[string]struct{})
+	for _, key := range s.mem.keys() {
+		if match(key) {
+			s.mem.remove(key)
+			removed[key] = struct{}{}
+		}
+	}
+	var files []string
+	if s.disk != nil {
+		for _, key := range s.disk.keys() {
+			if match(key) {
+				s.disk.remove(key)
+				removed[key] = struct{}{}
+				files = append(files, s.filePath(key))
+			}
+		}
+	}
+	for primary := range s.varies {
+		if match(primary) {
+			delete(s.varies, primary)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, file := range files {
+		_ = os.Remove(file)
+	}
+	return len(removed)
+}
+
+// Usage reports the number of entries and bytes held in memory and on disk.
+func (s *Store) Usage() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usage := map[string]interface{}{
+		"memoryEntries": s.mem.ll.Len(),
+		"memoryBytes":   s.mem.size,
+		"memoryMax":     s.mem.max,
+	}
+	if s.disk != nil {
+		usage["diskEntries"] = s.disk.ll.Len()
+		usage["diskBytes"] = s.disk.size
+		usage["diskMax"] = s.disk.max
+	}
+	return usage
+}
+
+func (s *Store) filePath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+fileSuffix)
+}
+
+func (s *Store) loadDisk() {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*"+fileSuffix))
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		entry, err := readEntry(file)
+		if err != nil || entry.Key == "" {
+			_ = os.Remove(file)
+			continue
+		}
+		if len(entry.Vary) > 0 {
+			s.varies[primaryOf(entry.Key)] = entry.Vary
+		}
+		for _, key := range s.disk.add(entry.Key, entry.size(), nil) {
+			_ = os.Remove(s.filePath(key))
+		}
+	}
+}
+
+func readEntry(path string) (*Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entry Entry
+	if err := gob.NewDecoder(f).Decode(&entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func writeEntry(path string, entry *Entry) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "tmp-*")
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(tmp).Encode(entry); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// lru tracks keys by recency with a byte budget.
+type lru struct {
+	ll    *list.List
+	items map[string]*list.Element
+	size  int64
+	max   int64
+}
+
+type lruItem struct {
+	key   string
+	size  int64
+	entry *Entry
+}
+
+func newLRU(max int64) *lru {
+	return &lru{ll: list.New(), items: make(map[string]*list.Element), max: max}
+}
+
+func (l *lru) get(key string) (*lruItem, bool) {
+	el, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.ll.MoveToFront(el)
+	return el.Value.(*lruItem), true
+}
+
+// add inserts or replaces key and returns the keys evicted to stay under max.
+func (l *lru) add(key string, size int64, entry *Entry) []string {
+	if el, ok := l.items[key]; ok {
+		item := el.Value.(*lruItem)
+		l.size += size - item.size
+		item.size, item.entry = size, entry
+		l.ll.MoveToFront(el)
+	} else {
+		l.items[key] = l.ll.PushFront(&lruItem{key: key, size: size, entry: entry})
+		l.size += size
+	}
+	var evicted []string
+	for l.size > l.max && l.ll.Len() > 1 {
+		oldest := l.ll.Back()
+		item := oldest.Value.(*lruItem)
+		l.ll.Remove(oldest)
+		delete(l.items, item.key)
+		l.size -= item.size
+		evicted = append(evicted, item.key)
+	}
+	return evicted
+}
+
+func (l *lru) remove(key string) bool {
+	el, ok := l.items[key]
+	if !ok {
+		return false
+	}
+	item := el.Value.(*lruItem)
+	l.ll.Remove(el)
+	delete(l.items, key)
+	l.size -= item.size
+	return true
+}
+
+func (l *lru) keys() []string {
+	keys := make([]string, 0, len(l.items))
+	for key := range l.items {
+		keys = append(keys, key)
+	}
+	return keys
+}
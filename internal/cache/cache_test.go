@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPolicy(t *testing.T) {
+	now := time.Now()
+	defaults := Defaults{TTL: time.Minute, StaleIfError: time.Hour}
+	tests := []struct {
+		name   string
+		header http.Header
+		status int
+		fresh  time.Duration
+		store  bool
+	}{
+		{"default ttl", http.Header{}, 200, time.Minute, true},
+		{"max-age", http.Header{"Cache-Control": {"public, max-age=30"}}, 200, 30 * time.Second, true},
+		{"s-maxage wins", http.Header{"Cache-Control": {"max-age=30, s-maxage=90"}}, 200, 90 * time.Second, true},
+		{"expires", http.Header{"Expires": {now.Add(2 * time.Hour).UTC().Format(http.TimeFormat)}}, 200, 2 * time.Hour, true},
+		{"no-store", http.Header{"Cache-Control": {"no-store"}}, 200, 0, false},
+		{"private", http.Header{"Cache-Control": {"private, max-age=60"}}, 200, 0, false},
+		{"set-cookie", http.Header{"Set-Cookie": {"a=b"}}, 200, 0, false},
+		{"vary star", http.Header{"Vary": {"*"}}, 200, 0, false},
+		{"server error", http.Header{}, 500, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := Policy(&http.Response{StatusCode: tt.status, Header: tt.header}, now, defaults)
+			if (entry != nil) != tt.store {
+				t.Fatalf("stored = %v, want %v", entry != nil, tt.store)
+			}
+			if entry == nil {
+				return
+			}
+			if diff := entry.Fresh - tt.fresh; diff < -time.Second || diff > time.Second {
+				t.Fatalf("fresh = %v, want %v", entry.Fresh, tt.fresh)
+			}
+			if entry.SIE != time.Hour {
+				t.Fatalf("stale-if-error = %v, want default", entry.SIE)
+			}
+		})
+	}
+}
+
+func TestStoreVaryEvictionAndPurge(t *testing.T) {
+	s, err := New(1<<20, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	en := httptest.NewRequest(http.MethodGet, "http://example.com/page?x=1", nil)
+	en.Header.Set("Accept-Language", "en")
+	de := en.Clone(en.Context())
+	de.Header.Set("Accept-Language", "de")
+
+	s.Put(en, &Entry{Status: 200, Body: []byte("hello"), Vary: []string{"Accept-Language"}, Stored: time.Now(), Fresh: time.Minute})
+	if got := s.Lookup(en); got == nil || string(got.Body) != "hello" {
+		t.Fatalf("lookup en = %+v", got)
+	}
+	if got := s.Lookup(de); got != nil {
+		t.Fatalf("other variant must miss, got %+v", got)
+	}
+
+	other := httptest.NewRequest(http.MethodGet, "http://example.com/other", nil)
+	s.Put(other, &Entry{Status: 200, Body: []byte("x"), Stored: time.Now(), Fresh: time.Minute})
+	if n := s.Purge("https://example.com/page?x=1", false); n != 1 {
+		t.Fatalf("purge url removed %d, want 1", n)
+	}
+	if s.Lookup(en) != nil || s.Lookup(other) == nil {
+		t.Fatal("purge by URL removed the wrong entries")
+	}
+	if n := s.Purge("example.com/", true); n != 1 {
+		t.Fatalf("purge prefix removed %d, want 1", n)
+	}
+
+	small, _ := New(160, "", 0) // 20 bytes per entry at most
+	first := httptest.NewRequest(http.MethodGet, "http://a/0", nil)
+	small.Put(first, &Entry{Status: 200, Body: make([]byte, 15)})
+	for i := 1; i <= 9; i++ {
+		small.Put(httptest.NewRequest(http.MethodGet, "http://a/"+string(rune('0'+i)), nil), &Entry{Status: 200, Body: make([]byte, 15)})
+	}
+	if small.Lookup(first) != nil {
+		t.Fatal("least recently used entry was not evicted")
+	}
+	if small.Lookup(httptest.NewRequest(http.MethodGet, "http://a/9", nil)) == nil {
+		t.Fatal("recent entry evicted")
+	}
+	small.Put(first, &Entry{Status: 200, Body: make([]byte, 64)})
+	if small.Lookup(first) != nil {
+		t.Fatal("oversized entry stored")
+	}
+}
+
+func TestStoreDiskTier(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New(1<<20, dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/asset.js", nil)
+	s.Put(r, &Entry{Status: 200, Header: http.Header{"Content-Type": {"text/javascript"}}, Body: []byte("js"), Stored: time.Now(), Fresh: time.Hour})
+
+	reopened, err := New(1<<20, dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := reopened.Lookup(r)
+	if got == nil || string(got.Body) != "js" || got.Header.Get("Content-Type") != "text/javascript" {
+		t.Fatalf("disk lookup = %+v", got)
+	}
+	if n := reopened.Purge("example.com", true); n != 1 {
+		t.Fatalf("purge removed %d, want 1", n)
+	}
+	again, _ := New(1<<20, dir, 1<<20)
+	if again.Lookup(r) != nil {
+		t.Fatal("purged entry came back from disk")
+	}
+}
@@ -0,0 +1,137 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults are the rule-level fallbacks applied when the upstream is silent.
+type Defaults struct {
+	TTL                  time.Duration // used when the response carries no freshness information
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+}
+
+// Cacheable reports whether a request may be answered from or stored in the cache.
+func Cacheable(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Range") != "" {
+		return false
+	}
+	_, noStore := cacheControl(r.Header)["no-store"]
+	return !noStore
+}
+
+// Policy builds an entry skeleton for a response, or returns nil when the
+// response must not be stored. Shared-cache directives win over private ones:
+// s-maxage, then max-age, then Expires, then defaults.TTL.
+func Policy(resp *http.Response, now time.Time, defaults Defaults) *Entry {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent,
+		http.StatusMovedPermanently, http.StatusPermanentRedirect, http.StatusNotFound,
+		http.StatusGone:
+	default:
+		return nil
+	}
+	h := resp.Header
+	cc := cacheControl(h)
+	for _, directive := range []string{"no-store", "private", "no-cache"} {
+		if _, ok := cc[directive]; ok {
+			return nil
+		}
+	}
+	if h.Get("Set-Cookie") != "" {
+		return nil
+	}
+	var vary []string
+	for _, value := range h.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return nil
+			}
+			if name != "" {
+				vary = append(vary, name)
+			}
+		}
+	}
+
+	fresh, explicit := defaults.TTL, false
+	if v, ok := seconds(cc, "s-maxage"); ok {
+		fresh, explicit = v, true
+	} else if v, ok := seconds(cc, "max-age"); ok {
+		fresh, explicit = v, true
+	} else if expires := h.Get("Expires"); expires != "" {
+		explicit = true
+		fresh = 0
+		if t, err := http.ParseTime(expires); err == nil {
+			base := now
+			if date, err := http.ParseTime(h.Get("Date")); err == nil {
+				base = date
+			}
+			if t.After(base) {
+				fresh = t.Sub(base)
+			}
+		}
+	}
+	if !explicit && fresh <= 0 {
+		return nil
+	}
+	if _, ok := cc["must-revalidate"]; ok {
+		defaults.StaleWhileRevalidate, defaults.StaleIfError = 0, 0
+	}
+	swr := defaults.StaleWhileRevalidate
+	if v, ok := seconds(cc, "stale-while-revalidate"); ok {
+		swr = v
+	}
+	sie := defaults.StaleIfError
+	if v, ok := seconds(cc, "stale-if-error"); ok {
+		sie = v
+	}
+	if fresh <= 0 && swr <= 0 && sie <= 0 {
+		return nil
+	}
+
+	stored := now
+	if age, err := strconv.Atoi(strings.TrimSpace(h.Get("Age"))); err == nil && age > 0 {
+		stored = now.Add(-time.Duration(age) * time.Second)
+	}
+	return &Entry{
+		Status: resp.StatusCode,
+		Stored: stored,
+		Fresh:  fresh,
+		SWR:    swr,
+		SIE:    sie,
+		Vary:   vary,
+	}
+}
+
+func cacheControl(h http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "" {
+				directives[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+			}
+		}
+	}
+	return directives
+}
+
+func seconds(cc map[string]string, directive string) (time.Duration, bool) {
+	arg, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
@@ -0,0 +1,215 @@
+// Package clientip resolves the real client address of an HTTP request.
+//
+// Forwarding headers are honoured only when the socket peer is a trusted
+// proxy: X-Forwarded-For / X-Real-IP from the operator-configured proxy
+// networks and CF-Connecting-IP from Cloudflare's published ranges. A direct
+// client can therefore no longer spoof its address to dodge bans or frame
+// someone else.
+package clientip
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"router/internal/proxyproto"
+	"strings"
+	"sync"
+)
+
+// DefaultCloudflareFile is the list of Cloudflare ranges shipped with the router.
+const DefaultCloudflareFile = "cloudflare_ips.txt"
+
+// Resolver extracts the client IP using an explicit set of trusted proxies.
+type Resolver struct {
+	trusted    []netip.Prefix
+	cloudflare []netip.Prefix
+}
+
+// New creates a resolver. trusted proxies may set X-Forwarded-For and
+// X-Real-IP; cloudflare ranges may additionally set CF-Connecting-IP.
+func New(trusted, cloudflare []netip.Prefix) *Resolver {
+	return &Resolver{trusted: trusted, cloudflare: cloudflare}
+}
+
+// loopbackOnly trusts a reverse proxy running on the same host.
+func loopbackOnly() []netip.Prefix {
+	return []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+}
+
+// FromEnv builds a resolver from TRUSTED_PROXIES (comma separated CIDRs,
+// loopback when unset) and the Cloudflare list in CLOUDFLARE_IPS_FILE.
+func FromEnv() (*Resolver, error) {
+	trusted := loopbackOnly()
+	if raw := strings.TrimSpace(os.Getenv("TRUSTED_PROXIES")); raw != "" {
+		parsed, err := proxyproto.ParseCIDRs(raw)
+		if err != nil {
+			return New(trusted, nil), err
+		}
+		trusted = parsed
+	}
+
+	path := strings.TrimSpace(os.Getenv("CLOUDFLARE_IPS_FILE"))
+	if path == "" {
+		path = DefaultCloudflareFile
+	}
+	cloudflare, err := LoadCIDRFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return New(trusted, nil), err
+	}
+	return New(trusted, cloudflare), nil
+}
+
+// LoadCIDRFile reads one CIDR or IP per line; blank lines and # comments are skipped.
+func LoadCIDRFile(path string) ([]netip.Prefix, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []netip.Prefix
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		parsed, err := proxyproto.ParseCIDRs(line)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, parsed...)
+	}
+	return out, scanner.Err()
+}
+
+var (
+	defaultMu       sync.RWMutex
+	defaultResolver = New(loopbackOnly(), nil)
+)
+
+// Configure replaces the process-wide resolver used by FromRequest.
+func Configure(r *Resolver) {
+	if r == nil {
+		return
+	}
+	defaultMu.Lock()
+	defaultResolver = r
+	defaultMu.Unlock()
+}
+
+// Default returns the process-wide resolver.
+func Default() *Resolver {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultResolver
+}
+
+// FromRequest resolves the client IP with the process-wide resolver.
+func FromRequest(r *http.Request) string {
+	return Default().FromRequest(r)
+}
+
+// TrustedPeer reports whether the request came directly from a trusted proxy
+// (including Cloudflare) whose informational headers may be believed.
+func TrustedPeer(r *http.Request) bool {
+	return Default().TrustedPeer(r)
+}
+
+// TrustedPeer reports whether the socket peer is a trusted proxy or Cloudflare.
+func (res *Resolver) TrustedPeer(r *http.Request) bool {
+	addr, ok := parseAddr(SocketIP(r.RemoteAddr))
+	return ok && (res.isTrusted(addr) || res.isCloudflare(addr))
+}
+
+// FromRequest returns the client IP of r.
+func (res *Resolver) FromRequest(r *http.Request) string {
+	socket := SocketIP(r.RemoteAddr)
+	addr, ok := parseAddr(socket)
+	if !ok {
+		return socket
+	}
+
+	fromCloudflare := res.isCloudflare(addr)
+	if fromCloudflare {
+		if ip, ok := parseAddr(r.Header.Get("CF-Connecting-IP")); ok {
+			return ip.String()
+		}
+	}
+	if !fromCloudflare && !res.isTrusted(addr) {
+		return addr.String()
+	}
+
+	// Walk X-Forwarded-For from the nearest hop; the first address that is
+	// not one of our proxies is the client.
+	hops := forwardedFor(r.Header.Values("X-Forwarded-For"))
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseAddr(hops[i])
+		if !ok {
+			break
+		}
+		if !res.isTrusted(hop) && !res.isCloudflare(hop) {
+			return hop.String()
+		}
+		if i == 0 {
+			return hop.String()
+		}
+	}
+
+	if ip, ok := parseAddr(r.Header.Get("X-Real-IP")); ok {
+		return ip.String()
+	}
+	return addr.String()
+}
+
+func (res *Resolver) isTrusted(addr netip.Addr) bool {
+	return containsAddr(res.trusted, addr)
+}
+
+func (res *Resolver) isCloudflare(addr netip.Addr) bool {
+	return containsAddr(res.cloudflare, addr)
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				hops = append(hops, part)
+			}
+		}
+	}
+	return hops
+}
+
+func parseAddr(value string) (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(strings.TrimSpace(value))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
+
+// SocketIP returns the host part of a RemoteAddr value.
+func SocketIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return strings.TrimSpace(remoteAddr)
+	}
+	return strings.TrimSpace(host)
+}
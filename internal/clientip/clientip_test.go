@@ -0,0 +1,114 @@
+package clientip
+
+import (
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolverFromRequest(t *testing.T) {
+	resolver := New(
+		[]netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("10.0.0.0/8")},
+		[]netip.Prefix{netip.MustParsePrefix("173.245.48.0/20")},
+	)
+
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		remote   string
+		expected string
+	}{
+		{
+			name:     "direct client cannot spoof cf-connecting-ip",
+			headers:  map[string]string{"CF-Connecting-IP": "198.51.100.7"},
+			remote:   "185.177.72.13:23088",
+			expected: "185.177.72.13",
+		},
+		{
+			name:     "direct client cannot spoof x-forwarded-for",
+			headers:  map[string]string{"X-Forwarded-For": "198.51.100.11", "X-Real-IP": "198.51.100.12"},
+			remote:   "185.177.72.13:23088",
+			expected: "185.177.72.13",
+		},
+		{
+			name:     "cloudflare edge sets cf-connecting-ip",
+			headers:  map[string]string{"CF-Connecting-IP": "198.51.100.7", "X-Forwarded-For": "203.0.113.1"},
+			remote:   "173.245.48.10:443",
+			expected: "198.51.100.7",
+		},
+		{
+			name:     "trusted proxy cannot relay cf-connecting-ip",
+			headers:  map[string]string{"CF-Connecting-IP": "198.51.100.7", "X-Forwarded-For": "203.0.113.5"},
+			remote:   "127.0.0.1:12345",
+			expected: "203.0.113.5",
+		},
+		{
+			name:     "rightmost untrusted hop wins over spoofed prefix",
+			headers:  map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.11, 10.0.0.7"},
+			remote:   "127.0.0.1:12345",
+			expected: "198.51.100.11",
+		},
+		{
+			name:     "x-real-ip from trusted proxy without xff",
+			headers:  map[string]string{"X-Real-IP": "198.51.100.8"},
+			remote:   "10.1.2.3:80",
+			expected: "198.51.100.8",
+		},
+		{
+			name:     "all hops trusted falls back to leftmost",
+			headers:  map[string]string{"X-Forwarded-For": "10.0.0.2, 10.0.0.3"},
+			remote:   "127.0.0.1:80",
+			expected: "10.0.0.2",
+		},
+		{
+			name:     "remote addr fallback",
+			headers:  map[string]string{},
+			remote:   "203.0.113.20:443",
+			expected: "203.0.113.20",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			req.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+
+			if got := resolver.FromRequest(req); got != tt.expected {
+				t.Fatalf("FromRequest() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestLoadCIDRFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cf.txt")
+	content := "# comment\n173.245.48.0/20\n\n2400:cb00::/32 # v6\n198.51.100.1\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	prefixes, err := LoadCIDRFile(path)
+	if err != nil {
+		t.Fatalf("LoadCIDRFile() error: %v", err)
+	}
+	if len(prefixes) != 3 || prefixes[2].Bits() != 32 {
+		t.Fatalf("unexpected prefixes: %v", prefixes)
+	}
+}
+
+func TestShippedCloudflareList(t *testing.T) {
+	prefixes, err := LoadCIDRFile(filepath.Join("..", "..", DefaultCloudflareFile))
+	if err != nil {
+		t.Fatalf("shipped cloudflare list is invalid: %v", err)
+	}
+	if len(prefixes) == 0 {
+		t.Fatalf("shipped cloudflare list is empty")
+	}
+}
@@ -0,0 +1,320 @@
+// Package jose verifies compact JSON Web Tokens signed with RS256/384/512,
+// PS256/384/512, ES256/384/512 or HS256/384/512 against JSON Web Keys. It
+// is the minimum needed by the proxy's OIDC and JWT policies; Sign exists
+// for tests and tools. Encrypted tokens (JWE) are not supported.
+package jose
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// Errors returned by Parse, Verify and Validate.
+var (
+	ErrMalformed    = errors.New("malformed token")
+	ErrAlgorithm    = errors.New("unsupported or disallowed algorithm")
+	ErrNoKey        = errors.New("no matching key")
+	ErrSignature    = errors.New("invalid signature")
+	ErrExpired      = errors.New("token expired")
+	ErrNotYetValid  = errors.New("token not valid yet")
+	ErrIssuer       = errors.New("unexpected issuer")
+	ErrAudience     = errors.New("unexpected audience")
+	ErrMissingClaim = errors.New("missing required claim")
+)
+
+// Header is the JOSE header of a token.
+type Header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// Token is a parsed, not yet verified JWT.
+type Token struct {
+	Header    Header
+	Claims    Claims
+	signed    string // header.payload
+	signature []byte
+}
+
+// Parse splits a compact JWT and decodes its header and claims. The
+// signature is not checked; call Verify.
+func Parse(raw string) (*Token, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	var tok Token
+	if err := decodeSegment(parts[0], &tok.Header); err != nil {
+		return nil, err
+	}
+	if err := decodeSegment(parts[1], &tok.Claims); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	tok.signed = parts[0] + "." + parts[1]
+	tok.signature = sig
+	return &tok, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return ErrMalformed
+	}
+	dec := json.NewDecoder(strings.NewReader(string(b)))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return ErrMalformed
+	}
+	return nil
+}
+
+// Verify checks the signature with the first key of set that matches the
+// token's kid and algorithm. allowed lists acceptable algorithms; "none" is
+// never accepted.
+func (t *Token) Verify(set *KeySet, allowed []string) error {
+	if t.Header.Alg == "" || t.Header.Alg == "none" || !slices.Contains(allowed, t.Header.Alg) {
+		return ErrAlgorithm
+	}
+	keys := set.Lookup(t.Header.Kid, t.Header.Alg)
+	if len(keys) == 0 {
+		return ErrNoKey
+	}
+	for _, key := range keys {
+		if verifySignature(t.Header.Alg, key.Key, []byte(t.signed), t.signature) == nil {
+			return nil
+		}
+	}
+	return ErrSignature
+}
+
+func verifySignature(alg string, key any, signed, sig []byte) error {
+	hash, ok := algHash(alg)
+	if !ok {
+		return ErrAlgorithm
+	}
+	switch alg[:2] {
+	case "HS":
+		secret, ok := key.([]byte)
+		if !ok {
+			return ErrNoKey
+		}
+		mac := hmac.New(hash.New, secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return ErrSignature
+		}
+		return nil
+	case "RS", "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrNoKey
+		}
+		h := hash.New()
+		h.Write(signed)
+		if alg[:2] == "PS" {
+			return rsa.VerifyPSS(pub, hash, h.Sum(nil), sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		return rsa.VerifyPKCS1v15(pub, hash, h.Sum(nil), sig)
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return ErrNoKey
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return ErrSignature
+		}
+		h := hash.New()
+		h.Write(signed)
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, h.Sum(nil), r, s) {
+			return ErrSignature
+		}
+		return nil
+	}
+	return ErrAlgorithm
+}
+
+func algHash(alg string) (crypto.Hash, bool) {
+	if len(alg) != 5 {
+		return 0, false
+	}
+	switch alg[:2] {
+	case "HS", "RS", "PS", "ES":
+	default:
+		return 0, false
+	}
+	switch alg[2:] {
+	case "256":
+		return crypto.SHA256, true
+	case "384":
+		return crypto.SHA384, true
+	case "512":
+		return crypto.SHA512, true
+	}
+	return 0, false
+}
+
+// Claims is the decoded JWT payload. Numbers are json.Number.
+type Claims map[string]any
+
+// String returns a string claim or "".
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Strings returns a claim that is a string or an array of strings; for
+// space separated scope strings use strings.Fields on String instead.
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// Time returns a NumericDate claim; ok is false when it is absent or invalid.
+func (c Claims) Time(name string) (time.Time, bool) {
+	n, ok := c[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*1e9)), true
+}
+
+// Expectations are the registered claim checks done by Validate.
+type Expectations struct {
+	Issuer    string   // required iss when not empty
+	Audiences []string // one of them must be in aud when not empty
+	Now       time.Time
+	Leeway    time.Duration // clock skew allowance for exp and nbf
+	// RequireExp rejects tokens without an exp claim.
+	RequireExp bool
+}
+
+// Validate checks exp, nbf, iss and aud.
+func (c Claims) Validate(e Expectations) error {
+	now := e.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	if exp, ok := c.Time("exp"); ok {
+		if !now.Before(exp.Add(e.Leeway)) {
+			return ErrExpired
+		}
+	} else if e.RequireExp {
+		return fmt.Errorf("%w: exp", ErrMissingClaim)
+	}
+	if nbf, ok := c.Time("nbf"); ok && now.Add(e.Leeway).Before(nbf) {
+		return ErrNotYetValid
+	}
+	if e.Issuer != "" && c.String("iss") != e.Issuer {
+		return ErrIssuer
+	}
+	if len(e.Audiences) > 0 {
+		found := false
+		for _, aud := range c.Strings("aud") {
+			if slices.Contains(e.Audiences, aud) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return ErrAudience
+		}
+	}
+	return nil
+}
+
+// Sign encodes claims as a compact JWT. key is an *rsa.PrivateKey,
+// *ecdsa.PrivateKey or an HMAC secret ([]byte), matching alg.
+func Sign(alg, kid string, key any, claims any) (string, error) {
+	hash, ok := algHash(alg)
+	if !ok {
+		return "", ErrAlgorithm
+	}
+	header, err := json.Marshal(Header{Alg: alg, Kid: kid, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		if alg[:2] != "HS" {
+			return "", ErrAlgorithm
+		}
+		mac := hmac.New(hash.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		switch alg[:2] {
+		case "RS":
+			sig, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest)
+		case "PS":
+			sig, err = rsa.SignPSS(rand.Reader, k, hash, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		default:
+			return "", ErrAlgorithm
+		}
+	case *ecdsa.PrivateKey:
+		if alg[:2] != "ES" {
+			return "", ErrAlgorithm
+		}
+		r, s, signErr := ecdsa.Sign(rand.Reader, k, digest)
+		if signErr != nil {
+			return "", signErr
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+	default:
+		return "", ErrNoKey
+	}
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,327 @@
+package jose
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Key is a verification key from a JWK set.
+type Key struct {
+	Kid string
+	Alg string // optional algorithm restriction
+	Key any    // *rsa.PublicKey, *ecdsa.PublicKey or []byte for HMAC
+}
+
+// KeySet is a set of verification keys.
+type KeySet struct {
+	Keys []Key
+}
+
+// Lookup returns keys usable for a token with the given kid and alg. Without
+// a kid every key of a compatible type is a candidate.
+func (s *KeySet) Lookup(kid, alg string) []Key {
+	if s == nil {
+		return nil
+	}
+	var out []Key
+	for _, key := range s.Keys {
+		if kid != "" && key.Kid != kid {
+			continue
+		}
+		if key.Alg != "" && key.Alg != alg {
+			continue
+		}
+		if !keyFitsAlg(key.Key, alg) {
+			continue
+		}
+		out = append(out, key)
+	}
+	return out
+}
+
+func keyFitsAlg(key any, alg string) bool {
+	if len(alg) < 2 {
+		return false
+	}
+	switch key.(type) {
+	case []byte:
+		return alg[:2] == "HS"
+	case *rsa.PublicKey:
+		return alg[:2] == "RS" || alg[:2] == "PS"
+	case *ecdsa.PublicKey:
+		return alg[:2] == "ES"
+	}
+	return false
+}
+
+// HMACKeySet wraps a shared secret for HS* tokens.
+func HMACKeySet(secret []byte) *KeySet {
+	return &KeySet{Keys: []Key{{Key: secret}}}
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// ParseKeySet decodes a JWKS document ({"keys": [...]}). Keys of unknown
+// types and encryption keys are skipped.
+func ParseKeySet(data []byte) (*KeySet, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("decode JWKS: %w", err)
+	}
+	set := &KeySet{}
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		if key != nil {
+			set.Keys = append(set.Keys, Key{Kid: k.Kid, Alg: k.Alg, Key: key})
+		}
+	}
+	return set, nil
+}
+
+// ParseKeyFile reads verification keys from a file's content: a JWKS
+// document, PEM public keys or certificates, or otherwise a shared HMAC
+// secret (surrounding whitespace is ignored).
+func ParseKeyFile(data []byte) (*KeySet, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return nil, fmt.Errorf("key file is empty")
+	}
+	if trimmed[0] == '{' {
+		return ParseKeySet(trimmed)
+	}
+	if !bytes.HasPrefix(trimmed, []byte("-----BEGIN")) {
+		return HMACKeySet(trimmed), nil
+	}
+	set := &KeySet{}
+	for rest := trimmed; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		var key any
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", strings.ToLower(block.Type), err)
+		}
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+			set.Keys = append(set.Keys, Key{Key: key})
+		}
+	}
+	if len(set.Keys) == 0 {
+		return nil, fmt.Errorf("no RSA or EC public key in PEM data")
+	}
+	return set, nil
+}
+
+func (k jwk) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, nil
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil || len(secret) == 0 {
+			return nil, fmt.Errorf("invalid symmetric key")
+		}
+		return secret, nil
+	}
+	return nil, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+const (
+	jwksTTL          = time.Hour
+	jwksMinRefresh   = 30 * time.Second
+	maxJWKSDocument  = 1 << 20
+	jwksFetchTimeout = 10 * time.Second
+)
+
+// RemoteKeySet caches a JWKS fetched over HTTP. Keys are refreshed hourly,
+// and earlier when a token names an unknown kid, so that provider key
+// rotation is picked up without a restart. Fetches, failed ones included,
+// happen at most every 30 seconds and one at a time; concurrent callers wait
+// for the fetch in flight instead of starting their own.
+type RemoteKeySet struct {
+	URL    string
+	Client *http.Client
+
+	mu        sync.Mutex
+	set       *KeySet
+	fetched   time.Time     // last successful fetch
+	attempted time.Time     // last fetch, successful or not
+	err       error         // error of the last fetch
+	inFlight  chan struct{} // closed when the running fetch completes
+}
+
+// NewRemoteKeySet returns a cache for the JWKS at url.
+func NewRemoteKeySet(url string) *RemoteKeySet {
+	return &RemoteKeySet{URL: url, Client: &http.Client{Timeout: jwksFetchTimeout}}
+}
+
+// Keys returns the cached set, fetching it when it is missing, old, or has
+// no key with the wanted kid.
+func (r *RemoteKeySet) Keys(ctx context.Context, kid string) (*KeySet, error) {
+	r.mu.Lock()
+	stale := r.set == nil || time.Since(r.fetched) > jwksTTL
+	unknownKid := r.set != nil && kid != "" && !r.hasKid(kid)
+	if !stale && !unknownKid {
+		defer r.mu.Unlock()
+		return r.set, nil
+	}
+	if done := r.inFlight; done != nil {
+		r.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.cachedLocked()
+	}
+	if time.Since(r.attempted) < jwksMinRefresh {
+		defer r.mu.Unlock()
+		return r.cachedLocked()
+	}
+	done := make(chan struct{})
+	r.inFlight, r.attempted = done, time.Now()
+	r.mu.Unlock()
+
+	// Waiting callers share the result, so one of them going away must not
+	// cancel the fetch; the client timeout bounds it.
+	set, err := r.fetch(context.WithoutCancel(ctx))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.inFlight, r.err = nil, err
+	if err == nil {
+		r.set, r.fetched = set, time.Now()
+	}
+	close(done)
+	return r.cachedLocked()
+}
+
+// cachedLocked returns the last good keys, or the last fetch error when
+// there are none.
+func (r *RemoteKeySet) cachedLocked() (*KeySet, error) {
+	if r.set != nil {
+		return r.set, nil // keep verifying with the last good keys
+	}
+	return nil, r.err
+}
+
+func (r *RemoteKeySet) hasKid(kid string) bool {
+	for _, key := range r.set.Keys {
+		if key.Kid == kid {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RemoteKeySet) fetch(ctx context.Context) (*KeySet, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch JWKS: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxJWKSDocument))
+	if err != nil {
+		return nil, fmt.Errorf("fetch JWKS: %w", err)
+	}
+	return ParseKeySet(data)
+}
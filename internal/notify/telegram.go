@@ -126,17 +126,8 @@ func (n *TelegramNotifier) HandleCallback(data string, fromChatID int64) (string
 	if cfg.Token == "" || len(cfg.ChatIDs) == 0 {
 		return "", "", fmt.Errorf("telegram is not configured")
 	}
-	if len(cfg.ChatIDs) > 0 {
-		allowed := false
-		for _, id := range cfg.ChatIDs {
-			if id == fromChatID {
-				allowed = true
-				break
-			}
-		}
-		if !allowed {
-			return "", "Unauthorized chat", nil
-		}
+	if !n.IsAdminChat(fromChatID) {
+		return "", "Unauthorized chat", nil
 	}
 	if !strings.HasPrefix(data, "ban:") {
 		return "", "Unsupported action", nil
@@ -148,6 +139,17 @@ func (n *TelegramNotifier) HandleCallback(data string, fromChatID int64) (string
 	return ip, "", nil
 }
 
+// IsAdminChat reports whether chatID is one of the configured notification
+// chats, which may run admin actions.
+func (n *TelegramNotifier) IsAdminChat(chatID int64) bool {
+	for _, id := range n.store.Get().ChatIDs {
+		if id == chatID {
+			return true
+		}
+	}
+	return false
+}
+
 func (n *TelegramNotifier) SendActionResult(text string) {
 	cfg := n.store.Get()
 	chatIDs := targetChatIDs(cfg)
@@ -4,9 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"net/http"
-	"net/netip"
 	"router/internal/clog"
-	"strings"
 	"sync"
 	"time"
 )
@@ -63,30 +61,6 @@ func (h *Handler) invalidateSession(token string) {
 	h.auth.sessionsMu.Unlock()
 }
 
-func clientIPFromRequest(r *http.Request) string {
-	xff := strings.TrimSpace(r.Header.Get("X-Forwarded-For"))
-	if xff != "" {
-		parts := strings.Split(xff, ",")
-		if len(parts) > 0 {
-			ip := strings.TrimSpace(parts[0])
-			if addr, err := netip.ParseAddr(ip); err == nil {
-				return addr.String()
-			}
-		}
-	}
-	hostPort := strings.TrimSpace(r.RemoteAddr)
-	if hostPort == "" {
-		return "unknown"
-	}
-	if addr, err := netip.ParseAddrPort(hostPort); err == nil {
-		return addr.Addr().String()
-	}
-	if addr, err := netip.ParseAddr(hostPort); err == nil {
-		return addr.String()
-	}
-	return hostPort
-}
-
 func (h *Handler) checkLoginBlocked(ip string) (time.Duration, bool) {
 	h.auth.loginFailsMu.Lock()
 	defer h.auth.loginFailsMu.Unlock()
@@ -5,6 +5,8 @@ import (
 	"html/template"
 	"net/http"
 	"net/url"
+	"router/internal/cache"
+	"router/internal/clientip"
 	"router/internal/clog"
 	"strconv"
 	"strings"
@@ -12,6 +14,7 @@ import (
 	"router/internal/gpt"
 	"router/internal/logstream"
 	"router/internal/notify"
+	"router/internal/proxyproto"
 	"router/internal/stats"
 	"router/internal/storage"
 
@@ -53,10 +56,14 @@ type Handler struct {
 	gptStore    *storage.GPTStore
 	gptClient   *gpt.Client
 	notifier    *notify.TelegramNotifier
+	streamStore *storage.StreamStore
+	cacheStore  *cache.Store
+	signatures  *storage.SignatureStore
+	allowlist   *storage.AllowlistStore
 }
 
 // NewHandler creates a new panel handler
-func NewHandler(store *storage.RuleStore, adminStore *storage.AdminStore, stats *stats.Stats, broadcaster *logstream.Broadcaster, ipStore *storage.IPReputationStore, backupStore *storage.BackupStore, notifyStore *storage.NotificationStore, gptStore *storage.GPTStore, gptClient *gpt.Client, notifier *notify.TelegramNotifier) *Handler {
+func NewHandler(store *storage.RuleStore, adminStore *storage.AdminStore, stats *stats.Stats, broadcaster *logstream.Broadcaster, ipStore *storage.IPReputationStore, backupStore *storage.BackupStore, notifyStore *storage.NotificationStore, gptStore *storage.GPTStore, gptClient *gpt.Client, notifier *notify.TelegramNotifier, streamStore *storage.StreamStore, cacheStore *cache.Store, signatures *storage.SignatureStore, allowlist *storage.AllowlistStore) *Handler {
 	templates := make(map[string]*template.Template)
 
 	// Parse templates
@@ -81,6 +88,10 @@ func NewHandler(store *storage.RuleStore, adminStore *storage.AdminStore, stats
 		gptStore:    gptStore,
 		gptClient:   gptClient,
 		notifier:    notifier,
+		streamStore: streamStore,
+		cacheStore:  cacheStore,
+		signatures:  signatures,
+		allowlist:   allowlist,
 	}
 }
 
@@ -142,9 +153,14 @@ func (h *Handler) Index(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		streams := []storage.StreamRule{}
+		if h.streamStore != nil {
+			streams = h.streamStore.List()
+		}
 		data := map[string]interface{}{
 			"Rules":           h.store.All(),
 			"MaintenanceMode": h.store.MaintenanceMode,
+			"Streams":         streams,
 		}
 		h.render(w, r, "index", data)
 	}).ServeHTTP(w, r)
@@ -165,11 +181,111 @@ func (h *Handler) Notifications(w http.ResponseWriter, r *http.Request) {
 	h.serveStaticAuth("internal/panel/static/notifications.html").ServeHTTP(w, r)
 }
 
+// WAF serves the request signature editor.
+func (h *Handler) WAF(w http.ResponseWriter, r *http.Request) {
+	h.serveStaticAuth("internal/panel/static/waf.html").ServeHTTP(w, r)
+}
+
 // Settings serves GPT settings page.
 func (h *Handler) Settings(w http.ResponseWriter, r *http.Request) {
 	h.serveStaticAuth("internal/panel/static/settings.html").ServeHTTP(w, r)
 }
 
+// RuleSettings serves the per-rule settings page.
+func (h *Handler) RuleSettings(w http.ResponseWriter, r *http.Request) {
+	h.serveStaticAuth("internal/panel/static/rule.html").ServeHTTP(w, r)
+}
+
+// RuleData returns the full settings of a single rule.
+func (h *Handler) RuleData(w http.ResponseWriter, r *http.Request) {
+	h.basicAuth(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.TrimSpace(r.URL.Query().Get("host"))
+		rule, ok := h.store.Snapshot(host)
+		if !ok {
+			http.Error(w, "Rule not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"host": host, "rule": rule})
+	}).ServeHTTP(w, r)
+}
+
+// SaveRuleConfig replaces the settings of a rule with the posted JSON.
+func (h *Handler) SaveRuleConfig(w http.ResponseWriter, r *http.Request) {
+	h.basicAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		host := strings.TrimSpace(r.URL.Query().Get("host"))
+		var rule storage.Rule
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&rule); err != nil {
+			http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.store.Update(host, rule); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		saved, _ := h.store.Snapshot(host)
+		writeJSON(w, map[string]interface{}{"host": host, "rule": saved})
+	}).ServeHTTP(w, r)
+}
+
+// SaveRuleWeights changes canary variant weights without touching the rest of
+// the rule; open connections are kept.
+func (h *Handler) SaveRuleWeights(w http.ResponseWriter, r *http.Request) {
+	h.basicAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		host := strings.TrimSpace(r.URL.Query().Get("host"))
+		var payload struct {
+			Weights map[string]int `json:"weights"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&payload); err != nil {
+			http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.store.SetCanaryWeights(host, payload.Weights); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		clog.Infof("[canary] weights of %s changed: %v", host, payload.Weights)
+		saved, _ := h.store.Snapshot(host)
+		writeJSON(w, map[string]interface{}{"host": host, "rule": saved})
+	}).ServeHTTP(w, r)
+}
+
+// PurgeCache removes a cached URL, or with prefix=on everything under it.
+func (h *Handler) PurgeCache(w http.ResponseWriter, r *http.Request) {
+	h.basicAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		target := strings.TrimSpace(r.FormValue("url"))
+		if target == "" {
+			http.Error(w, "URL is required", http.StatusBadRequest)
+			return
+		}
+		purged := 0
+		if h.cacheStore != nil {
+			purged = h.cacheStore.Purge(target, r.FormValue("prefix") == "on")
+		}
+		clog.Infof("[cache-purge] %s prefix=%t removed=%d", target, r.FormValue("prefix") == "on", purged)
+		writeJSON(w, map[string]interface{}{"purged": purged})
+	}).ServeHTTP(w, r)
+}
+
+func (h *Handler) cacheData() map[string]interface{} {
+	data := map[string]interface{}{"hosts": h.stats.GetCacheData()}
+	if h.cacheStore != nil {
+		data["usage"] = h.cacheStore.Usage()
+	}
+	return data
+}
+
 // AddRule adds a new routing rule
 func (h *Handler) AddRule(w http.ResponseWriter, r *http.Request) {
 	h.basicAuth(func(w http.ResponseWriter, r *http.Request) {
@@ -223,6 +339,90 @@ func (h *Handler) RuleMaintenance(w http.ResponseWriter, r *http.Request) {
 	}).ServeHTTP(w, r)
 }
 
+// RulePassthrough toggles TLS passthrough for a specific rule.
+func (h *Handler) RulePassthrough(w http.ResponseWriter, r *http.Request) {
+	h.basicAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		host := r.FormValue("host")
+		if host == "" {
+			http.Error(w, "Host is required", http.StatusBadRequest)
+			return
+		}
+		passthrough := r.FormValue("passthrough") == "on"
+		h.store.SetRulePassthrough(host, passthrough)
+		http.Redirect(w, r, "/", http.StatusFound)
+	}).ServeHTTP(w, r)
+}
+
+// RuleProxyProtocol sets the outbound PROXY protocol version for a specific rule.
+func (h *Handler) RuleProxyProtocol(w http.ResponseWriter, r *http.Request) {
+	h.basicAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		host := r.FormValue("host")
+		if host == "" {
+			http.Error(w, "Host is required", http.StatusBadRequest)
+			return
+		}
+		h.store.SetRuleProxyProtocol(host, proxyproto.NormalizeVersion(r.FormValue("proxyProtocol")))
+		http.Redirect(w, r, "/", http.StatusFound)
+	}).ServeHTTP(w, r)
+}
+
+// AddStream creates or updates a TCP/UDP stream rule.
+func (h *Handler) AddStream(w http.ResponseWriter, r *http.Request) {
+	h.basicAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if h.streamStore == nil {
+			http.Error(w, "stream storage is disabled", http.StatusServiceUnavailable)
+			return
+		}
+		_, err := h.streamStore.Upsert(storage.StreamRule{
+			ID:            strings.TrimSpace(r.FormValue("id")),
+			Name:          r.FormValue("name"),
+			Protocol:      r.FormValue("protocol"),
+			Listen:        r.FormValue("listen"),
+			Target:        r.FormValue("target"),
+			Enabled:       true,
+			ProxyProtocol: r.FormValue("proxyProtocol"),
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusFound)
+	}).ServeHTTP(w, r)
+}
+
+// RemoveStream deletes a TCP/UDP stream rule.
+func (h *Handler) RemoveStream(w http.ResponseWriter, r *http.Request) {
+	h.basicAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if h.streamStore == nil {
+			http.Error(w, "stream storage is disabled", http.StatusServiceUnavailable)
+			return
+		}
+		id := strings.TrimSpace(r.FormValue("id"))
+		if id == "" {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+		h.streamStore.Delete(id)
+		http.Redirect(w, r, "/", http.StatusFound)
+	}).ServeHTTP(w, r)
+}
+
 // StatsData provides stats data as JSON
 func (h *Handler) StatsData(w http.ResponseWriter, r *http.Request) {
 	h.basicAuth(func(w http.ResponseWriter, r *http.Request) {
@@ -236,6 +436,14 @@ func (h *Handler) StatsData(w http.ResponseWriter, r *http.Request) {
 			suspicious = h.ipStore.List()
 			autoBanned = h.ipStore.AutoBannedList()
 		}
+		allowlist := []storage.AllowEntry{}
+		if h.allowlist != nil {
+			allowlist = h.allowlist.List()
+		}
+		blocklists := []storage.BlocklistSource{}
+		if store := h.blocklists(); store != nil {
+			blocklists = store.List()
+		}
 		requestData := h.stats.GetRequestData()
 		memoryLabels, memoryValues, memoryPercents := h.stats.GetMemoryData()
 		cpuLabels, cpuPercents := h.stats.GetCPUData()
@@ -257,8 +465,16 @@ func (h *Handler) StatsData(w http.ResponseWriter, r *http.Request) {
 			"disks":      diskData,
 			"countries":  countryData,
 			"ssh":        sshData,
+			"streams":    h.stats.GetStreamData(),
+			"liveConns":  h.stats.GetLiveConnData(),
+			"cache":      h.cacheData(),
+			"limits":     h.stats.GetLimitData(),
+			"mirrors":    h.stats.GetMirrorData(),
+			"canary":     h.stats.GetCanaryData(),
 			"suspicious": suspicious,
 			"autoBanned": autoBanned,
+			"allowlist":  allowlist,
+			"blocklists": blocklists,
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -306,9 +522,14 @@ func (h *Handler) BanSuspiciousIP(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "ip storage is disabled", http.StatusServiceUnavailable)
 			return
 		}
-		h.ipStore.Ban(ip)
+		if err := h.ipStore.CheckBan(ip); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		target, _ := storage.ParseBanTarget(ip)
+		h.ipStore.Ban(target)
 		if h.notifier != nil {
-			h.notifier.Notify("manual_ban", "manual-ban:"+ip, "⛔️ Manual ban\nip: "+ip)
+			h.notifier.Notify("manual_ban", "manual-ban:"+target, "⛔️ Manual ban\nip: "+target)
 		}
 		w.WriteHeader(http.StatusNoContent)
 	}).ServeHTTP(w, r)
@@ -354,7 +575,7 @@ func (h *Handler) RemoveSuspiciousIP(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "ip storage is disabled", http.StatusServiceUnavailable)
 			return
 		}
-		if h.ipStore.IsBanned(ip) {
+		if h.ipStore.HasBan(ip) {
 			http.Error(w, "cannot remove banned ip; unban first", http.StatusBadRequest)
 			return
 		}
@@ -366,6 +587,165 @@ func (h *Handler) RemoveSuspiciousIP(w http.ResponseWriter, r *http.Request) {
 	}).ServeHTTP(w, r)
 }
 
+// AllowIP adds an IP or CIDR range with a comment to the allowlist.
+func (h *Handler) AllowIP(w http.ResponseWriter, r *http.Request) {
+	h.basicAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if h.allowlist == nil {
+			http.Error(w, "allowlist is disabled", http.StatusServiceUnavailable)
+			return
+		}
+		entry, err := h.allowlist.Add(r.FormValue("ip"), r.FormValue("comment"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		clog.Infof("[allowlist] added %s", entry)
+		writeJSON(w, map[string]interface{}{"entry": entry})
+	}).ServeHTTP(w, r)
+}
+
+// UnallowIP removes an IP or CIDR range from the allowlist.
+func (h *Handler) UnallowIP(w http.ResponseWriter, r *http.Request) {
+	h.basicAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if h.allowlist == nil {
+			http.Error(w, "allowlist is disabled", http.StatusServiceUnavailable)
+			return
+		}
+		ip := strings.TrimSpace(r.FormValue("ip"))
+		if !h.allowlist.Remove(ip) {
+			http.Error(w, "not in allowlist", http.StatusNotFound)
+			return
+		}
+		clog.Infof("[allowlist] removed %s", ip)
+		w.WriteHeader(http.StatusNoContent)
+	}).ServeHTTP(w, r)
+}
+
+// blocklists returns the external blocklists of the IP reputation store.
+func (h *Handler) blocklists() *storage.BlocklistStore {
+	if h.ipStore == nil {
+		return nil
+	}
+	return h.ipStore.Blocklists
+}
+
+// SaveBlocklist adds or updates an external blocklist and loads it.
+func (h *Handler) SaveBlocklist(w http.ResponseWriter, r *http.Request) {
+	h.basicAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		store := h.blocklists()
+		if store == nil {
+			http.Error(w, "blocklists are disabled", http.StatusServiceUnavailable)
+			return
+		}
+		refresh := 0
+		if raw := strings.TrimSpace(r.FormValue("refreshMinutes")); raw != "" {
+			value, err := strconv.Atoi(raw)
+			if err != nil {
+				http.Error(w, "invalid refresh interval", http.StatusBadRequest)
+				return
+			}
+			refresh = value
+		}
+		src, err := store.Upsert(storage.BlocklistSource{
+			Tag:            r.FormValue("tag"),
+			Source:         r.FormValue("source"),
+			Enabled:        r.FormValue("enabled") != "",
+			RefreshMinutes: refresh,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		clog.Infof("[blocklist] saved %s from %s", src.Tag, src.Source)
+		if src.Enabled {
+			go func() {
+				if err := store.Refresh(src.Tag); err != nil {
+					clog.Warnf("[blocklist] %s: %v", src.Tag, err)
+				}
+			}()
+		}
+		writeJSON(w, map[string]interface{}{"blocklist": src})
+	}).ServeHTTP(w, r)
+}
+
+// ToggleBlocklist enables or disables an external blocklist.
+func (h *Handler) ToggleBlocklist(w http.ResponseWriter, r *http.Request) {
+	h.basicAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		store := h.blocklists()
+		if store == nil {
+			http.Error(w, "blocklists are disabled", http.StatusServiceUnavailable)
+			return
+		}
+		tag := strings.TrimSpace(r.FormValue("tag"))
+		enabled := r.FormValue("enabled") != ""
+		if err := store.SetEnabled(tag, enabled); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		clog.Infof("[blocklist] %s enabled=%v", tag, enabled)
+		w.WriteHeader(http.StatusNoContent)
+	}).ServeHTTP(w, r)
+}
+
+// RefreshBlocklist reloads an external blocklist right away.
+func (h *Handler) RefreshBlocklist(w http.ResponseWriter, r *http.Request) {
+	h.basicAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		store := h.blocklists()
+		if store == nil {
+			http.Error(w, "blocklists are disabled", http.StatusServiceUnavailable)
+			return
+		}
+		tag := strings.TrimSpace(r.FormValue("tag"))
+		if err := store.Refresh(tag); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}).ServeHTTP(w, r)
+}
+
+// RemoveBlocklist deletes an external blocklist and its entries.
+func (h *Handler) RemoveBlocklist(w http.ResponseWriter, r *http.Request) {
+	h.basicAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		store := h.blocklists()
+		if store == nil {
+			http.Error(w, "blocklists are disabled", http.StatusServiceUnavailable)
+			return
+		}
+		tag := strings.TrimSpace(r.FormValue("tag"))
+		if !store.Remove(tag) {
+			http.Error(w, "unknown blocklist", http.StatusNotFound)
+			return
+		}
+		clog.Infof("[blocklist] removed %s", tag)
+		w.WriteHeader(http.StatusNoContent)
+	}).ServeHTTP(w, r)
+}
+
 // BackupsData returns backup jobs and existing archives.
 func (h *Handler) BackupsData(w http.ResponseWriter, r *http.Request) {
 	h.basicAuth(func(w http.ResponseWriter, r *http.Request) {
@@ -520,17 +900,23 @@ func (h *Handler) TelegramWebhook(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
-		if h.gptClient == nil || h.notifier == nil {
-			clog.Warnf("Telegram webhook: gpt client or notifier is nil")
+		chatID := update.Message.Chat.ID
+		text := strings.TrimSpace(update.Message.Text)
+		// Allowlist commands need only the notifier and an admin chat, not GPT.
+		if reply, ok := h.allowlistCommand(chatID, text); ok {
+			_ = h.notifier.SendMessageToChat(chatID, reply)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if h.gptClient == nil {
+			clog.Warnf("Telegram webhook: gpt client is nil")
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
-		chatID := update.Message.Chat.ID
-		text := strings.TrimSpace(update.Message.Text)
 		clog.Infof("Telegram webhook: incoming message chat_id=%d text_len=%d", chatID, len(text))
 		if text == "/start" || text == "/help" {
 			clog.Debugf("Telegram webhook: help command chat_id=%d", chatID)
-			_ = h.notifier.SendMessageToChat(chatID, "Привет! Я бот Router. Пишите сообщение, и я отвечу через GPT.\nКоманды: /help")
+			_ = h.notifier.SendMessageToChat(chatID, "Привет! Я бот Router. Пишите сообщение, и я отвечу через GPT.\nКоманды: /help, /allowlist, /allow <ip|cidr> [комментарий], /unallow <ip|cidr>")
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
@@ -563,11 +949,64 @@ func (h *Handler) TelegramWebhook(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "ip storage is disabled", http.StatusServiceUnavailable)
 		return
 	}
+	if err := h.ipStore.CheckBan(ip); err != nil {
+		h.notifier.SendActionResult("⚠️ Ban refused\n" + err.Error())
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
 	h.ipStore.Ban(ip)
 	h.notifier.SendActionResult("⛔️ Banned from Telegram action\nip: " + ip)
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// allowlistCommand handles the /allowlist, /allow and /unallow bot commands
+// from admin chats. ok is false when text is not one of them.
+func (h *Handler) allowlistCommand(chatID int64, text string) (reply string, ok bool) {
+	fields := strings.Fields(text)
+	command := strings.SplitN(fields[0], "@", 2)[0]
+	if command != "/allowlist" && command != "/allow" && command != "/unallow" {
+		return "", false
+	}
+	if !h.notifier.IsAdminChat(chatID) {
+		return "Unauthorized chat", true
+	}
+	if h.allowlist == nil {
+		return "Allowlist is disabled", true
+	}
+
+	switch command {
+	case "/allowlist":
+		entries := h.allowlist.List()
+		if len(entries) == 0 {
+			return "Allowlist is empty", true
+		}
+		lines := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			lines = append(lines, "• "+entry.String())
+		}
+		return "✅ Allowlist\n" + strings.Join(lines, "\n"), true
+	case "/allow":
+		if len(fields) < 2 {
+			return "Usage: /allow <ip|cidr> [comment]", true
+		}
+		entry, err := h.allowlist.Add(fields[1], strings.Join(fields[2:], " "))
+		if err != nil {
+			return "⚠️ " + err.Error(), true
+		}
+		clog.Infof("[allowlist] added %s from telegram chat %d", entry, chatID)
+		return "✅ Allowlisted\n" + entry.String(), true
+	default:
+		if len(fields) < 2 {
+			return "Usage: /unallow <ip|cidr>", true
+		}
+		if !h.allowlist.Remove(fields[1]) {
+			return "⚠️ " + fields[1] + " is not in the allowlist", true
+		}
+		clog.Infof("[allowlist] removed %s from telegram chat %d", fields[1], chatID)
+		return "🧹 Removed from allowlist\n" + fields[1], true
+	}
+}
+
 // NotificationsData returns telegram settings.
 func (h *Handler) NotificationsData(w http.ResponseWriter, r *http.Request) {
 	h.basicAuth(func(w http.ResponseWriter, r *http.Request) {
@@ -677,6 +1116,86 @@ func (h *Handler) TestNotification(w http.ResponseWriter, r *http.Request) {
 	}).ServeHTTP(w, r)
 }
 
+// WAFData returns the built-in signature packs, custom signatures and hit counts.
+func (h *Handler) WAFData(w http.ResponseWriter, r *http.Request) {
+	h.basicAuth(func(w http.ResponseWriter, r *http.Request) {
+		if h.signatures == nil {
+			http.Error(w, "signature storage is disabled", http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, map[string]interface{}{
+			"packs":      h.signatures.Packs(),
+			"signatures": h.signatures.List(),
+			"hits":       h.stats.GetWAFData(),
+		})
+	}).ServeHTTP(w, r)
+}
+
+// SaveWAFSignature creates or replaces a custom signature from the posted JSON.
+func (h *Handler) SaveWAFSignature(w http.ResponseWriter, r *http.Request) {
+	h.basicAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if h.signatures == nil {
+			http.Error(w, "signature storage is disabled", http.StatusServiceUnavailable)
+			return
+		}
+		var sig storage.Signature
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&sig); err != nil {
+			http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		saved, err := h.signatures.Upsert(sig)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"signature": saved})
+	}).ServeHTTP(w, r)
+}
+
+// DeleteWAFSignature removes a custom signature.
+func (h *Handler) DeleteWAFSignature(w http.ResponseWriter, r *http.Request) {
+	h.basicAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if h.signatures == nil {
+			http.Error(w, "signature storage is disabled", http.StatusServiceUnavailable)
+			return
+		}
+		id := strings.TrimSpace(r.FormValue("id"))
+		if !h.signatures.Delete(id) {
+			http.Error(w, "Signature not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}).ServeHTTP(w, r)
+}
+
+// SetWAFPack switches a built-in signature pack and its action override.
+func (h *Handler) SetWAFPack(w http.ResponseWriter, r *http.Request) {
+	h.basicAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if h.signatures == nil {
+			http.Error(w, "signature storage is disabled", http.StatusServiceUnavailable)
+			return
+		}
+		name := strings.TrimSpace(r.FormValue("name"))
+		if err := h.signatures.SetPack(name, r.FormValue("enabled") == "on", r.FormValue("action")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}).ServeHTTP(w, r)
+}
+
 // SettingsData returns GPT settings.
 func (h *Handler) SettingsData(w http.ResponseWriter, r *http.Request) {
 	h.basicAuth(func(w http.ResponseWriter, r *http.Request) {
@@ -746,7 +1265,7 @@ func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "admin storage is disabled", http.StatusServiceUnavailable)
 		return
 	}
-	clientIP := clientIPFromRequest(r)
+	clientIP := clientip.FromRequest(r)
 	if retryAfter, blocked := h.checkLoginBlocked(clientIP); blocked {
 		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
 		http.Error(w, "Too many failed login attempts. Try later.", http.StatusTooManyRequests)
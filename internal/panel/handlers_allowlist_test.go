@@ -0,0 +1,64 @@
+package panel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"router/internal/notify"
+	"router/internal/storage"
+	"strings"
+	"testing"
+)
+
+func TestAllowlistTelegramCommands(t *testing.T) {
+	dir := t.TempDir()
+	notifyStore := storage.NewNotificationStore(filepath.Join(dir, "notifications.json"))
+	notifyStore.Update(storage.NotificationConfig{Token: "t", ChatIDs: []int64{-100123}})
+	h := &Handler{notifier: notify.NewTelegramNotifier(notifyStore), allowlist: storage.NewAllowlistStore(filepath.Join(dir, "ip_allowlist.json"))}
+
+	if _, ok := h.allowlistCommand(-100123, "hello there"); ok {
+		t.Fatalf("plain text must not be treated as a command")
+	}
+	if reply, _ := h.allowlistCommand(-999, "/allow 203.0.113.9"); reply != "Unauthorized chat" {
+		t.Fatalf("expected unauthorized chat to be refused, got %q", reply)
+	}
+	if reply, _ := h.allowlistCommand(-100123, "/allow@RouterBot 203.0.113.9 uptime robot"); !strings.Contains(reply, "203.0.113.9 — uptime robot") {
+		t.Fatalf("unexpected /allow reply: %q", reply)
+	}
+	if reply, _ := h.allowlistCommand(-100123, "/allow nonsense"); !strings.HasPrefix(reply, "⚠️") {
+		t.Fatalf("expected invalid target to be reported, got %q", reply)
+	}
+	if reply, _ := h.allowlistCommand(-100123, "/allowlist"); !strings.Contains(reply, "203.0.113.9") {
+		t.Fatalf("unexpected /allowlist reply: %q", reply)
+	}
+	if reply, _ := h.allowlistCommand(-100123, "/unallow 203.0.113.9"); !strings.Contains(reply, "Removed") {
+		t.Fatalf("unexpected /unallow reply: %q", reply)
+	}
+	if len(h.allowlist.List()) != 0 {
+		t.Fatalf("expected the allowlist to be empty")
+	}
+}
+
+func TestTelegramWebhookRunsAllowlistCommandsWithoutGPT(t *testing.T) {
+	dir := t.TempDir()
+	notifyStore := storage.NewNotificationStore(filepath.Join(dir, "notifications.json"))
+	notifyStore.Update(storage.NotificationConfig{ChatIDs: []int64{-100123}})
+	h := &Handler{
+		notifyStore: notifyStore,
+		notifier:    notify.NewTelegramNotifier(notifyStore),
+		allowlist:   storage.NewAllowlistStore(filepath.Join(dir, "ip_allowlist.json")),
+	}
+
+	for _, chatID := range []string{"-999", "-100123"} {
+		body := `{"message":{"text":"/allow 203.0.113.9","chat":{"id":` + chatID + `}}}`
+		rec := httptest.NewRecorder()
+		h.TelegramWebhook(rec, httptest.NewRequest(http.MethodPost, "/telegram/webhook", strings.NewReader(body)))
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("chat %s: status %d", chatID, rec.Code)
+		}
+	}
+	entries := h.allowlist.List()
+	if len(entries) != 1 || !strings.Contains(entries[0].String(), "203.0.113.9") {
+		t.Fatalf("expected only the admin chat to allowlist the IP, got %v", entries)
+	}
+}
@@ -3,6 +3,7 @@ package panel
 import (
 	"net/http"
 	"net/http/httptest"
+	"router/internal/clientip"
 	"testing"
 	"time"
 )
@@ -18,11 +19,16 @@ func TestBruteforceBlockAfterFiveFailures(t *testing.T) {
 	}
 }
 
-func TestClientIPFromRequest(t *testing.T) {
+func TestLoginClientIPIgnoresSpoofedForwardedFor(t *testing.T) {
 	r := httptest.NewRequest("POST", "/login", nil)
 	r.Header.Set("X-Forwarded-For", "9.8.7.6, 1.1.1.1")
-	if got := clientIPFromRequest(r); got != "9.8.7.6" {
-		t.Fatalf("unexpected client ip: %s", got)
+	if got := clientip.FromRequest(r); got != "192.0.2.1" {
+		t.Fatalf("untrusted peer must not choose its login rate-limit key, got %s", got)
+	}
+
+	r.RemoteAddr = "127.0.0.1:5000"
+	if got := clientip.FromRequest(r); got != "1.1.1.1" {
+		t.Fatalf("local reverse proxy should be trusted, got %s", got)
 	}
 }
 
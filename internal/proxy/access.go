@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"net/netip"
+	"router/internal/clog"
+	"router/internal/storage"
+	"slices"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const defaultAuthRealm = "Restricted"
+
+// checkAccess applies the rule's access policy and answers 403 or 401 when the
+// client is not let in. It reports whether the request may proceed.
+func (p *Proxy) checkAccess(w http.ResponseWriter, r *http.Request, policy *storage.AccessPolicy, remoteIP, country string) bool {
+	if policy == nil {
+		return true
+	}
+	addr, err := netip.ParseAddr(remoteIP)
+	if err == nil {
+		addr = addr.Unmap()
+	}
+	if (err == nil && inPrefixes(addr, policy.DenyCIDRs)) || slices.Contains(policy.DenyCountries, country) {
+		p.denyAccess(w, r, remoteIP, country, "deny list")
+		return false
+	}
+
+	listed := len(policy.AllowCIDRs)+len(policy.AllowCountries) > 0
+	allowed := (err == nil && inPrefixes(addr, policy.AllowCIDRs)) || slices.Contains(policy.AllowCountries, country)
+	if policy.Satisfy == storage.SatisfyAny && allowed {
+		return true
+	}
+	if listed && !allowed && policy.Satisfy != storage.SatisfyAny {
+		p.denyAccess(w, r, remoteIP, country, "not in allow list")
+		return false
+	}
+
+	if policy.BasicAuth == nil {
+		return true
+	}
+	username, password, ok := r.BasicAuth()
+	if ok && p.verifyBasicAuth(policy.BasicAuth, username, password) {
+		// The credentials are for the router, not for the upstream.
+		r.Header.Del("Authorization")
+		return true
+	}
+	if ok {
+		clog.Warnf("[access-denied] %s %s host=%s remote=%s user=%q: wrong password", r.Method, r.URL.Path, r.Host, remoteIP, username)
+	}
+	realm := policy.BasicAuth.Realm
+	if realm == "" {
+		realm = defaultAuthRealm
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`", charset="UTF-8"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+func (p *Proxy) denyAccess(w http.ResponseWriter, r *http.Request, remoteIP, country, reason string) {
+	clog.Warnf("[access-denied] %s %s host=%s remote=%s country=%s: %s", r.Method, r.URL.Path, r.Host, remoteIP, country, reason)
+	http.Error(w, "Forbidden", http.StatusForbidden)
+}
+
+func inPrefixes(addr netip.Addr, cidrs []string) bool {
+	for _, cidr := range cidrs {
+		if prefix, err := netip.ParsePrefix(cidr); err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyBasicAuth checks credentials against the bcrypt hashes. Successful
+// checks are remembered so that every request of a logged in browser does
+// not pay for bcrypt; the key covers the hash, so a password change drops it.
+func (p *Proxy) verifyBasicAuth(auth *storage.BasicAuth, username, password string) bool {
+	for _, user := range auth.Users {
+		if subtle.ConstantTimeCompare([]byte(user.Username), []byte(username)) != 1 {
+			continue
+		}
+		key := sha256.Sum256([]byte(user.PasswordHash + "\x00" + username + "\x00" + password))
+		if _, ok := p.authCache.Load(key); ok {
+			return true
+		}
+		if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+			return false
+		}
+		p.authCache.Store(key, struct{}{})
+		return true
+	}
+	return false
+}
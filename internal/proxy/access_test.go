@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"router/internal/storage"
+	"strings"
+	"testing"
+)
+
+func TestAccessPolicyNetworksAndBasicAuth(t *testing.T) {
+	var gotAuth []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = append(gotAuth, r.Header.Get("Authorization"))
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	host := "staging.example.com"
+	p, store, _ := newRuleTestProxy(t, host, strings.TrimPrefix(upstream.URL, "http://"), storage.Rule{
+		Access: &storage.AccessPolicy{
+			AllowCIDRs: []string{"10.0.0.0/8"},
+			DenyCIDRs:  []string{"10.0.0.66"},
+			BasicAuth: &storage.BasicAuth{Users: []storage.BasicAuthUser{
+				{Username: "qa", Password: "secret"},
+			}},
+			Satisfy: storage.SatisfyAny,
+		},
+	})
+	if rule, _ := store.Snapshot(host); rule.Access.BasicAuth.Users[0].Password != "" || rule.Access.BasicAuth.Users[0].PasswordHash == "" {
+		t.Fatalf("password was not hashed: %+v", rule.Access.BasicAuth.Users[0])
+	}
+
+	serve := func(remote, user, pass string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		req.RemoteAddr = remote + ":1234"
+		if user != "" {
+			req.SetBasicAuth(user, pass)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := serve("10.1.2.3", "", ""); rec.Code != http.StatusOK {
+		t.Fatalf("office network: %d", rec.Code)
+	}
+	if rec := serve("10.0.0.66", "qa", "secret"); rec.Code != http.StatusForbidden {
+		t.Fatalf("denied address: %d", rec.Code)
+	}
+	rec := serve("172.16.0.1", "", "")
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") != `Basic realm="Restricted", charset="UTF-8"` {
+		t.Fatalf("outside without password: %d %q", rec.Code, rec.Header().Get("WWW-Authenticate"))
+	}
+	if rec := serve("172.16.0.1", "qa", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong password: %d", rec.Code)
+	}
+	for i := 0; i < 2; i++ {
+		if rec := serve("172.16.0.1", "qa", "secret"); rec.Code != http.StatusOK {
+			t.Fatalf("password login: %d", rec.Code)
+		}
+	}
+	for _, auth := range gotAuth {
+		if auth != "" {
+			t.Fatalf("Authorization leaked to upstream: %q", auth)
+		}
+	}
+
+	// With the default "all" mode the network check comes on top of the password.
+	rule, _ := store.Snapshot(host)
+	access := *rule.Access
+	access.Satisfy = ""
+	rule.Access = &access
+	if err := store.Update(host, rule); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if rec := serve("172.16.0.1", "qa", "secret"); rec.Code != http.StatusForbidden {
+		t.Fatalf("outside network in all mode: %d", rec.Code)
+	}
+	if rec := serve("10.1.2.3", "", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("office network without password in all mode: %d", rec.Code)
+	}
+
+	// Re-submitting the "add rule" form only changes the target.
+	store.Add(host, strings.TrimPrefix(upstream.URL, "http://"))
+	if rec := serve("172.16.0.1", "", ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("re-added rule lost its access policy: %d", rec.Code)
+	}
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"router/internal/cache"
+	"router/internal/clog"
+	"router/internal/storage"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func cacheDefaults(policy *storage.CachePolicy) cache.Defaults {
+	return cache.Defaults{
+		TTL:                  seconds(policy.DefaultTTLSec),
+		StaleWhileRevalidate: seconds(policy.StaleWhileRevalidateSec),
+		StaleIfError:         seconds(policy.StaleIfErrorSec),
+	}
+}
+
+// serveCached answers r from the cache when a usable entry exists. Stale
+// entries are served while a background request refreshes them, or while the
+// rule's service is down.
+func (p *Proxy) serveCached(w http.ResponseWriter, r *http.Request, rule *storage.Rule, upstreams []string, remoteIP string, vars headerVars) bool {
+	entry := p.Cache.Lookup(r)
+	now := time.Now()
+	switch {
+	case entry == nil:
+		p.stats.CacheResult(r.Host, "miss")
+		return false
+	case entry.IsFresh(now):
+		p.stats.CacheResult(r.Host, "hit")
+		writeCached(w, r, entry, rule, vars, "HIT")
+		return true
+	case rule.ServiceDown && entry.CanServeOnError(now):
+		p.stats.CacheResult(r.Host, "stale")
+		writeCached(w, r, entry, rule, vars, "STALE")
+		return true
+	case entry.CanRevalidateInBackground(now):
+		p.stats.CacheResult(r.Host, "stale")
+		p.revalidate(r, rule, upstreams, remoteIP, vars)
+		writeCached(w, r, entry, rule, vars, "STALE")
+		return true
+	}
+	p.stats.CacheResult(r.Host, "miss")
+	return false
+}
+
+// revalidate refreshes the entry for r in the background, once per key.
+func (p *Proxy) revalidate(r *http.Request, rule *storage.Rule, upstreams []string, remoteIP string, vars headerVars) {
+	key := cache.Key(r)
+	if _, busy := p.revalidating.LoadOrStore(key, struct{}{}); busy {
+		return
+	}
+	req := r.Clone(context.Background())
+	req.Method = http.MethodGet
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+	go func() {
+		defer p.revalidating.Delete(key)
+		proxy, req := p.reverseProxy(req, rule, upstreams, remoteIP, vars, true)
+		proxy.ServeHTTP(&discardResponseWriter{header: http.Header{}}, req)
+	}()
+}
+
+// cacheResponse stores a cacheable upstream response once its body has been
+// read in full, or replaces a 5xx response with a stale entry when allowed.
+func (p *Proxy) cacheResponse(r *http.Request, resp *http.Response, policy *storage.CachePolicy) {
+	now := time.Now()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		if entry := p.Cache.Lookup(r); entry != nil && entry.CanServeOnError(now) {
+			clog.Warnf("[cache-stale] %s %s host=%s upstream status %d", r.Method, r.URL.Path, r.Host, resp.StatusCode)
+			resp.Body.Close()
+			resp.StatusCode = entry.Status
+			resp.Header = cachedHeader(entry, now, "STALE")
+			resp.Body = io.NopCloser(bytes.NewReader(entry.Body))
+			resp.ContentLength = int64(len(entry.Body))
+			return
+		}
+	}
+	entry := cache.Policy(resp, now, cacheDefaults(policy))
+	// Encoded bodies are not stored: the cache keeps one identity copy per variant.
+	if entry != nil && r.Method == http.MethodGet && resp.Header.Get("Content-Encoding") == "" {
+		entry.Header = resp.Header.Clone()
+		resp.Body = &captureBody{ReadCloser: resp.Body, limit: p.Cache.MaxEntryBytes(), done: func(body []byte) {
+			entry.Body = body
+			p.Cache.Put(r, entry)
+		}}
+	}
+	resp.Header.Set("X-Cache", "MISS")
+}
+
+func cachedHeader(entry *cache.Entry, now time.Time, status string) http.Header {
+	h := entry.Header.Clone()
+	h.Set("Age", strconv.Itoa(int(entry.Age(now)/time.Second)))
+	h.Set("X-Cache", status)
+	h.Set("Content-Length", strconv.Itoa(len(entry.Body)))
+	return h
+}
+
+// writeCached sends a stored response, answering matching conditional requests with 304.
+func writeCached(w http.ResponseWriter, r *http.Request, entry *cache.Entry, rule *storage.Rule, vars headerVars, status string) {
+	h := w.Header()
+	for name, values := range cachedHeader(entry, time.Now(), status) {
+		h[name] = values
+	}
+	applyResponseHeaders(h, rule, vars)
+	if etag := h.Get("ETag"); etag != "" && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(entry.Status)
+	if r.Method != http.MethodHead {
+		w.Write(entry.Body)
+	}
+}
+
+// etagMatches implements the weak comparison used by If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// captureBody copies the body while it is streamed to the client and hands
+// the copy to done on EOF. Bodies over limit are not kept.
+type captureBody struct {
+	io.ReadCloser
+	buf   bytes.Buffer
+	limit int64
+	over  bool
+	done  func([]byte)
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.over {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.over = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.over && b.done != nil {
+		b.done(b.buf.Bytes())
+		b.done = nil
+	}
+	return n, err
+}
+
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardResponseWriter) WriteHeader(int)             {}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"router/internal/cache"
+	"router/internal/storage"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProxyCache(t *testing.T) {
+	var calls atomic.Int32
+	var failing atomic.Bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if failing.Load() {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("payload"))
+	}))
+	defer backend.Close()
+
+	host := "cache.example.com"
+	p, _, st := newRuleTestProxy(t, host, strings.TrimPrefix(backend.URL, "http://"), storage.Rule{
+		Cache: &storage.CachePolicy{Enabled: true, StaleIfErrorSec: 600},
+	})
+	store, _ := cache.New(1<<20, "", 0)
+	p.Cache = store
+
+	get := func(header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/page", nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get(nil); rec.Body.String() != "payload" || rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("first response = %q cache=%q", rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+	if rec := get(nil); rec.Body.String() != "payload" || rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("second response = %q cache=%q", rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+	if rec := get(http.Header{"If-None-Match": {`"v1"`}}); rec.Code != http.StatusNotModified {
+		t.Fatalf("conditional hit status = %d, want 304", rec.Code)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("upstream calls = %d, want 1", n)
+	}
+
+	// Expire the entry and let the upstream fail: stale-if-error takes over.
+	entry := store.Lookup(httptest.NewRequest(http.MethodGet, "http://"+host+"/page", nil))
+	expired := *entry
+	expired.Stored = time.Now().Add(-2 * time.Minute)
+	store.Put(httptest.NewRequest(http.MethodGet, "http://"+host+"/page", nil), &expired)
+	failing.Store(true)
+	if rec := get(nil); rec.Code != http.StatusOK || rec.Body.String() != "payload" || rec.Header().Get("X-Cache") != "STALE" {
+		t.Fatalf("stale-if-error response = %d %q cache=%q", rec.Code, rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+
+	rows := st.GetCacheData()
+	if len(rows) != 1 || rows[0]["hits"] != 2 || rows[0]["misses"] != 2 {
+		t.Fatalf("cache stats = %+v", rows)
+	}
+}
+
+func TestProxyCacheServesStaleWhenServiceDown(t *testing.T) {
+	host := "down.example.com"
+	p, store, _ := newRuleTestProxy(t, host, "127.0.0.1:1", storage.Rule{
+		Cache: &storage.CachePolicy{Enabled: true, StaleIfErrorSec: 600},
+	})
+	p.Cache, _ = cache.New(1<<20, "", 0)
+	req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+	p.Cache.Put(req, &cache.Entry{Status: 200, Header: http.Header{}, Body: []byte("old"), Stored: time.Now().Add(-time.Hour), Fresh: time.Minute, SIE: 2 * time.Hour})
+	rule, _ := store.GetRule(host)
+	rule.ServiceDown = true
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "old" || rec.Header().Get("X-Cache") != "STALE" {
+		t.Fatalf("response = %d %q cache=%q", rec.Code, rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+}
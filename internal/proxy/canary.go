@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"router/internal/storage"
+)
+
+const defaultStickyCookie = "router_variant"
+
+// chooseVariant picks the canary variant for r: an explicit override by
+// header, cookie or query parameter first, then the sticky cookie, then a
+// weighted random draw. The sticky cookie is (re)issued on w when enabled.
+func chooseVariant(w http.ResponseWriter, r *http.Request, policy *storage.CanaryPolicy) *storage.CanaryVariant {
+	if variant := variantByName(policy, overrideName(r, policy)); variant != nil {
+		return variant
+	}
+	cookieName := policy.StickyCookie
+	if cookieName == "" {
+		cookieName = defaultStickyCookie
+	}
+	if policy.Sticky {
+		// A sticky variant whose weight dropped to zero is abandoned.
+		if c, err := r.Cookie(cookieName); err == nil {
+			if variant := variantByName(policy, c.Value); variant != nil && variant.Weight > 0 {
+				return variant
+			}
+		}
+	}
+
+	variant := weightedVariant(policy)
+	if policy.Sticky {
+		cookie := &http.Cookie{
+			Name:     cookieName,
+			Value:    variant.Name,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		}
+		if policy.StickyTTLSec > 0 {
+			cookie.MaxAge = policy.StickyTTLSec
+		}
+		http.SetCookie(w, cookie)
+	}
+	return variant
+}
+
+func overrideName(r *http.Request, policy *storage.CanaryPolicy) string {
+	if policy.Header != "" {
+		if name := r.Header.Get(policy.Header); name != "" {
+			return name
+		}
+	}
+	if policy.Cookie != "" {
+		if c, err := r.Cookie(policy.Cookie); err == nil && c.Value != "" {
+			return c.Value
+		}
+	}
+	if policy.Query != "" {
+		return r.URL.Query().Get(policy.Query)
+	}
+	return ""
+}
+
+func variantByName(policy *storage.CanaryPolicy, name string) *storage.CanaryVariant {
+	if name == "" {
+		return nil
+	}
+	for i := range policy.Variants {
+		if policy.Variants[i].Name == name {
+			return &policy.Variants[i]
+		}
+	}
+	return nil
+}
+
+func weightedVariant(policy *storage.CanaryPolicy) *storage.CanaryVariant {
+	total := 0
+	for _, variant := range policy.Variants {
+		total += variant.Weight
+	}
+	pick := rand.IntN(total)
+	for i := range policy.Variants {
+		pick -= policy.Variants[i].Weight
+		if pick < 0 {
+			return &policy.Variants[i]
+		}
+	}
+	return &policy.Variants[len(policy.Variants)-1]
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"router/internal/storage"
+	"strings"
+	"testing"
+)
+
+func TestCanaryRoutesByOverrideStickyCookieAndWeight(t *testing.T) {
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+	}
+	stable := backend("stable")
+	defer stable.Close()
+	next := backend("next")
+	defer next.Close()
+
+	host := "canary.example.com"
+	p, store, st := newRuleTestProxy(t, host, strings.TrimPrefix(stable.URL, "http://"), storage.Rule{
+		Canary: &storage.CanaryPolicy{
+			Variants: []storage.CanaryVariant{
+				{Name: "stable", Weight: 100},
+				{Name: "next", Target: strings.TrimPrefix(next.URL, "http://"), Weight: 0},
+			},
+			Header: "X-Variant",
+			Query:  "variant",
+			Sticky: true,
+		},
+	})
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// A zero-weight variant is never drawn, and the draw is made sticky.
+	rec := serve(httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+	if rec.Body.String() != "stable" {
+		t.Fatalf("weighted response = %q", rec.Body.String())
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != defaultStickyCookie || cookies[0].Value != "stable" {
+		t.Fatalf("sticky cookie = %+v", cookies)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+	req.Header.Set("X-Variant", "next")
+	if got := serve(req).Body.String(); got != "next" {
+		t.Fatalf("header override response = %q", got)
+	}
+	if got := serve(httptest.NewRequest(http.MethodGet, "http://"+host+"/?variant=next", nil)).Body.String(); got != "next" {
+		t.Fatalf("query override response = %q", got)
+	}
+
+	// Weights change live; the sticky cookie keeps the user on its variant.
+	if err := store.SetCanaryWeights(host, map[string]int{"stable": 0, "next": 100}); err != nil {
+		t.Fatalf("set weights: %v", err)
+	}
+	if err := store.SetCanaryWeights(host, map[string]int{"missing": 1}); err == nil {
+		t.Fatal("unknown variant weight should be rejected")
+	}
+	req = httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+	req.AddCookie(&http.Cookie{Name: defaultStickyCookie, Value: "next"})
+	rec = serve(req)
+	if rec.Body.String() != "next" || len(rec.Result().Cookies()) != 0 {
+		t.Fatalf("sticky response = %q cookies %+v", rec.Body.String(), rec.Result().Cookies())
+	}
+
+	// A sticky variant whose weight dropped to zero is abandoned.
+	req = httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+	req.AddCookie(&http.Cookie{Name: defaultStickyCookie, Value: "stable"})
+	if got := serve(req).Body.String(); got != "next" {
+		t.Fatalf("abandoned sticky response = %q", got)
+	}
+
+	rows := st.GetCanaryData()
+	if len(rows) != 1 {
+		t.Fatalf("canary stats = %+v", rows)
+	}
+	variants := rows[0]["variants"].(map[string]int)
+	if variants["stable"] != 1 || variants["next"] != 4 {
+		t.Fatalf("canary counts = %+v", variants)
+	}
+}
@@ -0,0 +1,252 @@
+package proxy
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"router/internal/storage"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const defaultCompressMinSize = 1024
+
+var (
+	defaultCompressEncodings    = []string{"br", "zstd", "gzip"}
+	defaultCompressContentTypes = []string{
+		"text/",
+		"application/json",
+		"application/javascript",
+		"application/xml",
+		"application/xhtml+xml",
+		"application/rss+xml",
+		"application/atom+xml",
+		"application/manifest+json",
+		"application/wasm",
+		"image/svg+xml",
+	}
+)
+
+// compressor is a pooled streaming encoder.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+var compressorPools = map[string]*sync.Pool{
+	"gzip": {New: func() interface{} {
+		gz, _ := gzip.NewWriterLevel(io.Discard, gzip.DefaultCompression)
+		return gz
+	}},
+	"br": {New: func() interface{} {
+		return brotli.NewWriterLevel(io.Discard, 5)
+	}},
+	"zstd": {New: func() interface{} {
+		enc, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+		return enc
+	}},
+}
+
+// negotiateEncoding picks the first policy encoding the client accepts.
+func negotiateEncoding(policy *storage.CompressionPolicy, acceptEncoding string) string {
+	encodings := policy.Encodings
+	if len(encodings) == 0 {
+		encodings = defaultCompressEncodings
+	}
+	for _, encoding := range encodings {
+		if acceptsEncoding(acceptEncoding, encoding) {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// compressWriter compresses the response body when the upstream response
+// qualifies. Small bodies of unknown length are buffered up to MinSize before
+// deciding; already encoded, partial and event-stream responses pass through.
+type compressWriter struct {
+	http.ResponseWriter
+	policy   *storage.CompressionPolicy
+	encoding string
+
+	status  int
+	decided bool
+	enc     compressor
+	buf     []byte
+}
+
+// newCompressWriter wraps w when the request allows compression under policy.
+func newCompressWriter(w http.ResponseWriter, r *http.Request, policy *storage.CompressionPolicy) (*compressWriter, bool) {
+	if policy == nil || !policy.Enabled || r.Method == http.MethodHead || liveConnKind(r) != "" {
+		return nil, false
+	}
+	encoding := negotiateEncoding(policy, r.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return nil, false
+	}
+	return &compressWriter{ResponseWriter: w, policy: policy, encoding: encoding}, true
+}
+
+func (w *compressWriter) minSize() int {
+	if w.policy.MinSize > 0 {
+		return w.policy.MinSize
+	}
+	return defaultCompressMinSize
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = code
+	if code < 200 || code == http.StatusSwitchingProtocols {
+		// Informational responses are forwarded as-is and do not end the headers.
+		w.status = 0
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	h := w.Header()
+	if !w.eligible(code, h) {
+		w.decided = true
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	h.Add("Vary", "Accept-Encoding")
+	if length, err := strconv.Atoi(h.Get("Content-Length")); err == nil {
+		w.decided = true
+		if length >= w.minSize() {
+			w.startCompression()
+		}
+		w.ResponseWriter.WriteHeader(code)
+	}
+	// Unknown length: wait for the body to decide.
+}
+
+func (w *compressWriter) eligible(code int, h http.Header) bool {
+	if code == http.StatusNoContent || code == http.StatusPartialContent || code == http.StatusNotModified || code >= 300 && code < 400 {
+		return false
+	}
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	if strings.Contains(h.Get("Cache-Control"), "no-transform") {
+		return false
+	}
+	contentType := strings.ToLower(h.Get("Content-Type"))
+	if contentType == "" || strings.HasPrefix(contentType, "text/event-stream") {
+		return false
+	}
+	types := w.policy.ContentTypes
+	if len(types) == 0 {
+		types = defaultCompressContentTypes
+	}
+	for _, prefix := range types {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *compressWriter) startCompression() {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	h.Set("Content-Encoding", w.encoding)
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	w.enc = compressorPools[w.encoding].Get().(compressor)
+	w.enc.Reset(w.ResponseWriter)
+}
+
+// decide commits to compressing (or not) and flushes the buffered prefix.
+func (w *compressWriter) decide(compress bool) error {
+	w.decided = true
+	if compress {
+		w.startCompression()
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := w.writeBody(buf)
+	return err
+}
+
+func (w *compressWriter) writeBody(p []byte) (int, error) {
+	if w.enc != nil {
+		return w.enc.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.decided {
+		return w.writeBody(p)
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= w.minSize() {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush commits a streaming response to compression so that data is not held back.
+func (w *compressWriter) Flush() {
+	if w.status != 0 && !w.decided {
+		_ = w.decide(true)
+	}
+	if w.enc != nil {
+		_ = w.enc.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close finishes the compressed stream; it must be called once the handler is done.
+func (w *compressWriter) Close() error {
+	if w.status != 0 && !w.decided {
+		if err := w.decide(false); err != nil {
+			return err
+		}
+	}
+	if w.enc == nil {
+		return nil
+	}
+	err := w.enc.Close()
+	w.enc.Reset(io.Discard)
+	compressorPools[w.encoding].Put(w.enc)
+	w.enc = nil
+	return err
+}
+
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hj.Hijack()
+	}
+	return nil, nil, errors.New("response writer does not support hijacking")
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"router/internal/storage"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestProxyCompressesResponses(t *testing.T) {
+	large := strings.Repeat(`{"key":"value"},`, 200)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("ETag", `"v1"`)
+			io.WriteString(w, large)
+		case "/small":
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, "ok")
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			io.WriteString(w, large)
+		case "/encoded":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Encoding", "gzip")
+			io.WriteString(w, "already-compressed")
+		case "/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, "data: "+large+"\n\n")
+		}
+	}))
+	defer backend.Close()
+
+	p, _, _ := newRuleTestProxy(t, "app.test", strings.TrimPrefix(backend.URL, "http://"), storage.Rule{
+		Compression: &storage.CompressionPolicy{Enabled: true},
+	})
+	fetch := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://app.test"+path, nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"br":   func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+		"zstd": func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+	}
+	for encoding, decode := range decoders {
+		rec := fetch("/large", encoding)
+		if got := rec.Header().Get("Content-Encoding"); got != encoding {
+			t.Fatalf("%s: Content-Encoding = %q", encoding, got)
+		}
+		if rec.Header().Get("Vary") != "Accept-Encoding" || rec.Header().Get("ETag") != `W/"v1"` {
+			t.Fatalf("%s: headers = %v", encoding, rec.Header())
+		}
+		reader, err := decode(rec.Body)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		body, err := io.ReadAll(reader)
+		if err != nil || string(body) != large {
+			t.Fatalf("%s: decoded body mismatch (%d bytes, %v)", encoding, len(body), err)
+		}
+	}
+
+	if rec := fetch("/large", "gzip, br"); rec.Header().Get("Content-Encoding") != "br" {
+		t.Fatalf("preferred encoding = %q, want br", rec.Header().Get("Content-Encoding"))
+	}
+	if rec := fetch("/large", ""); rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != large {
+		t.Fatalf("identity response was modified")
+	}
+	for _, path := range []string{"/small", "/image", "/events"} {
+		if rec := fetch(path, "gzip"); rec.Header().Get("Content-Encoding") != "" {
+			t.Fatalf("%s should not be compressed", path)
+		}
+	}
+	if rec := fetch("/encoded", "br"); rec.Header().Get("Content-Encoding") != "gzip" || rec.Body.String() != "already-compressed" {
+		t.Fatalf("already encoded response was changed: %v %q", rec.Header(), rec.Body.String())
+	}
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/textproto"
+	"router/internal/clog"
+	"router/internal/storage"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// corsHeaders are the response headers owned by a CORS policy.
+var corsHeaders = []string{
+	"Access-Control-Allow-Origin",
+	"Access-Control-Allow-Credentials",
+	"Access-Control-Allow-Methods",
+	"Access-Control-Allow-Headers",
+	"Access-Control-Expose-Headers",
+	"Access-Control-Max-Age",
+}
+
+// handleCORS answers preflight requests and otherwise wraps w so that every
+// response, proxied or produced by the router, carries the policy's headers.
+// It reports whether the request has been answered.
+func handleCORS(w http.ResponseWriter, r *http.Request, policy *storage.CORSPolicy) (http.ResponseWriter, bool) {
+	origin := r.Header.Get("Origin")
+	if r.Method == http.MethodOptions && origin != "" && r.Header.Get("Access-Control-Request-Method") != "" {
+		preflight(w, r, policy, origin)
+		return w, true
+	}
+	return &corsWriter{ResponseWriter: w, policy: policy, origin: origin}, false
+}
+
+func preflight(w http.ResponseWriter, r *http.Request, policy *storage.CORSPolicy, origin string) {
+	h := w.Header()
+	h.Add("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+	method := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+	methods := policy.AllowedMethods
+	if len(methods) == 0 {
+		methods = storage.DefaultCORSMethods
+	}
+	requested := requestedHeaders(r)
+	allowOrigin, ok := allowedOrigin(policy, origin)
+	switch {
+	case !ok:
+		clog.Warnf("[cors] preflight %s host=%s origin=%q: origin not allowed", r.URL.Path, r.Host, origin)
+	case !slices.Contains(methods, method):
+		clog.Warnf("[cors] preflight %s host=%s origin=%q: method %s not allowed", r.URL.Path, r.Host, origin, method)
+		ok = false
+	case !headersAllowed(policy.AllowedHeaders, requested):
+		clog.Warnf("[cors] preflight %s host=%s origin=%q: headers %v not allowed", r.URL.Path, r.Host, origin, requested)
+		ok = false
+	}
+	if !ok {
+		http.Error(w, "CORS request not allowed", http.StatusForbidden)
+		return
+	}
+
+	h.Set("Access-Control-Allow-Origin", allowOrigin)
+	if policy.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if len(requested) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+	}
+	if policy.MaxAgeSec > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(policy.MaxAgeSec))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// allowedOrigin returns the Access-Control-Allow-Origin value for origin.
+// "*" never matches when credentials are allowed: echoing any origin would
+// let every site make credentialed reads. Validation rejects that policy.
+func allowedOrigin(policy *storage.CORSPolicy, origin string) (string, bool) {
+	if origin == "" {
+		return "", false
+	}
+	lower := strings.ToLower(origin)
+	for _, allowed := range policy.AllowedOrigins {
+		switch {
+		case allowed == "*":
+			if policy.AllowCredentials {
+				continue
+			}
+			return "*", true
+		case allowed == lower:
+			return origin, true
+		case strings.Contains(allowed, "://*."):
+			scheme, suffix, _ := strings.Cut(allowed, "://*")
+			if strings.HasPrefix(lower, scheme+"://") && strings.HasSuffix(lower, suffix) && len(lower) > len(scheme)+3+len(suffix) {
+				return origin, true
+			}
+		}
+	}
+	return "", false
+}
+
+func requestedHeaders(r *http.Request) []string {
+	var out []string
+	for _, value := range r.Header.Values("Access-Control-Request-Headers") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				out = append(out, textproto.CanonicalMIMEHeaderKey(name))
+			}
+		}
+	}
+	return out
+}
+
+func headersAllowed(allowed, requested []string) bool {
+	if len(allowed) == 0 || slices.Contains(allowed, "*") {
+		return true
+	}
+	for _, name := range requested {
+		if !slices.Contains(allowed, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// corsWriter adds the CORS headers when the response header is written, after
+// the upstream's headers have been copied, so it can strip or defer to them.
+type corsWriter struct {
+	http.ResponseWriter
+	policy  *storage.CORSPolicy
+	origin  string
+	applied bool
+}
+
+func (w *corsWriter) apply() {
+	if w.applied {
+		return
+	}
+	w.applied = true
+	h := w.Header()
+	if w.policy.StripUpstream {
+		for _, name := range corsHeaders {
+			h.Del(name)
+		}
+	} else if h.Get("Access-Control-Allow-Origin") != "" {
+		return // the upstream handles CORS for this response
+	}
+	if !slices.Equal(w.policy.AllowedOrigins, []string{"*"}) || w.policy.AllowCredentials {
+		h.Add("Vary", "Origin")
+	}
+	allowOrigin, ok := allowedOrigin(w.policy, w.origin)
+	if !ok {
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", allowOrigin)
+	if w.policy.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(w.policy.ExposedHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(w.policy.ExposedHeaders, ", "))
+	}
+}
+
+func (w *corsWriter) WriteHeader(code int) {
+	if code >= 200 || code == http.StatusSwitchingProtocols {
+		w.apply()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *corsWriter) Write(p []byte) (int, error) {
+	w.apply()
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *corsWriter) Flush() {
+	w.apply()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets protocol upgrades through once the 101 headers carry CORS.
+func (w *corsWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.apply()
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *corsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
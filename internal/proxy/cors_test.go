@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"router/internal/storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCORSPreflightAndResponseHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/own" {
+			w.Header().Set("Access-Control-Allow-Origin", "https://upstream.example")
+		}
+		if r.Method == http.MethodOptions {
+			t.Errorf("preflight reached the upstream")
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	host := "api.example.com"
+	p, store, _ := newRuleTestProxy(t, host, strings.TrimPrefix(upstream.URL, "http://"), storage.Rule{
+		CORS: &storage.CORSPolicy{
+			AllowedOrigins:   []string{"https://app.example.com", "https://*.preview.example.com"},
+			AllowedMethods:   []string{"GET", "POST"},
+			AllowedHeaders:   []string{"Content-Type", "Authorization"},
+			ExposedHeaders:   []string{"X-Total-Count"},
+			AllowCredentials: true,
+			MaxAgeSec:        600,
+		},
+	})
+
+	serve := func(method, path, origin string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://"+host+path, nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve(http.MethodOptions, "/items", "https://pr-7.preview.example.com", map[string]string{
+		"Access-Control-Request-Method":  "POST",
+		"Access-Control-Request-Headers": "content-type, authorization",
+	})
+	h := rec.Header()
+	if rec.Code != http.StatusNoContent || h.Get("Access-Control-Allow-Origin") != "https://pr-7.preview.example.com" ||
+		h.Get("Access-Control-Allow-Methods") != "GET, POST" || h.Get("Access-Control-Allow-Headers") != "Content-Type, Authorization" ||
+		h.Get("Access-Control-Max-Age") != "600" || h.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Fatalf("preflight = %d %v", rec.Code, h)
+	}
+	for _, bad := range []map[string]string{
+		{"Access-Control-Request-Method": "DELETE"},
+		{"Access-Control-Request-Method": "GET", "Access-Control-Request-Headers": "X-Secret"},
+	} {
+		if rec := serve(http.MethodOptions, "/items", "https://app.example.com", bad); rec.Code != http.StatusForbidden || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Fatalf("disallowed preflight %v = %d %v", bad, rec.Code, rec.Header())
+		}
+	}
+	if rec := serve(http.MethodOptions, "/items", "https://preview.example.com", map[string]string{"Access-Control-Request-Method": "GET"}); rec.Code != http.StatusForbidden {
+		t.Fatalf("wildcard must not match the bare domain: %d", rec.Code)
+	}
+
+	rec = serve(http.MethodGet, "/items", "https://app.example.com", nil)
+	if rec.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" || rec.Header().Get("Access-Control-Expose-Headers") != "X-Total-Count" || rec.Header().Get("Vary") != "Origin" {
+		t.Fatalf("simple request headers = %v", rec.Header())
+	}
+	if rec := serve(http.MethodGet, "/items", "https://evil.example", nil); rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("foreign origin got CORS headers: %v", rec.Header())
+	}
+
+	// The upstream's own CORS headers win unless they are stripped.
+	if got := serve(http.MethodGet, "/own", "https://app.example.com", nil).Header().Values("Access-Control-Allow-Origin"); len(got) != 1 || got[0] != "https://upstream.example" {
+		t.Fatalf("upstream CORS header = %v", got)
+	}
+	rule, _ := store.Snapshot(host)
+	cors := *rule.CORS
+	cors.StripUpstream = true
+	rule.CORS = &cors
+	if err := store.Update(host, rule); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if got := serve(http.MethodGet, "/own", "https://app.example.com", nil).Header().Values("Access-Control-Allow-Origin"); len(got) != 1 || got[0] != "https://app.example.com" {
+		t.Fatalf("stripped upstream CORS header = %v", got)
+	}
+}
+
+func TestCORSWildcardNeverReflectedWithCredentials(t *testing.T) {
+	// Rules saved before validation refused this combination.
+	policy := &storage.CORSPolicy{AllowedOrigins: []string{"*", "https://app.example.com"}, AllowCredentials: true}
+	if got, ok := allowedOrigin(policy, "https://evil.example"); ok {
+		t.Fatalf("wildcard with credentials allowed %q", got)
+	}
+	if got, ok := allowedOrigin(policy, "https://app.example.com"); !ok || got != "https://app.example.com" {
+		t.Fatalf("listed origin = %q %v", got, ok)
+	}
+	policy.AllowCredentials = false
+	if got, ok := allowedOrigin(policy, "https://evil.example"); !ok || got != "*" {
+		t.Fatalf("wildcard without credentials = %q %v", got, ok)
+	}
+}
+
+func TestCORSRulePassesWebSocketUpgrades(t *testing.T) {
+	backend := newUpgradeBackend(t)
+	defer backend.Close()
+	p, _, _ := newRuleTestProxy(t, "app.test", strings.TrimPrefix(backend.URL, "http://"), storage.Rule{
+		CORS: &storage.CORSPolicy{AllowedOrigins: []string{"https://a.test"}},
+	})
+	front := httptest.NewServer(p)
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(front.URL, "http://"))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: app.test\r\nOrigin: https://a.test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Access-Control-Allow-Origin") != "https://a.test" {
+		t.Fatalf("upgrade = %d %v", resp.StatusCode, resp.Header)
+	}
+	io.WriteString(conn, "ping")
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo = %q, %v", buf, err)
+	}
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"router/internal/clog"
+	"router/internal/storage"
+	"time"
+)
+
+const (
+	defaultForwardAuthTimeout = 5 * time.Second
+	// maxForwardAuthBody bounds the auth service body relayed on 401/403.
+	maxForwardAuthBody = 64 << 10
+)
+
+var forwardAuthClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// forwardAuthRelayed are auth response headers passed to the client on 401/403.
+var forwardAuthRelayed = []string{"WWW-Authenticate", "Content-Type", "Set-Cookie", "Location"}
+
+// forwardAuth asks the rule's auth service about r. On success the configured
+// auth response headers are copied onto r and true is returned; otherwise the
+// client has been answered.
+func (p *Proxy) forwardAuth(w http.ResponseWriter, r *http.Request, rule *storage.Rule, remoteIP string) bool {
+	policy := rule.ForwardAuth
+	// Identity headers may only come from the auth service.
+	for _, name := range policy.CopyHeaders {
+		r.Header.Del(name)
+	}
+
+	timeout := defaultForwardAuthTimeout
+	if policy.TimeoutSec > 0 {
+		timeout = time.Duration(policy.TimeoutSec) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	out, err := http.NewRequestWithContext(ctx, r.Method, policy.URL, nil)
+	if err != nil {
+		clog.Errorf("[forward-auth] host=%s: %v", r.Host, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return false
+	}
+	out.Header = r.Header.Clone()
+	for _, name := range []string{"Connection", "Upgrade", "Content-Length", "Transfer-Encoding", "Expect"} {
+		out.Header.Del(name)
+	}
+	setForwardingHeaders(out.Header, r, rule, remoteIP)
+	out.Header.Set("X-Forwarded-Method", r.Method)
+	out.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	out.Header.Set("X-Original-Method", r.Method)
+	out.Header.Set("X-Original-URI", r.URL.RequestURI())
+
+	resp, err := forwardAuthClient.Do(out)
+	if err != nil {
+		clog.Errorf("[forward-auth] %s %s host=%s: auth service failed: %v", r.Method, r.URL.Path, r.Host, err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return false
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		for _, name := range policy.CopyHeaders {
+			if values := resp.Header.Values(name); len(values) > 0 {
+				r.Header[name] = values
+			}
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxForwardAuthBody))
+		return true
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		clog.Warnf("[forward-auth] %s %s host=%s remote=%s: denied with %d", r.Method, r.URL.Path, r.Host, remoteIP, resp.StatusCode)
+		for _, name := range forwardAuthRelayed {
+			if values := resp.Header.Values(name); len(values) > 0 {
+				w.Header()[http.CanonicalHeaderKey(name)] = values
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, io.LimitReader(resp.Body, maxForwardAuthBody))
+		return false
+	default:
+		clog.Errorf("[forward-auth] %s %s host=%s: unexpected auth status %d", r.Method, r.URL.Path, r.Host, resp.StatusCode)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return false
+	}
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"router/internal/storage"
+	"strings"
+	"testing"
+)
+
+// newStandInAuthServer is a minimal forward-auth service: the bearer token is
+// the user name, "forbidden" is refused with 403 and a missing token with 401.
+func newStandInAuthServer(t *testing.T, seen chan<- string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if seen != nil {
+			seen <- r.Method + " " + r.Header.Get("X-Forwarded-Method") + " " + r.Header.Get("X-Forwarded-Uri") + " " + r.Header.Get("X-Forwarded-Host")
+		}
+		user := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		switch user {
+		case "":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="test"`)
+			http.Error(w, "login required", http.StatusUnauthorized)
+		case "forbidden":
+			http.Error(w, "no access", http.StatusForbidden)
+		default:
+			w.Header().Set("X-User", user)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestForwardAuthGuardsRule(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, "user="+r.Header.Get("X-User")+" body="+string(body))
+	}))
+	defer upstream.Close()
+
+	seen := make(chan string, 4)
+	auth := newStandInAuthServer(t, seen)
+	host := "app.example.com"
+	p, _, _ := newRuleTestProxy(t, host, strings.TrimPrefix(upstream.URL, "http://"), storage.Rule{
+		ForwardAuth: &storage.ForwardAuthPolicy{URL: auth.URL + "/verify", CopyHeaders: []string{"x-user"}},
+	})
+
+	serve := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "http://"+host+"/orders?id=7", strings.NewReader("payload"))
+		req.Header.Set("X-User", "spoofed")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve("alice")
+	if rec.Code != http.StatusOK || rec.Body.String() != "user=alice body=payload" {
+		t.Fatalf("allowed request = %d %q", rec.Code, rec.Body.String())
+	}
+	if got := <-seen; got != "POST POST /orders?id=7 "+host {
+		t.Fatalf("auth subrequest = %q", got)
+	}
+
+	rec = serve("")
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") != `Bearer realm="test"` || !strings.Contains(rec.Body.String(), "login required") {
+		t.Fatalf("unauthenticated = %d %q %q", rec.Code, rec.Header().Get("WWW-Authenticate"), rec.Body.String())
+	}
+	<-seen
+	if rec := serve("forbidden"); rec.Code != http.StatusForbidden {
+		t.Fatalf("forbidden = %d", rec.Code)
+	}
+	<-seen
+
+	auth.Close()
+	if rec := serve("alice"); rec.Code != http.StatusBadGateway {
+		t.Fatalf("auth service down = %d", rec.Code)
+	}
+}
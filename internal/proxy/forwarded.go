@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"router/internal/clientip"
+	"router/internal/storage"
+	"strings"
+)
+
+// setForwardingHeaders describes the original request to the upstream:
+// X-Real-IP, X-Forwarded-For/Host/Proto/Port and, when the rule asks for it,
+// the RFC 7239 Forwarded header. Values announced by the previous hop are only
+// kept when that hop is a trusted proxy.
+func setForwardingHeaders(out http.Header, in *http.Request, rule *storage.Rule, remoteIP string) {
+	trusted := clientip.TrustedPeer(in)
+	socketIP := clientip.SocketIP(in.RemoteAddr)
+	proto := forwardedProto(in, trusted)
+
+	out.Set("X-Real-IP", remoteIP)
+	prior := ""
+	if trusted {
+		prior = strings.Join(in.Header.Values("X-Forwarded-For"), ", ")
+	}
+	out.Set("X-Forwarded-For", appendForwardedFor(prior, socketIP))
+	out.Set("X-Forwarded-Host", in.Host)
+	out.Set("X-Forwarded-Proto", proto)
+	out.Set("X-Forwarded-Port", forwardedPort(in, proto, trusted))
+
+	out.Del("Forwarded")
+	if rule.ForwardedHeader {
+		element := "for=" + forwardedNode(socketIP) + ";host=" + forwardedValue(in.Host) + ";proto=" + proto
+		if prior := strings.Join(in.Header.Values("Forwarded"), ", "); trusted && prior != "" {
+			element = prior + ", " + element
+		}
+		out.Set("Forwarded", element)
+	}
+}
+
+func forwardedProto(r *http.Request, trusted bool) string {
+	if trusted {
+		switch proto := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Forwarded-Proto"))); proto {
+		case "http", "https":
+			return proto
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func forwardedPort(r *http.Request, proto string, trusted bool) string {
+	if _, port, err := net.SplitHostPort(r.Host); err == nil && port != "" {
+		return port
+	}
+	if trusted {
+		if port := strings.TrimSpace(r.Header.Get("X-Forwarded-Port")); port != "" && strings.Trim(port, "0123456789") == "" {
+			return port
+		}
+	}
+	if proto == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+// forwardedNode formats an IP as an RFC 7239 node; IPv6 must be bracketed and quoted.
+func forwardedNode(ip string) string {
+	if ip == "" {
+		return "unknown"
+	}
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// forwardedValue quotes a value unless it is a plain RFC 7230 token.
+func forwardedValue(value string) string {
+	for _, c := range value {
+		if !isTokenChar(c) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+		}
+	}
+	return value
+}
+
+func isTokenChar(c rune) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
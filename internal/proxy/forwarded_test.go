@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"router/internal/clientip"
+	"router/internal/storage"
+	"strings"
+	"testing"
+)
+
+func TestProxyForwardingHeaders(t *testing.T) {
+	var got *http.Request
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Clone(r.Context())
+	}))
+	defer backend.Close()
+	target := strings.TrimPrefix(backend.URL, "http://")
+
+	defer clientip.Configure(clientip.Default())
+	clientip.Configure(clientip.New([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, nil))
+
+	cases := []struct {
+		name        string
+		rule        storage.Rule
+		host        string
+		remoteAddr  string
+		tls         bool
+		header      map[string]string
+		wantHost    string
+		wantProto   string
+		wantPort    string
+		wantXFF     string
+		wantForward string
+	}{
+		{
+			name:       "plain http rewrites host",
+			host:       "app.test",
+			remoteAddr: "198.51.100.7:5000",
+			wantHost:   target,
+			wantProto:  "http",
+			wantPort:   "80",
+			wantXFF:    "198.51.100.7",
+		},
+		{
+			name:       "tls with preserved host",
+			rule:       storage.Rule{PreserveHost: true},
+			host:       "app.test",
+			remoteAddr: "198.51.100.7:5000",
+			tls:        true,
+			wantHost:   "app.test",
+			wantProto:  "https",
+			wantPort:   "443",
+			wantXFF:    "198.51.100.7",
+		},
+		{
+			name:        "untrusted client cannot spoof proto or Forwarded",
+			rule:        storage.Rule{ForwardedHeader: true},
+			host:        "app.test:8443",
+			remoteAddr:  "198.51.100.7:5000",
+			header:      map[string]string{"X-Forwarded-Proto": "https", "Forwarded": "for=1.2.3.4", "X-Forwarded-For": "1.2.3.4"},
+			wantHost:    target,
+			wantProto:   "http",
+			wantPort:    "8443",
+			wantXFF:     "198.51.100.7",
+			wantForward: `for=198.51.100.7;host="app.test:8443";proto=http`,
+		},
+		{
+			name:       "untrusted client cannot plant X-Forwarded-For entries",
+			host:       "app.test",
+			remoteAddr: "198.51.100.7:5000",
+			header:     map[string]string{"X-Forwarded-For": "127.0.0.1, 10.9.9.9"},
+			wantHost:   target,
+			wantProto:  "http",
+			wantPort:   "80",
+			wantXFF:    "198.51.100.7",
+		},
+		{
+			name:        "trusted proxy keeps its proto and Forwarded chain",
+			rule:        storage.Rule{PreserveHost: true, ForwardedHeader: true},
+			host:        "app.test",
+			remoteAddr:  "10.1.2.3:5000",
+			header:      map[string]string{"X-Forwarded-Proto": "https", "Forwarded": "for=203.0.113.9", "X-Forwarded-For": "203.0.113.9"},
+			wantHost:    "app.test",
+			wantProto:   "https",
+			wantPort:    "443",
+			wantXFF:     "203.0.113.9, 10.1.2.3",
+			wantForward: "for=203.0.113.9, for=10.1.2.3;host=app.test;proto=https",
+		},
+		{
+			name:        "ipv6 client is bracketed",
+			rule:        storage.Rule{ForwardedHeader: true},
+			host:        "app.test",
+			remoteAddr:  "[2001:db8::1]:5000",
+			tls:         true,
+			wantHost:    target,
+			wantProto:   "https",
+			wantPort:    "443",
+			wantXFF:     "2001:db8::1",
+			wantForward: `for="[2001:db8::1]";host=app.test;proto=https`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, _, _ := newRuleTestProxy(t, tc.host, target, tc.rule)
+			req := httptest.NewRequest(http.MethodGet, "http://"+tc.host+"/path", nil)
+			req.Host = tc.host
+			req.RemoteAddr = tc.remoteAddr
+			if tc.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			for k, v := range tc.header {
+				req.Header.Set(k, v)
+			}
+			got = nil
+			p.ServeHTTP(httptest.NewRecorder(), req)
+			if got == nil {
+				t.Fatalf("request did not reach the backend")
+			}
+			if got.Host != tc.wantHost {
+				t.Errorf("Host = %q, want %q", got.Host, tc.wantHost)
+			}
+			if v := got.Header.Get("X-Forwarded-Host"); v != tc.host {
+				t.Errorf("X-Forwarded-Host = %q, want %q", v, tc.host)
+			}
+			if v := got.Header.Get("X-Forwarded-Proto"); v != tc.wantProto {
+				t.Errorf("X-Forwarded-Proto = %q, want %q", v, tc.wantProto)
+			}
+			if v := got.Header.Get("X-Forwarded-Port"); v != tc.wantPort {
+				t.Errorf("X-Forwarded-Port = %q, want %q", v, tc.wantPort)
+			}
+			if v := got.Header.Get("X-Forwarded-For"); v != tc.wantXFF {
+				t.Errorf("X-Forwarded-For = %q, want %q", v, tc.wantXFF)
+			}
+			if v := got.Header.Get("Forwarded"); v != tc.wantForward {
+				t.Errorf("Forwarded = %q, want %q", v, tc.wantForward)
+			}
+		})
+	}
+}
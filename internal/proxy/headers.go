@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"router/internal/clog"
+	"router/internal/storage"
+	"strings"
+	"sync"
+)
+
+// securityHeaders is the built-in preset. Upstream values win, so a backend
+// that already sends its own CSP keeps it.
+var securityHeaders = []storage.HeaderOp{
+	{Action: storage.HeaderSet, Name: "Content-Security-Policy", Value: "default-src 'self'; object-src 'none'; base-uri 'self'; frame-ancestors 'self'"},
+	{Action: storage.HeaderSet, Name: "X-Frame-Options", Value: "SAMEORIGIN"},
+	{Action: storage.HeaderSet, Name: "Referrer-Policy", Value: "strict-origin-when-cross-origin"},
+	{Action: storage.HeaderSet, Name: "X-Content-Type-Options", Value: "nosniff"},
+}
+
+var compiledPatterns sync.Map // pattern -> *regexp.Regexp
+
+// headerVars holds the values available to header templates.
+type headerVars struct {
+	clientIP  string
+	country   string
+	requestID string
+	host      string
+}
+
+func (v headerVars) expand(value string) string {
+	if !strings.Contains(value, "{") {
+		return value
+	}
+	return strings.NewReplacer(
+		"{client_ip}", v.clientIP,
+		"{country}", v.country,
+		"{request_id}", v.requestID,
+		"{host}", v.host,
+	).Replace(value)
+}
+
+// requestID reuses a sane incoming X-Request-Id or generates a new one.
+func requestID(r *http.Request) string {
+	if id := strings.TrimSpace(r.Header.Get("X-Request-Id")); id != "" && len(id) <= 128 && !strings.ContainsAny(id, "\r\n") {
+		return id
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buf)
+}
+
+// applyHeaderOps runs header operations in order.
+func applyHeaderOps(h http.Header, ops []storage.HeaderOp, vars headerVars) {
+	for _, op := range ops {
+		switch op.Action {
+		case storage.HeaderSet:
+			h.Set(op.Name, vars.expand(op.Value))
+		case storage.HeaderAppend:
+			h.Add(op.Name, vars.expand(op.Value))
+		case storage.HeaderDelete:
+			h.Del(op.Name)
+		case storage.HeaderReplace:
+			re := compilePattern(op.Pattern)
+			if re == nil {
+				continue
+			}
+			values := h[http.CanonicalHeaderKey(op.Name)]
+			replacement := vars.expand(op.Value)
+			for i := range values {
+				values[i] = re.ReplaceAllString(values[i], replacement)
+			}
+		}
+	}
+}
+
+// applySecurityHeaders sets preset headers the upstream did not send itself.
+func applySecurityHeaders(h http.Header) {
+	for _, op := range securityHeaders {
+		if h.Get(op.Name) == "" {
+			h.Set(op.Name, op.Value)
+		}
+	}
+}
+
+func compilePattern(pattern string) *regexp.Regexp {
+	if cached, ok := compiledPatterns.Load(pattern); ok {
+		return cached.(*regexp.Regexp)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		clog.Warnf("[rewrite] invalid pattern %q: %v", pattern, err)
+		return nil
+	}
+	compiledPatterns.Store(pattern, re)
+	return re
+}
+
+// responseHeaderPolicy returns a ModifyResponse hook for the rule, or nil when
+// the rule has no response header settings.
+func responseHeaderPolicy(rule *storage.Rule, vars headerVars) func(*http.Response) error {
+	if !rule.SecurityHeaders && len(rule.ResponseHeaders) == 0 {
+		return nil
+	}
+	return func(resp *http.Response) error {
+		applyResponseHeaders(resp.Header, rule, vars)
+		return nil
+	}
+}
+
+// applyResponseHeaders runs the security preset and the rule's response operations.
+func applyResponseHeaders(h http.Header, rule *storage.Rule, vars headerVars) {
+	if rule.SecurityHeaders {
+		applySecurityHeaders(h)
+	}
+	applyHeaderOps(h, rule.ResponseHeaders, vars)
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"router/internal/storage"
+	"strings"
+	"testing"
+)
+
+func TestApplyHeaderOps(t *testing.T) {
+	h := http.Header{}
+	h.Set("X-Remove", "1")
+	h.Set("Cookie", "session=abc; theme=dark")
+	vars := headerVars{clientIP: "203.0.113.7", country: "DE", requestID: "req-1", host: "app.test"}
+
+	applyHeaderOps(h, []storage.HeaderOp{
+		{Action: storage.HeaderSet, Name: "X-Client", Value: "{client_ip}/{country}"},
+		{Action: storage.HeaderAppend, Name: "X-Trace", Value: "a"},
+		{Action: storage.HeaderAppend, Name: "X-Trace", Value: "{request_id}"},
+		{Action: storage.HeaderDelete, Name: "X-Remove"},
+		{Action: storage.HeaderReplace, Name: "Cookie", Pattern: `theme=(\w+)`, Value: "theme=$1-{host}"},
+	}, vars)
+
+	if got := h.Get("X-Client"); got != "203.0.113.7/DE" {
+		t.Fatalf("X-Client = %q", got)
+	}
+	if got := h.Values("X-Trace"); len(got) != 2 || got[1] != "req-1" {
+		t.Fatalf("X-Trace = %q", got)
+	}
+	if h.Get("X-Remove") != "" {
+		t.Fatalf("X-Remove was not deleted")
+	}
+	if got := h.Get("Cookie"); got != "session=abc; theme=dark-app.test" {
+		t.Fatalf("Cookie = %q", got)
+	}
+}
+
+func TestProxyAppliesHeaderPolicies(t *testing.T) {
+	var upstreamHeader http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header.Clone()
+		w.Header().Set("Server", "backend/1.0")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	p, _, _ := newRuleTestProxy(t, "app.test", strings.TrimPrefix(backend.URL, "http://"), storage.Rule{
+		SecurityHeaders: true,
+		RequestHeaders: []storage.HeaderOp{
+			{Action: "set", Name: "X-Request-Id", Value: "{request_id}"},
+			{Action: "delete", Name: "X-Debug"},
+		},
+		ResponseHeaders: []storage.HeaderOp{
+			{Action: "delete", Name: "Server"},
+			{Action: "set", Name: "X-Served-By", Value: "{host}"},
+		},
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://app.test/", nil)
+	req.Header.Set("X-Request-Id", "incoming-42")
+	req.Header.Set("X-Debug", "1")
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	if upstreamHeader.Get("X-Request-Id") != "incoming-42" || upstreamHeader.Get("X-Debug") != "" {
+		t.Fatalf("upstream headers = %v", upstreamHeader)
+	}
+	res := rec.Header()
+	if res.Get("Server") != "" || res.Get("X-Served-By") != "app.test" {
+		t.Fatalf("response headers = %v", res)
+	}
+	if res.Get("X-Frame-Options") != "DENY" {
+		t.Fatalf("preset overrode upstream X-Frame-Options: %q", res.Get("X-Frame-Options"))
+	}
+	if res.Get("Content-Security-Policy") == "" || res.Get("Referrer-Policy") == "" {
+		t.Fatalf("security preset missing: %v", res)
+	}
+}
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"router/internal/clog"
+	"router/internal/jose"
+	"router/internal/storage"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwtFailureThreshold invalid tokens from one IP within jwtFailureWindow
+	// count as one suspicious event in the IP reputation store.
+	jwtFailureThreshold = 5
+	jwtFailureWindow    = time.Minute
+)
+
+// keyFileEntry caches a parsed key file until it changes on disk.
+type keyFileEntry struct {
+	modTime time.Time
+	size    int64
+	set     *jose.KeySet
+}
+
+// checkJWT verifies the bearer token of r against the rule's JWT policy and
+// copies the mapped claims to the upstream request. On failure the client
+// gets 401 with a WWW-Authenticate challenge and false is returned.
+func (p *Proxy) checkJWT(w http.ResponseWriter, r *http.Request, policy *storage.JWTPolicy, remoteIP string) bool {
+	for _, ch := range policy.ClaimHeaders {
+		r.Header.Del(ch.Header)
+	}
+	raw, ok := bearerToken(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+r.Host+`"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	claims, err := p.verifyJWT(r, policy, raw)
+	if err != nil {
+		clog.Warnf("[jwt] %s %s host=%s remote=%s: %v", r.Method, r.URL.Path, r.Host, remoteIP, err)
+		p.jwtFailure(remoteIP)
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s", error="invalid_token", error_description="%s"`, r.Host, strings.ReplaceAll(err.Error(), `"`, "'")))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	for _, ch := range policy.ClaimHeaders {
+		if value := claimString(claims[ch.Claim]); value != "" {
+			r.Header.Set(ch.Header, value)
+		}
+	}
+	return true
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+func (p *Proxy) verifyJWT(r *http.Request, policy *storage.JWTPolicy, raw string) (jose.Claims, error) {
+	tok, err := jose.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := p.jwtKeys(r, policy, tok.Header.Kid)
+	if err != nil {
+		clog.Errorf("[jwt] host=%s: %v", r.Host, err)
+		return nil, errors.New("verification keys are unavailable")
+	}
+	algs := policy.Algorithms
+	if len(algs) == 0 {
+		algs = storage.DefaultJWTAlgorithms
+	}
+	if err := tok.Verify(keys, algs); err != nil {
+		return nil, err
+	}
+	if err := tok.Claims.Validate(jose.Expectations{
+		Issuer:     policy.Issuer,
+		Audiences:  policy.Audiences,
+		Leeway:     time.Duration(policy.LeewaySec) * time.Second,
+		RequireExp: !policy.AllowMissingExp,
+	}); err != nil {
+		return nil, err
+	}
+	for _, required := range policy.RequiredClaims {
+		name, want, hasValue := strings.Cut(required, "=")
+		value, present := tok.Claims[name]
+		if !present {
+			return nil, fmt.Errorf("%w: %s", jose.ErrMissingClaim, name)
+		}
+		if hasValue && !slices.Contains(append(tok.Claims.Strings(name), claimString(value)), want) {
+			return nil, fmt.Errorf("claim %s does not match", name)
+		}
+	}
+	return tok.Claims, nil
+}
+
+// jwtKeys returns the policy's keys: a cached remote JWKS or a key file that
+// is re-read when it changes.
+func (p *Proxy) jwtKeys(r *http.Request, policy *storage.JWTPolicy, kid string) (*jose.KeySet, error) {
+	if policy.JWKSURL != "" {
+		remote, _ := p.jwksCache.LoadOrStore(policy.JWKSURL, jose.NewRemoteKeySet(policy.JWKSURL))
+		return remote.(*jose.RemoteKeySet).Keys(r.Context(), kid)
+	}
+	info, err := os.Stat(policy.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if cached, ok := p.keyFiles.Load(policy.KeyFile); ok {
+		entry := cached.(*keyFileEntry)
+		if entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+			return entry.set, nil
+		}
+	}
+	data, err := os.ReadFile(policy.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	set, err := jose.ParseKeyFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", policy.KeyFile, err)
+	}
+	p.keyFiles.Store(policy.KeyFile, &keyFileEntry{modTime: info.ModTime(), size: info.Size(), set: set})
+	return set, nil
+}
+
+// claimString renders a claim for a header: strings as is, arrays joined with
+// commas, numbers and booleans in JSON form.
+func claimString(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []any:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			parts = append(parts, claimString(item))
+		}
+		return strings.Join(parts, ",")
+	case json.Number:
+		return v.String()
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// failureCounter counts events per key in a fixed window.
+type failureCounter struct {
+	mu      sync.Mutex
+	entries map[string]*failureWindow
+}
+
+type failureWindow struct {
+	start time.Time
+	count int
+}
+
+// add records one failure and reports whether the key reached threshold
+// within window; the count starts over then.
+func (c *failureCounter) add(key string, now time.Time, threshold int, window time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*failureWindow)
+	}
+	if len(c.entries) > 10000 {
+		for k, e := range c.entries {
+			if now.Sub(e.start) > window {
+				delete(c.entries, k)
+			}
+		}
+	}
+	e := c.entries[key]
+	if e == nil || now.Sub(e.start) > window {
+		e = &failureWindow{start: now}
+		c.entries[key] = e
+	}
+	e.count++
+	if e.count < threshold {
+		return false
+	}
+	delete(c.entries, key)
+	return true
+}
+
+func (p *Proxy) jwtFailure(remoteIP string) {
+	if p.reputation == nil || remoteIP == "" {
+		return
+	}
+	if p.jwtFailures.add(remoteIP, time.Now(), jwtFailureThreshold, jwtFailureWindow) {
+		p.markSuspicious(remoteIP, "repeated invalid JWT", 0)
+	}
+}
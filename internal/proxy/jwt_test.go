@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"router/internal/jose"
+	"router/internal/storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJWTPolicyVerifiesAndMapsClaims(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-User")+"|"+r.Header.Get("X-Roles"))
+	}))
+	defer upstream.Close()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	keyFile := filepath.Join(t.TempDir(), "jwt.pem")
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+
+	host := "api.example.com"
+	p, _, _ := newRuleTestProxy(t, host, strings.TrimPrefix(upstream.URL, "http://"), storage.Rule{
+		JWT: &storage.JWTPolicy{
+			KeyFile:        keyFile,
+			Issuer:         "https://issuer.example",
+			Audiences:      []string{"api"},
+			RequiredClaims: []string{"sub", "roles=reader"},
+			ClaimHeaders:   []storage.ClaimHeader{{Claim: "sub", Header: "X-User"}, {Claim: "roles", Header: "X-Roles"}},
+		},
+	})
+	p.reputation = storage.NewIPReputationStore(filepath.Join(t.TempDir(), "ip_reputation.json"))
+
+	claims := func(overrides map[string]any) map[string]any {
+		c := map[string]any{
+			"iss": "https://issuer.example", "aud": "api", "sub": "svc-1",
+			"roles": []string{"reader", "writer"}, "exp": time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range overrides {
+			c[k] = v
+		}
+		return c
+	}
+	serve := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/v1/items", nil)
+		req.Header.Set("X-User", "spoofed")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	good, _ := jose.Sign("ES256", "", key, claims(nil))
+	if rec := serve(good); rec.Code != http.StatusOK || rec.Body.String() != "svc-1|reader,writer" {
+		t.Fatalf("valid token = %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec := serve("")
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") != `Bearer realm="`+host+`"` {
+		t.Fatalf("missing token = %d %q", rec.Code, rec.Header().Get("WWW-Authenticate"))
+	}
+
+	expired, _ := jose.Sign("ES256", "", key, claims(map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}))
+	wrongAud, _ := jose.Sign("ES256", "", key, claims(map[string]any{"aud": "other"}))
+	noRole, _ := jose.Sign("ES256", "", key, claims(map[string]any{"roles": []string{"writer"}}))
+	hmacToken, _ := jose.Sign("HS256", "", []byte("guess"), claims(nil))
+	noExp, _ := jose.Sign("ES256", "", key, claims(map[string]any{"exp": nil}))
+	for _, token := range []string{expired, wrongAud, noRole, hmacToken, "garbage", noExp} {
+		rec := serve(token)
+		if rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Header().Get("WWW-Authenticate"), `error="invalid_token"`) {
+			t.Fatalf("invalid token = %d %q", rec.Code, rec.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	// Five invalid tokens from one address count as one suspicious event.
+	list := p.reputation.List()
+	if len(list) != 1 || list[0].IP != "192.0.2.1" || list[0].Count != 1 || list[0].Reason != "repeated invalid JWT" {
+		t.Fatalf("reputation after invalid tokens = %+v", list)
+	}
+}
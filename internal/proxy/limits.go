@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errUpstreamHeaderTimeout is the cancel cause when the upstream does not
+// send response headers in time.
+var errUpstreamHeaderTimeout = errors.New("upstream response header timeout")
+
+// Timeouts are the listener-level limits applied to the HTTP servers.
+type Timeouts struct {
+	ReadHeader time.Duration
+	Read       time.Duration
+	Write      time.Duration
+	Idle       time.Duration
+}
+
+// TimeoutsFromEnv reads HTTP_READ_HEADER_TIMEOUT_SEC (10), HTTP_READ_TIMEOUT_SEC
+// (0), HTTP_WRITE_TIMEOUT_SEC (0) and HTTP_IDLE_TIMEOUT_SEC (120). A value of
+// 0 disables the timeout. Read and write are off by default: they bound the
+// whole body, which would cut off slow uploads, downloads, static files and
+// cache hits; per-rule requestTimeoutSec covers proxied requests instead.
+func TimeoutsFromEnv() Timeouts {
+	return Timeouts{
+		ReadHeader: envTimeout("HTTP_READ_HEADER_TIMEOUT_SEC", 10*time.Second),
+		Read:       envTimeout("HTTP_READ_TIMEOUT_SEC", 0),
+		Write:      envTimeout("HTTP_WRITE_TIMEOUT_SEC", 0),
+		Idle:       envTimeout("HTTP_IDLE_TIMEOUT_SEC", 120*time.Second),
+	}
+}
+
+func envTimeout(key string, fallback time.Duration) time.Duration {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return fallback
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil || v < 0 {
+		return fallback
+	}
+	return time.Duration(v) * time.Second
+}
+
+// envCount reads a non-negative integer, falling back on empty or bad values.
+func envCount(key string, fallback int) int {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return fallback
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil || v < 0 {
+		return fallback
+	}
+	return v
+}
+
+// Apply sets the timeouts on srv.
+func (t Timeouts) Apply(srv *http.Server) {
+	srv.ReadHeaderTimeout = t.ReadHeader
+	srv.ReadTimeout = t.Read
+	srv.WriteTimeout = t.Write
+	srv.IdleTimeout = t.Idle
+}
+
+// extendDeadlines lifts the listener read/write deadlines for a request that
+// has its own limits: zero clears them (long-lived connections), otherwise
+// they are pushed to the given time.
+func extendDeadlines(w http.ResponseWriter, until time.Time) {
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(until)
+	_ = rc.SetWriteDeadline(until)
+}
+
+// headerTimeoutTransport cancels the upstream request when response headers
+// do not arrive within timeout. The body is not limited.
+type headerTimeoutTransport struct {
+	base    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *headerTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancelCause(req.Context())
+	timer := time.AfterFunc(t.timeout, func() { cancel(errUpstreamHeaderTimeout) })
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel(nil)
+		return nil, errUpstreamHeaderTimeout
+	}
+	if err != nil {
+		cancel(nil)
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: func() { cancel(nil) }}
+	return resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// Write lets ReverseProxy use the upgraded connection of a 101 response.
+func (b *cancelOnClose) Write(p []byte) (int, error) {
+	if w, ok := b.ReadCloser.(io.Writer); ok {
+		return w.Write(p)
+	}
+	return 0, errors.New("upstream body is not writable")
+}
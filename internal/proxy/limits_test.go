@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"router/internal/stats"
+	"router/internal/storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyRequestLimits(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.Copy(io.Discard, r.Body); err == nil {
+			io.WriteString(w, "ok")
+		}
+	}))
+	defer backend.Close()
+
+	host := "limits.example.com"
+	p, _, st := newRuleTestProxy(t, host, strings.TrimPrefix(backend.URL, "http://"), storage.Rule{
+		MaxBodyBytes: 16,
+	})
+	front := httptest.NewServer(p)
+	defer front.Close()
+
+	send := func(path string, body io.Reader, length int64) int {
+		req, _ := http.NewRequest(http.MethodPost, front.URL+path, body)
+		req.Host = host
+		req.ContentLength = length
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := send("/", strings.NewReader("small"), 5); code != http.StatusOK {
+		t.Fatalf("small body status = %d", code)
+	}
+	if code := send("/", strings.NewReader(strings.Repeat("a", 64)), 64); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("declared large body status = %d, want 413", code)
+	}
+	if code := send("/", io.MultiReader(strings.NewReader(strings.Repeat("a", 64))), -1); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("chunked large body status = %d, want 413", code)
+	}
+
+	rows := st.GetLimitData()
+	if len(rows) != 1 || rows[0][stats.BreachBodyTooLarge] != 2 {
+		t.Fatalf("limit stats = %+v", rows)
+	}
+}
+
+func TestHeaderTimeoutTransport(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(w, "done")
+	}))
+	defer backend.Close()
+
+	host := "timeout.example.com"
+	p, _, st := newRuleTestProxy(t, host, strings.TrimPrefix(backend.URL, "http://"), storage.Rule{})
+	rule, _ := p.store.GetRule(host)
+	transport := &headerTimeoutTransport{base: http.DefaultTransport, timeout: 50 * time.Millisecond}
+
+	req, _ := http.NewRequest(http.MethodGet, backend.URL+"/slow", nil)
+	if _, err := transport.RoundTrip(req); err != errUpstreamHeaderTimeout {
+		t.Fatalf("slow headers error = %v, want header timeout", err)
+	}
+
+	// Headers arrive in time; a slow body is not cut off.
+	transport.timeout = 150 * time.Millisecond
+	req, _ = http.NewRequest(http.MethodGet, backend.URL+"/", nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("round trip: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "done" {
+		t.Fatalf("body = %q, %v", body, err)
+	}
+
+	rec := httptest.NewRecorder()
+	p.upstreamError(rec, httptest.NewRequest(http.MethodGet, "http://"+host+"/slow", nil), errUpstreamHeaderTimeout, rule, headerVars{}, false)
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("timeout status = %d, want 504", rec.Code)
+	}
+	if rows := st.GetLimitData(); len(rows) != 1 || rows[0][stats.BreachUpstreamTimeout] != 1 {
+		t.Fatalf("limit stats = %+v", rows)
+	}
+}
+
+func TestProxyRequestDeadline(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(3 * time.Second):
+		}
+	}))
+	defer backend.Close()
+
+	host := "deadline.example.com"
+	p, _, st := newRuleTestProxy(t, host, strings.TrimPrefix(backend.URL, "http://"), storage.Rule{RequestTimeoutSec: 1})
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+	if rec.Code != http.StatusGatewayTimeout || time.Since(start) > 2*time.Second {
+		t.Fatalf("status = %d after %v, want 504 after ~1s", rec.Code, time.Since(start))
+	}
+	if rows := st.GetLimitData(); len(rows) != 1 || rows[0][stats.BreachDeadline] != 1 {
+		t.Fatalf("limit stats = %+v", rows)
+	}
+}
+
+func TestTimeoutsFromEnvLeaveBodiesUnbounded(t *testing.T) {
+	for _, key := range []string{"HTTP_READ_HEADER_TIMEOUT_SEC", "HTTP_READ_TIMEOUT_SEC", "HTTP_WRITE_TIMEOUT_SEC", "HTTP_IDLE_TIMEOUT_SEC"} {
+		t.Setenv(key, "")
+	}
+	got := TimeoutsFromEnv()
+	if got.ReadHeader != 10*time.Second || got.Idle != 120*time.Second || got.Read != 0 || got.Write != 0 {
+		t.Fatalf("default timeouts = %+v", got)
+	}
+	t.Setenv("HTTP_WRITE_TIMEOUT_SEC", "300")
+	if got := TimeoutsFromEnv(); got.Write != 300*time.Second {
+		t.Fatalf("write timeout = %v", got.Write)
+	}
+}
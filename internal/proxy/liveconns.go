@@ -0,0 +1,283 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"router/internal/stats"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	liveConnWebSocket = "websocket"
+	liveConnStreaming = "streaming"
+
+	// Draining waits for a quiet moment so no message is cut in half, but
+	// never longer than drainGrace.
+	drainGrace = 10 * time.Second
+	drainQuiet = 1 * time.Second
+)
+
+// liveConnKind classifies requests that may hold a connection open for a long time.
+func liveConnKind(r *http.Request) string {
+	if r.Header.Get("Upgrade") != "" && headerHasToken(r.Header, "Connection", "upgrade") {
+		return liveConnWebSocket
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		return liveConnStreaming
+	}
+	return ""
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// liveConnTracker keeps upgraded and streaming connections per rule host.
+type liveConnTracker struct {
+	stats  *stats.Stats
+	mu     sync.Mutex
+	byHost map[string]map[*liveConn]struct{}
+}
+
+func newLiveConnTracker(st *stats.Stats) *liveConnTracker {
+	return &liveConnTracker{stats: st, byHost: make(map[string]map[*liveConn]struct{})}
+}
+
+// open registers a connection unless the host already has max active ones.
+func (t *liveConnTracker) open(host, kind string, max int) (*liveConn, bool) {
+	t.mu.Lock()
+	conns := t.byHost[host]
+	if max > 0 && len(conns) >= max {
+		t.mu.Unlock()
+		if t.stats != nil {
+			t.stats.LiveConnRejected(host)
+		}
+		return nil, false
+	}
+	if conns == nil {
+		conns = make(map[*liveConn]struct{})
+		t.byHost[host] = conns
+	}
+	c := &liveConn{tracker: t, host: host, kind: kind, started: time.Now(), done: make(chan struct{})}
+	c.touch()
+	conns[c] = struct{}{}
+	t.mu.Unlock()
+
+	if t.stats != nil {
+		t.stats.LiveConnOpened(host, kind)
+	}
+	return c, true
+}
+
+// active returns the number of tracked connections for host.
+func (t *liveConnTracker) active(host string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.byHost[host])
+}
+
+// drain gracefully closes connections of host, or of every host when host is empty.
+func (t *liveConnTracker) drain(host string) {
+	t.mu.Lock()
+	var conns []*liveConn
+	for h, set := range t.byHost {
+		if host != "" && h != host {
+			continue
+		}
+		for c := range set {
+			conns = append(conns, c)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, c := range conns {
+		go c.drain()
+	}
+}
+
+// liveConn is one tracked long-lived connection.
+type liveConn struct {
+	tracker    *liveConnTracker
+	host       string
+	kind       string
+	started    time.Time
+	lastActive atomic.Int64
+	done       chan struct{}
+
+	mu      sync.Mutex
+	closers []func()
+	reason  string
+	closed  bool
+	once    sync.Once
+}
+
+func (c *liveConn) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+func (c *liveConn) idleFor() time.Duration {
+	return time.Since(time.Unix(0, c.lastActive.Load()))
+}
+
+// onClose registers a function that tears the connection down.
+func (c *liveConn) onClose(fn func()) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		fn()
+		return
+	}
+	c.closers = append(c.closers, fn)
+	c.mu.Unlock()
+}
+
+// close tears the connection down and remembers why.
+func (c *liveConn) close(reason string) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	c.reason = reason
+	closers := c.closers
+	c.mu.Unlock()
+	for _, fn := range closers {
+		fn()
+	}
+}
+
+// watch enforces idle and absolute timeouts until the connection finishes.
+func (c *liveConn) watch(idle, lifetime time.Duration) {
+	if idle <= 0 && lifetime <= 0 {
+		return
+	}
+	interval := time.Second
+	if idle > 0 && idle/2 < interval {
+		interval = idle / 2
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+				if lifetime > 0 && time.Since(c.started) >= lifetime {
+					c.close("lifetime")
+					return
+				}
+				if idle > 0 && c.idleFor() >= idle {
+					c.close("idle")
+					return
+				}
+			}
+		}
+	}()
+}
+
+func (c *liveConn) drain() {
+	deadline := time.Now().Add(drainGrace)
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if c.idleFor() >= drainQuiet || time.Now().After(deadline) {
+			c.close("drain")
+			return
+		}
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// finish unregisters the connection once the proxy handler returns.
+func (c *liveConn) finish() {
+	c.once.Do(func() {
+		close(c.done)
+		c.mu.Lock()
+		c.closed = true
+		reason := c.reason
+		c.mu.Unlock()
+
+		t := c.tracker
+		t.mu.Lock()
+		if set, ok := t.byHost[c.host]; ok {
+			delete(set, c)
+			if len(set) == 0 {
+				delete(t.byHost, c.host)
+			}
+		}
+		t.mu.Unlock()
+		if t.stats != nil {
+			t.stats.LiveConnClosed(c.host, c.kind, reason)
+		}
+	})
+}
+
+// liveResponseWriter records activity and wraps hijacked connections.
+type liveResponseWriter struct {
+	http.ResponseWriter
+	conn *liveConn
+}
+
+func (w *liveResponseWriter) Write(p []byte) (int, error) {
+	w.conn.touch()
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *liveResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *liveResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	// The controller also reaches hijackers below wrappers that only Unwrap.
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.conn.onClose(func() { conn.Close() })
+	return &activityConn{Conn: conn, live: w.conn}, brw, nil
+}
+
+func (w *liveResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// activityConn marks the tracked connection active on every read and write.
+type activityConn struct {
+	net.Conn
+	live *liveConn
+}
+
+func (c *activityConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.live.touch()
+	}
+	return n, err
+}
+
+func (c *activityConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.live.touch()
+	}
+	return n, err
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"router/internal/stats"
+	"router/internal/storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newUpgradeBackend answers every request with 101 and echoes the raw stream.
+func newUpgradeBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+}
+
+func newRuleTestProxy(t *testing.T, host, target string, rule storage.Rule) (*Proxy, *storage.RuleStore, *stats.Stats) {
+	t.Helper()
+	store := storage.NewRuleStore(storage.NewStorage(filepath.Join(t.TempDir(), "rules.json")))
+	store.Add(host, target)
+	rule.Target = target
+	if err := store.Update(host, rule); err != nil {
+		t.Fatalf("update rule: %v", err)
+	}
+	st := stats.New()
+	p := &Proxy{store: store, stats: st, ppTransports: map[string]*http.Transport{}, live: newLiveConnTracker(st), mirrorSlots: make(chan struct{}, maxMirrorsInFlight)}
+	store.OnRuleChange = p.RuleChanged
+	return p, store, st
+}
+
+func dialUpgrade(t *testing.T, addr, host string) (net.Conn, *bufio.Reader, int) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n", host)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	return conn, reader, resp.StatusCode
+}
+
+func waitClosed(t *testing.T, conn net.Conn, reader *bufio.Reader, within time.Duration) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(within))
+	if _, err := reader.ReadByte(); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("connection still open after %s (err=%v)", within, err)
+	}
+}
+
+func TestLiveConnLimitAndDrainOnMaintenance(t *testing.T) {
+	backend := newUpgradeBackend(t)
+	defer backend.Close()
+	p, store, st := newRuleTestProxy(t, "app.test", strings.TrimPrefix(backend.URL, "http://"), storage.Rule{MaxConnections: 1})
+	front := httptest.NewServer(p)
+	defer front.Close()
+	frontAddr := strings.TrimPrefix(front.URL, "http://")
+
+	conn, reader, code := dialUpgrade(t, frontAddr, "app.test")
+	defer conn.Close()
+	if code != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", code)
+	}
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo = %q, %v", buf, err)
+	}
+
+	second, _, code := dialUpgrade(t, frontAddr, "app.test")
+	second.Close()
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("second connection status = %d, want 503", code)
+	}
+
+	store.SetRuleMaintenance("app.test", true)
+	waitClosed(t, conn, reader, drainQuiet+3*time.Second)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for p.live.active("app.test") != 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	rows := st.GetLiveConnData()
+	if len(rows) != 1 || rows[0]["active"] != 0 || rows[0]["rejected"] != 1 || rows[0]["drained"] != 1 {
+		t.Fatalf("live conn stats = %v", rows)
+	}
+}
+
+func TestLiveConnIdleTimeout(t *testing.T) {
+	backend := newUpgradeBackend(t)
+	defer backend.Close()
+	p, _, _ := newRuleTestProxy(t, "app.test", strings.TrimPrefix(backend.URL, "http://"), storage.Rule{IdleTimeoutSec: 1})
+	front := httptest.NewServer(p)
+	defer front.Close()
+
+	conn, reader, code := dialUpgrade(t, strings.TrimPrefix(front.URL, "http://"), "app.test")
+	defer conn.Close()
+	if code != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", code)
+	}
+	waitClosed(t, conn, reader, 3*time.Second)
+}
+
+func TestLiveConnKind(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if liveConnKind(r) != "" {
+		t.Fatalf("plain request classified as live")
+	}
+	r.Header.Set("Accept", "text/event-stream")
+	if liveConnKind(r) != liveConnStreaming {
+		t.Fatalf("SSE request not classified as streaming")
+	}
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Connection", "keep-alive, Upgrade")
+	if liveConnKind(r) != liveConnWebSocket {
+		t.Fatalf("upgrade request not classified as websocket")
+	}
+}
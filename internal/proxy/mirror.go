@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"router/internal/clog"
+	"router/internal/storage"
+	"time"
+)
+
+const (
+	defaultMirrorMaxBody = 1 << 20
+	mirrorTimeout        = 30 * time.Second
+	// maxMirrorsInFlight bounds shadow requests so that a slow shadow upstream
+	// cannot pile up goroutines; extra requests are skipped.
+	maxMirrorsInFlight = 64
+	// mirrorPairWait is how long a finished shadow request waits for the
+	// primary response before recording the sample.
+	mirrorPairWait = 5 * time.Minute
+)
+
+var mirrorClient = &http.Client{
+	Timeout: mirrorTimeout,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// mirrorResult carries the primary outcome to the shadow goroutine.
+type mirrorResult struct {
+	status  int
+	latency time.Duration
+}
+
+// startMirror sends a copy of r to the rule's shadow upstream when the request
+// is sampled. It returns a function that must be called with the primary
+// status once the primary response has started (or failed), or nil when the
+// request is not mirrored. r.Body is replaced when it had to be read.
+func (p *Proxy) startMirror(r *http.Request, rule *storage.Rule, remoteIP string, vars headerVars) func(int) {
+	policy := rule.Mirror
+	if policy == nil || rand.IntN(100) >= policy.Percent {
+		return nil
+	}
+	limit := policy.MaxBodyBytes
+	if limit <= 0 {
+		limit = defaultMirrorMaxBody
+	}
+
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		if r.ContentLength > limit {
+			p.stats.MirrorSkipped(r.Host)
+			return nil
+		}
+		buf, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+		if err != nil || int64(len(buf)) > limit {
+			// Hand the primary everything read so far followed by the rest.
+			r.Body = readCloser{io.MultiReader(bytes.NewReader(buf), errOrBody(err, r.Body)), r.Body}
+			p.stats.MirrorSkipped(r.Host)
+			return nil
+		}
+		body = buf
+		r.Body = readCloser{bytes.NewReader(buf), r.Body}
+	}
+
+	select {
+	case p.mirrorSlots <- struct{}{}:
+	default:
+		p.stats.MirrorSkipped(r.Host)
+		return nil
+	}
+
+	out, err := http.NewRequestWithContext(context.Background(), r.Method, "http://"+policy.Target+r.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		<-p.mirrorSlots
+		clog.Errorf("[mirror] %s %s host=%s: %v", r.Method, r.URL.Path, r.Host, err)
+		return nil
+	}
+	out.Header = r.Header.Clone()
+	out.Header.Del("Connection")
+	if len(body) == 0 {
+		out.Body = http.NoBody
+	}
+	out.ContentLength = int64(len(body))
+	if rule.PreserveHost {
+		out.Host = r.Host
+	}
+	setForwardingHeaders(out.Header, r, rule, remoteIP)
+	applyHeaderOps(out.Header, rule.RequestHeaders, vars)
+
+	primary := make(chan mirrorResult, 1)
+	start := time.Now()
+	host := r.Host
+	go func() {
+		defer func() { <-p.mirrorSlots }()
+		status := 0
+		resp, err := mirrorClient.Do(out)
+		latency := time.Since(start)
+		if err != nil {
+			clog.Debugf("[mirror] %s %s host=%s -> %s failed: %v", out.Method, out.URL.Path, host, policy.Target, err)
+		} else {
+			status = resp.StatusCode
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		select {
+		case result := <-primary:
+			p.stats.MirrorSample(host, result.status, result.latency, status, latency)
+		case <-time.After(mirrorPairWait):
+		}
+	}()
+	return func(status int) {
+		primary <- mirrorResult{status: status, latency: time.Since(start)}
+	}
+}
+
+func errOrBody(err error, body io.Reader) io.Reader {
+	if err != nil {
+		return errReader{err}
+	}
+	return body
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// statusRecorder remembers the status of a mirrored request's primary response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	done   func(int)
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 && code >= 200 {
+		w.status = code
+		w.done(code)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// finish reports a primary that never wrote a response.
+func (w *statusRecorder) finish() {
+	if w.status == 0 {
+		w.status = -1
+		w.done(0)
+	}
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"router/internal/storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirrorSendsCopyAndRecordsComparison(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer primary.Close()
+
+	shadowBodies := make(chan string, 4)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		shadowBodies <- r.Method + " " + r.URL.RequestURI() + " " + string(body) + " " + r.Header.Get("X-Real-IP")
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+
+	host := "mirror.example.com"
+	p, _, st := newRuleTestProxy(t, host, strings.TrimPrefix(primary.URL, "http://"), storage.Rule{
+		Mirror: &storage.MirrorPolicy{Target: strings.TrimPrefix(shadow.URL, "http://"), Percent: 100, MaxBodyBytes: 8},
+	})
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "http://"+host+"/api?x=1", strings.NewReader("hello")))
+	if rec.Code != http.StatusOK || rec.Body.String() != "hello" {
+		t.Fatalf("primary response = %d %q", rec.Code, rec.Body.String())
+	}
+	select {
+	case got := <-shadowBodies:
+		if got != "POST /api?x=1 hello 192.0.2.1" {
+			t.Fatalf("shadow request = %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("shadow request not sent")
+	}
+
+	// Bodies over the limit reach the primary intact and are not mirrored.
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "http://"+host+"/api", io.NopCloser(strings.NewReader("a long request body")))
+	req.ContentLength = -1
+	p.ServeHTTP(rec, req)
+	if rec.Body.String() != "a long request body" {
+		t.Fatalf("primary body after skipped mirror = %q", rec.Body.String())
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		rows := st.GetMirrorData()
+		if len(rows) == 1 && rows[0]["mismatches"] == 1 {
+			shadowSide := rows[0]["shadow"].(map[string]interface{})
+			primarySide := rows[0]["primary"].(map[string]interface{})
+			if shadowSide["5xx"] != 1 || primarySide["2xx"] != 1 || rows[0]["skipped"] != 1 {
+				t.Fatalf("mirror stats = %+v", rows)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("mirror stats = %+v", st.GetMirrorData())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case got := <-shadowBodies:
+		t.Fatalf("oversized request was mirrored: %q", got)
+	default:
+	}
+}
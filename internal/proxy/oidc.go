@@ -0,0 +1,438 @@
+package proxy
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"router/internal/clientip"
+	"router/internal/clog"
+	"router/internal/jose"
+	"router/internal/storage"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	oidcSessionCookie = "router_oidc"
+	oidcStateCookie   = "router_oidc_state"
+	oidcStateTTL      = 10 * time.Minute
+	oidcDiscoveryTTL  = time.Hour
+	oidcClockLeeway   = time.Minute
+	maxOIDCResponse   = 1 << 20
+	// maxSessionCookie keeps the sealed session under the browser cookie limit.
+	maxSessionCookie = 3800
+)
+
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcSigningAlgs are the ID token algorithms accepted from providers.
+var oidcSigningAlgs = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// Identity headers set for the upstream; client supplied values are removed.
+const (
+	oidcEmailHeader  = "X-Auth-Request-Email"
+	oidcUserHeader   = "X-Auth-Request-User"
+	oidcGroupsHeader = "X-Auth-Request-Groups"
+)
+
+// oidcProvider is the discovered configuration of an issuer.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	keys    *jose.RemoteKeySet
+	fetched time.Time
+}
+
+// oidcSession is the content of the encrypted session cookie.
+type oidcSession struct {
+	Email   string   `json:"e,omitempty"`
+	Subject string   `json:"s"`
+	Groups  []string `json:"g,omitempty"`
+	Expires int64    `json:"x"`
+}
+
+// oidcLogin is the content of the encrypted state cookie of a login in progress.
+type oidcLogin struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v"`
+	Return   string `json:"r"`
+	Expires  int64  `json:"x"`
+}
+
+// oidcAuth enforces the rule's OIDC policy. It reports whether the request
+// may proceed; otherwise the client was redirected to login or answered.
+func (p *Proxy) oidcAuth(w http.ResponseWriter, r *http.Request, policy *storage.OIDCPolicy) bool {
+	for _, name := range []string{oidcEmailHeader, oidcUserHeader, oidcGroupsHeader} {
+		r.Header.Del(name)
+	}
+	key := oidcKey(policy)
+	if r.URL.Path == policy.CallbackPath {
+		p.oidcCallback(w, r, policy, key)
+		return false
+	}
+
+	if c, err := r.Cookie(oidcSessionCookie); err == nil {
+		var session oidcSession
+		if openCookie(key, r.Host+"\x00session", c.Value, &session) == nil && time.Now().Unix() < session.Expires {
+			dropCookies(r, oidcSessionCookie, oidcStateCookie)
+			if session.Email != "" {
+				r.Header.Set(oidcEmailHeader, session.Email)
+			}
+			r.Header.Set(oidcUserHeader, session.Subject)
+			if len(session.Groups) > 0 {
+				r.Header.Set(oidcGroupsHeader, strings.Join(session.Groups, ","))
+			}
+			return true
+		}
+	}
+
+	// Only navigations can follow a login redirect.
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	provider, err := p.oidcProvider(r.Context(), policy.Issuer)
+	if err != nil {
+		clog.Errorf("[oidc] host=%s issuer=%s: %v", r.Host, policy.Issuer, err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return false
+	}
+	login := oidcLogin{
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Verifier: randomToken() + randomToken(),
+		Return:   r.URL.RequestURI(),
+		Expires:  time.Now().Add(oidcStateTTL).Unix(),
+	}
+	sealed, err := sealCookie(key, r.Host+"\x00state", login)
+	if err != nil {
+		clog.Errorf("[oidc] host=%s: %v", r.Host, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return false
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name: oidcStateCookie, Value: sealed, Path: policy.CallbackPath, MaxAge: int(oidcStateTTL.Seconds()),
+		HttpOnly: true, Secure: isHTTPS(r), SameSite: http.SameSiteLaxMode,
+	})
+	challenge := sha256.Sum256([]byte(login.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {policy.ClientID},
+		"redirect_uri":          {callbackURL(r, policy)},
+		"scope":                 {strings.Join(policy.Scopes, " ")},
+		"state":                 {login.State},
+		"nonce":                 {login.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, provider.AuthorizationEndpoint+sep+query.Encode(), http.StatusFound)
+	return false
+}
+
+// oidcCallback finishes a login: it checks the state, exchanges the code,
+// verifies the ID token, applies the domain/group restrictions and issues
+// the session cookie.
+func (p *Proxy) oidcCallback(w http.ResponseWriter, r *http.Request, policy *storage.OIDCPolicy, key []byte) {
+	query := r.URL.Query()
+	if msg := query.Get("error"); msg != "" {
+		clog.Warnf("[oidc] host=%s: login failed at the issuer: %s %s", r.Host, msg, query.Get("error_description"))
+		http.Error(w, "Login failed", http.StatusForbidden)
+		return
+	}
+	var login oidcLogin
+	c, err := r.Cookie(oidcStateCookie)
+	if err == nil {
+		err = openCookie(key, r.Host+"\x00state", c.Value, &login)
+	}
+	if err != nil || time.Now().Unix() >= login.Expires || subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(login.State)) != 1 {
+		http.Error(w, "Invalid or expired login state, please retry", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: policy.CallbackPath, MaxAge: -1, HttpOnly: true, Secure: isHTTPS(r)})
+
+	provider, err := p.oidcProvider(r.Context(), policy.Issuer)
+	if err != nil {
+		clog.Errorf("[oidc] host=%s issuer=%s: %v", r.Host, policy.Issuer, err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	claims, err := exchangeCode(r, policy, provider, query.Get("code"), login)
+	if err != nil {
+		clog.Warnf("[oidc] host=%s: %v", r.Host, err)
+		http.Error(w, "Login failed", http.StatusForbidden)
+		return
+	}
+
+	session := oidcSession{
+		Email:   strings.ToLower(claims.String("email")),
+		Subject: claims.String("sub"),
+		Groups:  claims.Strings(policy.GroupsClaim),
+		Expires: time.Now().Add(time.Duration(policy.SessionTTLSec) * time.Second).Unix(),
+	}
+	if reason := oidcDenied(policy, claims, session); reason != "" {
+		clog.Warnf("[oidc] host=%s user=%q: %s", r.Host, session.Email, reason)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if len(policy.AllowedGroups) > 0 {
+		// Only the groups the rule checks are worth the cookie space.
+		session.Groups = slices.DeleteFunc(session.Groups, func(g string) bool {
+			return !slices.Contains(policy.AllowedGroups, g)
+		})
+	}
+	sealed, err := sealCookie(key, r.Host+"\x00session", session)
+	if err != nil {
+		clog.Errorf("[oidc] host=%s: %v", r.Host, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if len(sealed) > maxSessionCookie {
+		clog.Errorf("[oidc] host=%s user=%q: session with %d groups does not fit in a cookie, set allowedGroups to keep only the groups that matter", r.Host, session.Email, len(session.Groups))
+		http.Error(w, "Login failed: too many groups for a session cookie", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name: oidcSessionCookie, Value: sealed, Path: "/", MaxAge: policy.SessionTTLSec,
+		HttpOnly: true, Secure: isHTTPS(r), SameSite: http.SameSiteLaxMode,
+	})
+	clog.Infof("[oidc] host=%s user=%q logged in", r.Host, session.Email)
+
+	target := login.Return
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		target = "/"
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// oidcDenied returns why a verified user may not log in, or "".
+func oidcDenied(policy *storage.OIDCPolicy, claims jose.Claims, session oidcSession) string {
+	if session.Subject == "" {
+		return "ID token has no subject"
+	}
+	if len(policy.AllowedDomains) > 0 {
+		if verified, ok := claims["email_verified"].(bool); ok && !verified {
+			return "email is not verified"
+		}
+		at := strings.LastIndexByte(session.Email, '@')
+		if at < 0 || !slices.Contains(policy.AllowedDomains, session.Email[at+1:]) {
+			return "email domain is not allowed"
+		}
+	}
+	if len(policy.AllowedGroups) > 0 && !slices.ContainsFunc(session.Groups, func(g string) bool {
+		return slices.Contains(policy.AllowedGroups, g)
+	}) {
+		return "user is not in an allowed group"
+	}
+	return ""
+}
+
+func exchangeCode(r *http.Request, policy *storage.OIDCPolicy, provider *oidcProvider, code string, login oidcLogin) (jose.Claims, error) {
+	if code == "" {
+		return nil, errors.New("callback without code")
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {callbackURL(r, policy)},
+		"code_verifier": {login.Verifier},
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(policy.ClientID), url.QueryEscape(policy.ClientSecret))
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxOIDCResponse))
+	if err != nil {
+		return nil, fmt.Errorf("token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil || tokens.IDToken == "" {
+		return nil, errors.New("token response has no id_token")
+	}
+
+	tok, err := jose.Parse(tokens.IDToken)
+	if err != nil {
+		return nil, fmt.Errorf("ID token: %w", err)
+	}
+	keys, err := provider.keys.Keys(r.Context(), tok.Header.Kid)
+	if err != nil {
+		return nil, fmt.Errorf("ID token keys: %w", err)
+	}
+	if err := tok.Verify(keys, oidcSigningAlgs); err != nil {
+		return nil, fmt.Errorf("ID token: %w", err)
+	}
+	if err := tok.Claims.Validate(jose.Expectations{
+		Issuer:     provider.Issuer,
+		Audiences:  []string{policy.ClientID},
+		Leeway:     oidcClockLeeway,
+		RequireExp: true,
+	}); err != nil {
+		return nil, fmt.Errorf("ID token: %w", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(tok.Claims.String("nonce")), []byte(login.Nonce)) != 1 {
+		return nil, errors.New("ID token nonce mismatch")
+	}
+	return tok.Claims, nil
+}
+
+// oidcProvider returns the discovered configuration of issuer, refreshed
+// hourly; the last good configuration is kept while discovery fails.
+func (p *Proxy) oidcProvider(ctx context.Context, issuer string) (*oidcProvider, error) {
+	cached, _ := p.oidcProviders.Load(issuer)
+	old, _ := cached.(*oidcProvider)
+	if old != nil && time.Since(old.fetched) < oidcDiscoveryTTL {
+		return old, nil
+	}
+	provider, err := discoverOIDC(ctx, issuer)
+	if err != nil {
+		if old != nil {
+			return old, nil
+		}
+		return nil, err
+	}
+	if old != nil && old.JWKSURI == provider.JWKSURI {
+		provider.keys = old.keys
+	}
+	p.oidcProviders.Store(issuer, provider)
+	return provider, nil
+}
+
+func discoverOIDC(ctx context.Context, issuer string) (*oidcProvider, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery: %s", resp.Status)
+	}
+	var provider oidcProvider
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxOIDCResponse)).Decode(&provider); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if strings.TrimRight(provider.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("discovery: issuer %q does not match", provider.Issuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, errors.New("discovery: endpoints are missing")
+	}
+	provider.keys = jose.NewRemoteKeySet(provider.JWKSURI)
+	provider.fetched = time.Now()
+	return &provider, nil
+}
+
+func callbackURL(r *http.Request, policy *storage.OIDCPolicy) string {
+	return forwardedProto(r, clientip.TrustedPeer(r)) + "://" + r.Host + policy.CallbackPath
+}
+
+func isHTTPS(r *http.Request) bool {
+	return forwardedProto(r, clientip.TrustedPeer(r)) == "https"
+}
+
+// oidcKey derives the cookie encryption key from the client credentials, so
+// sessions survive restarts and are dropped when the secret is rotated.
+func oidcKey(policy *storage.OIDCPolicy) []byte {
+	key := sha256.Sum256([]byte("router-oidc-session\x00" + policy.Issuer + "\x00" + policy.ClientID + "\x00" + policy.ClientSecret))
+	return key[:]
+}
+
+// sealCookie encrypts v with AES-GCM; aad binds the value to a host and purpose.
+func sealCookie(key []byte, aad string, v any) (string, error) {
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(gcm.Seal(nonce, nonce, plain, []byte(aad))), nil
+}
+
+func openCookie(key []byte, aad, value string, v any) error {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return errors.New("short cookie")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(aad))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plain, v)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func randomToken() string {
+	buf := make([]byte, 24)
+	rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// dropCookies removes the router's own cookies before the request goes upstream.
+func dropCookies(r *http.Request, names ...string) {
+	cookies := r.Cookies()
+	kept := make([]string, 0, len(cookies))
+	for _, c := range cookies {
+		if !slices.Contains(names, c.Name) {
+			kept = append(kept, c.Name+"="+c.Value)
+		}
+	}
+	r.Header.Del("Cookie")
+	if len(kept) > 0 {
+		r.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"router/internal/cache"
+	"router/internal/jose"
+	"router/internal/storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeIssuer is a minimal OpenID provider: /authorize is not served (the
+// test follows the redirect by hand), /token returns an ID token for the
+// last authorization request.
+type fakeIssuer struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	email     string
+	groups    []string
+	nonce     string
+	challenge string
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	t.Helper()
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	f := &fakeIssuer{key: key, email: "alice@corp.example", groups: []string{"staff", "dev"}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 f.URL,
+			"authorization_endpoint": f.URL + "/authorize",
+			"token_endpoint":         f.URL + "/token",
+			"jwks_uri":               f.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []any{map[string]string{
+			"kty": "RSA", "kid": "k1",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if user != "router" || pass != "s3cret" || r.FormValue("code") != "good-code" || base64.RawURLEncoding.EncodeToString(sum[:]) != f.challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		idToken, _ := jose.Sign("RS256", "k1", key, map[string]any{
+			"iss": f.URL, "aud": "router", "sub": "u-1", "email": f.email, "email_verified": true,
+			"groups": f.groups, "nonce": f.nonce, "exp": time.Now().Add(time.Hour).Unix(),
+		})
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "token_type": "Bearer"})
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func TestOIDCLoginFlow(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Auth-Request-Email")+"|"+r.Header.Get("X-Auth-Request-Groups")+"|"+r.Header.Get("Cookie"))
+	}))
+	defer upstream.Close()
+	issuer := newFakeIssuer(t)
+
+	host := "wiki.example.com"
+	p, _, _ := newRuleTestProxy(t, host, strings.TrimPrefix(upstream.URL, "http://"), storage.Rule{
+		OIDC: &storage.OIDCPolicy{
+			Issuer: issuer.URL, ClientID: "router", ClientSecret: "s3cret",
+			AllowedDomains: []string{"corp.example"}, AllowedGroups: []string{"dev"},
+		},
+	})
+
+	serve := func(target string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("X-Auth-Request-Email", "spoofed@evil.example")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+	login := func() *httptest.ResponseRecorder {
+		t.Helper()
+		rec := serve("http://" + host + "/docs?page=2")
+		if rec.Code != http.StatusFound {
+			t.Fatalf("anonymous request = %d", rec.Code)
+		}
+		authURL, _ := url.Parse(rec.Header().Get("Location"))
+		q := authURL.Query()
+		if authURL.Path != "/authorize" || q.Get("client_id") != "router" || q.Get("redirect_uri") != "http://"+host+"/oauth2/callback" || q.Get("scope") != "openid email profile" {
+			t.Fatalf("authorization redirect = %s", authURL)
+		}
+		issuer.nonce, issuer.challenge = q.Get("nonce"), q.Get("code_challenge")
+		state := rec.Result().Cookies()[0]
+		return serve("http://"+host+"/oauth2/callback?code=good-code&state="+url.QueryEscape(q.Get("state")), state)
+	}
+
+	// Only the allowed groups are kept, so a long groups claim still fits.
+	for i := range 300 {
+		issuer.groups = append(issuer.groups, fmt.Sprintf("department-%03d-readers", i))
+	}
+	rec := login()
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/docs?page=2" {
+		t.Fatalf("callback = %d %q %s", rec.Code, rec.Header().Get("Location"), rec.Body.String())
+	}
+	var session *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == oidcSessionCookie {
+			session = c
+		}
+	}
+	if session == nil || !session.HttpOnly {
+		t.Fatalf("session cookie = %+v", rec.Result().Cookies())
+	}
+
+	rec = serve("http://"+host+"/docs", session, &http.Cookie{Name: "app", Value: "1"})
+	if rec.Code != http.StatusOK || rec.Body.String() != "alice@corp.example|dev|app=1" {
+		t.Fatalf("authenticated request = %d %q", rec.Code, rec.Body.String())
+	}
+
+	// The session is bound to the host and cannot be forged.
+	if rec := serve("http://"+host+"/", &http.Cookie{Name: oidcSessionCookie, Value: session.Value + "x"}); rec.Code != http.StatusFound {
+		t.Fatalf("tampered session = %d", rec.Code)
+	}
+
+	// A state that does not match the cookie is rejected.
+	if rec := serve("http://" + host + "/oauth2/callback?code=good-code&state=forged"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("forged state = %d", rec.Code)
+	}
+
+	// Users outside the allowed groups or domains are refused.
+	issuer.groups = []string{"staff"}
+	if rec := login(); rec.Code != http.StatusForbidden {
+		t.Fatalf("user without allowed group = %d", rec.Code)
+	}
+	issuer.groups, issuer.email = []string{"dev"}, "mallory@gmail.com"
+	if rec := login(); rec.Code != http.StatusForbidden {
+		t.Fatalf("user from another domain = %d", rec.Code)
+	}
+}
+
+func TestOIDCSessionsDoNotShareCache(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, r.Header.Get("X-Auth-Request-Email"))
+	}))
+	defer upstream.Close()
+	issuer := newFakeIssuer(t)
+
+	host := "wiki.example.com"
+	p, store, _ := newRuleTestProxy(t, host, strings.TrimPrefix(upstream.URL, "http://"), storage.Rule{
+		OIDC: &storage.OIDCPolicy{Issuer: issuer.URL, ClientID: "router", ClientSecret: "s3cret"},
+	})
+	// Validation refuses this combination; a hand-edited rules.json may not.
+	rule, _ := store.GetRule(host)
+	rule.Cache = &storage.CachePolicy{Enabled: true, DefaultTTLSec: 60}
+	p.Cache, _ = cache.New(1<<20, "", 0)
+
+	serve := func(target string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+	login := func(email string) *http.Cookie {
+		t.Helper()
+		issuer.email = email
+		rec := serve("http://" + host + "/page")
+		authURL, _ := url.Parse(rec.Header().Get("Location"))
+		q := authURL.Query()
+		issuer.nonce, issuer.challenge = q.Get("nonce"), q.Get("code_challenge")
+		rec = serve("http://"+host+"/oauth2/callback?code=good-code&state="+url.QueryEscape(q.Get("state")), rec.Result().Cookies()[0])
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == oidcSessionCookie {
+				return c
+			}
+		}
+		t.Fatalf("no session for %s: %d %s", email, rec.Code, rec.Body.String())
+		return nil
+	}
+
+	alice, bob := login("alice@corp.example"), login("bob@corp.example")
+	if rec := serve("http://"+host+"/page", alice); rec.Body.String() != "alice@corp.example" {
+		t.Fatalf("alice got %q", rec.Body.String())
+	}
+	if rec := serve("http://"+host+"/page", bob); rec.Body.String() != "bob@corp.example" || rec.Header().Get("X-Cache") != "" {
+		t.Fatalf("bob got %q cache=%q", rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestOIDCRejectsSessionsTooLargeForACookie(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	for i := range 300 {
+		issuer.groups = append(issuer.groups, fmt.Sprintf("department-%03d-readers", i))
+	}
+	host := "wiki.example.com"
+	p, _, _ := newRuleTestProxy(t, host, "127.0.0.1:1", storage.Rule{
+		OIDC: &storage.OIDCPolicy{Issuer: issuer.URL, ClientID: "router", ClientSecret: "s3cret"},
+	})
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+	authURL, _ := url.Parse(rec.Header().Get("Location"))
+	q := authURL.Query()
+	issuer.nonce, issuer.challenge = q.Get("nonce"), q.Get("code_challenge")
+	req := httptest.NewRequest(http.MethodGet, "http://"+host+"/oauth2/callback?code=good-code&state="+url.QueryEscape(q.Get("state")), nil)
+	req.AddCookie(rec.Result().Cookies()[0])
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), "too many groups") {
+		t.Fatalf("oversized session = %d %q", rec.Code, rec.Body.String())
+	}
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == oidcSessionCookie {
+			t.Fatalf("a truncated session cookie was issued")
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"router/internal/clientip"
+	"router/internal/clog"
+	"router/internal/proxyproto"
+	"router/internal/stats"
+	"router/internal/storage"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	clientHelloTimeout = 10 * time.Second
+	passthroughDialTTL = 10 * time.Second
+)
+
+// PassthroughListener wraps the :443 listener. It peeks the TLS ClientHello of
+// every connection and splices the raw stream to the rule target when the SNI
+// host is marked as passthrough. All other connections are handed to Accept
+// untouched, so the HTTPS server can terminate TLS as usual.
+type PassthroughListener struct {
+	inner      net.Listener
+	store      *storage.RuleStore
+	stats      *stats.Stats
+	reputation *storage.IPReputationStore
+
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewPassthroughListener starts accepting on inner and returns the wrapping listener.
+func NewPassthroughListener(inner net.Listener, store *storage.RuleStore, stats *stats.Stats, reputation *storage.IPReputationStore) *PassthroughListener {
+	l := &PassthroughListener{
+		inner:      inner,
+		store:      store,
+		stats:      stats,
+		reputation: reputation,
+		conns:      make(chan net.Conn),
+		errs:       make(chan error, 1),
+		done:       make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// Accept returns the next connection that should be terminated locally.
+func (l *PassthroughListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the listener.
+func (l *PassthroughListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.inner.Close()
+	})
+	return err
+}
+
+// Addr returns the listener's network address.
+func (l *PassthroughListener) Addr() net.Addr {
+	return l.inner.Addr()
+}
+
+func (l *PassthroughListener) acceptLoop() {
+	for {
+		conn, err := l.inner.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(50 * time.Millisecond)
+				continue
+			}
+			select {
+			case l.errs <- err:
+			case <-l.done:
+			}
+			return
+		}
+		go l.route(conn)
+	}
+}
+
+// route peeks the ClientHello and either splices the connection or hands it over to Accept.
+func (l *PassthroughListener) route(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	serverName, peeked, err := peekClientHello(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	wrapped := &peekedConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(peeked), conn)}
+	if err != nil || serverName == "" {
+		// Let the TLS server produce the handshake error itself.
+		l.handOff(wrapped)
+		return
+	}
+
+	rule, ok := l.store.GetRule(serverName)
+	if !ok || !rule.Passthrough {
+		l.handOff(wrapped)
+		return
+	}
+	l.splice(wrapped, serverName, rule)
+}
+
+func (l *PassthroughListener) handOff(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *PassthroughListener) splice(client net.Conn, host string, rule *storage.Rule) {
+	defer client.Close()
+
+	remoteIP := clientip.SocketIP(client.RemoteAddr().String())
+	if l.reputation != nil && l.reputation.IsBanned(remoteIP) {
+		clog.Warnf("[blocked-ip] passthrough host=%s remote=%s", host, remoteIP)
+		return
+	}
+	if l.store.MaintenanceMode || rule.Maintenance {
+		clog.Infof("[maintenance-passthrough] host=%s remote=%s", host, remoteIP)
+		return
+	}
+	if l.stats != nil {
+		l.stats.AddRequest(host, stats.CountryFromIP(remoteIP))
+	}
+
+	targetAddr := targetHostPort(rule.Target)
+	upstream, err := net.DialTimeout("tcp", targetAddr, passthroughDialTTL)
+	if err != nil {
+		clog.Errorf("[passthrough] dial %s for host=%s failed: %v", targetAddr, host, err)
+		return
+	}
+	defer upstream.Close()
+	if version := proxyproto.NormalizeVersion(rule.ProxyProtocol); version != "" {
+		if err := proxyproto.WriteHeader(upstream, version, client.RemoteAddr(), client.LocalAddr()); err != nil {
+			clog.Errorf("[passthrough] PROXY header to %s failed: %v", targetAddr, err)
+			return
+		}
+	}
+
+	clog.Infof("[passthrough-forward] host=%s remote=%s -> %s", host, remoteIP, targetAddr)
+	pipe(client, upstream)
+}
+
+// pipe copies data in both directions until either side is done.
+func pipe(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = dst.Close()
+		}
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+}
+
+// targetHostPort strips an optional scheme from the rule target so it can be dialed.
+func targetHostPort(target string) string {
+	target = strings.TrimSpace(target)
+	target = strings.TrimPrefix(target, "https://")
+	target = strings.TrimPrefix(target, "http://")
+	return strings.TrimSuffix(target, "/")
+}
+
+// peekedConn replays the bytes consumed while peeking the ClientHello.
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// CloseWrite forwards half-close to the underlying TCP connection when possible.
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+var errHelloCaptured = errors.New("client hello captured")
+
+// peekClientHello reads the ClientHello from r and returns its SNI together
+// with every byte consumed from r.
+func peekClientHello(r io.Reader) (string, []byte, error) {
+	var peeked bytes.Buffer
+	var serverName string
+	captured := false
+	err := tls.Server(readOnlyConn{reader: io.TeeReader(r, &peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = strings.ToLower(hello.ServerName)
+			captured = true
+			return nil, errHelloCaptured
+		},
+	}).Handshake()
+	if captured {
+		return serverName, peeked.Bytes(), nil
+	}
+	return "", peeked.Bytes(), err
+}
+
+// readOnlyConn lets crypto/tls parse a ClientHello without writing anything back.
+type readOnlyConn struct {
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.reader.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
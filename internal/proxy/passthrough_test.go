@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"router/internal/storage"
+	"strings"
+	"testing"
+)
+
+func TestPeekClientHelloReadsSNI(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		_ = tls.Client(client, &tls.Config{ServerName: "Secure.Example.com", InsecureSkipVerify: true}).Handshake()
+	}()
+
+	name, peeked, err := peekClientHello(server)
+	if err != nil {
+		t.Fatalf("peekClientHello() error: %v", err)
+	}
+	if name != "secure.example.com" {
+		t.Fatalf("server name = %q, want secure.example.com", name)
+	}
+	if len(peeked) == 0 || peeked[0] != 0x16 {
+		t.Fatalf("expected peeked bytes to start with a TLS handshake record")
+	}
+}
+
+func TestPassthroughListenerSplicesTLS(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "backend-tls")
+	}))
+	defer backend.Close()
+
+	store := storage.NewRuleStore(storage.NewStorage(filepath.Join(t.TempDir(), "rules.json")))
+	store.Add("pass.example.com", strings.TrimPrefix(backend.URL, "https://"))
+	store.SetRulePassthrough("pass.example.com", true)
+	store.Add("local.example.com", "127.0.0.1:1")
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ln := NewPassthroughListener(inner, store, nil, nil)
+	defer ln.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialTLS: func(network, addr string) (net.Conn, error) {
+			host, _, _ := net.SplitHostPort(addr)
+			return tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: host, InsecureSkipVerify: true})
+		},
+	}}
+
+	resp, err := client.Get("https://pass.example.com/")
+	if err != nil {
+		t.Fatalf("passthrough request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "backend-tls" {
+		t.Fatalf("unexpected body %q", body)
+	}
+
+	// Non-passthrough hosts must be handed to Accept with the ClientHello intact.
+	accepted := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			accepted <- ""
+			return
+		}
+		defer conn.Close()
+		name, _, _ := peekClientHello(conn)
+		accepted <- name
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	go func() {
+		_ = tls.Client(conn, &tls.Config{ServerName: "local.example.com", InsecureSkipVerify: true}).Handshake()
+	}()
+	if got := <-accepted; got != "local.example.com" {
+		t.Fatalf("accepted conn replayed SNI %q, want local.example.com", got)
+	}
+}
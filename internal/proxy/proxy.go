@@ -1,17 +1,21 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"html/template"
-	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"path/filepath"
+	"router/internal/cache"
+	"router/internal/clientip"
 	"router/internal/clog"
 	"router/internal/notify"
+	"router/internal/proxyproto"
 	"router/internal/stats"
 	"router/internal/storage"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -22,6 +26,21 @@ type Proxy struct {
 	reputation      *storage.IPReputationStore
 	notifier        *notify.TelegramNotifier
 	maintenanceTmpl *template.Template
+	ppTransports    map[string]*http.Transport
+	live            *liveConnTracker
+	revalidating    sync.Map // cache keys with a background refresh in flight
+	balance         sync.Map // primary target -> round-robin counter
+	mirrorSlots     chan struct{}
+	authCache       sync.Map // hashes of basic auth credentials that passed bcrypt
+	oidcProviders   sync.Map // issuer -> *oidcProvider
+	jwksCache       sync.Map // JWKS URL -> *jose.RemoteKeySet
+	keyFiles        sync.Map // JWT key file path -> *keyFileEntry
+	jwtFailures     failureCounter
+
+	// Cache stores responses of rules with a cache policy; caching is off when nil.
+	Cache *cache.Store
+	// Signatures holds the request signatures; the built-in packs apply when nil.
+	Signatures *storage.SignatureStore
 }
 
 // NewProxy creates a new Proxy.
@@ -33,13 +52,31 @@ func NewProxy(store *storage.RuleStore, stats *stats.Stats, reputation *storage.
 		reputation:      reputation,
 		notifier:        notifier,
 		maintenanceTmpl: maintenanceTmpl,
+		ppTransports: map[string]*http.Transport{
+			proxyproto.V1: newProxyProtocolTransport(proxyproto.V1),
+			proxyproto.V2: newProxyProtocolTransport(proxyproto.V2),
+		},
+		live:        newLiveConnTracker(stats),
+		mirrorSlots: make(chan struct{}, maxMirrorsInFlight),
+	}
+}
+
+// markSuspicious adds points (the reason's weight when zero) to the score of
+// ip and announces an auto-ban.
+func (p *Proxy) markSuspicious(ip, reason string, points int) {
+	autoBanned, banUntil := p.reputation.AddSuspicion(ip, reason, points)
+	if autoBanned && p.notifier != nil {
+		until := "permanent"
+		if !banUntil.IsZero() {
+			until = banUntil.Format(time.RFC3339)
+		}
+		p.notifier.Notify("auto_ban", "auto-ban:"+ip, "🤖 Auto-ban activated\nip: "+ip+"\nreason: suspicion score reached after "+reason+"\nuntil: "+until)
 	}
 }
 
 // ServeHTTP handles the proxying of requests.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	socketIP := remoteAddrIP(r.RemoteAddr)
-	remoteIP := clientIP(r)
+	remoteIP := clientip.FromRequest(r)
 	if p.reputation != nil && p.reputation.IsBanned(remoteIP) {
 		clog.Warnf("[blocked-ip] %s %s host=%s remote=%s", r.Method, r.URL.Path, r.Host, remoteIP)
 		if p.notifier != nil {
@@ -64,10 +101,7 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		clog.Warnf("[no-rule] %s %s host=%s remote=%s", r.Method, r.URL.Path, r.Host, r.RemoteAddr)
 		if p.reputation != nil {
-			autoBanned, banUntil := p.reputation.MarkSuspicious(remoteIP, "unknown host")
-			if autoBanned && p.notifier != nil {
-				p.notifier.Notify("auto_ban", "auto-ban:"+remoteIP, "🤖 Auto-ban activated\nip: "+remoteIP+"\nreason: too many suspicious requests\nuntil: "+banUntil.Format(time.RFC3339))
-			}
+			p.markSuspicious(remoteIP, "unknown host", 0)
 		}
 		if p.notifier != nil {
 			p.notifier.NotifyWithBanButton("unknown_host", "unknown-host:"+remoteIP+":"+r.Host, notify.BuildProxyAlert(r.Method, r.URL.Path, r.Host, remoteIP, "unknown host"), remoteIP)
@@ -76,14 +110,8 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if p.reputation != nil && suspiciousPath(r.URL.Path) {
-		autoBanned, banUntil := p.reputation.MarkSuspicious(remoteIP, "suspicious path probe")
-		if autoBanned && p.notifier != nil {
-			p.notifier.Notify("auto_ban", "auto-ban:"+remoteIP, "🤖 Auto-ban activated\nip: "+remoteIP+"\nreason: too many suspicious requests\nuntil: "+banUntil.Format(time.RFC3339))
-		}
-		if p.notifier != nil {
-			p.notifier.NotifyWithBanButton("suspicious_probe", "probe:"+remoteIP+":"+r.URL.Path, notify.BuildProxyAlert(r.Method, r.URL.Path, r.Host, remoteIP, "suspicious path probe"), remoteIP)
-		}
+	if p.inspectRequest(w, r, remoteIP) {
+		return
 	}
 
 	if rule.Maintenance {
@@ -98,130 +126,237 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Add request to stats with the specific host
-	p.stats.AddRequest(r.Host, stats.CountryFromRequest(r))
-
-	targetURL, err := url.Parse("http://" + rule.Target)
-	if err != nil {
-		clog.Errorf("Error parsing target URL for host %s: %v", r.Host, err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	country := stats.CountryFromRequest(r)
+	p.stats.AddRequest(r.Host, country)
+	vars := headerVars{clientIP: remoteIP, country: country, requestID: requestID(r), host: r.Host}
+	if rule.CORS != nil {
+		var answered bool
+		if w, answered = handleCORS(w, r, rule.CORS); answered {
+			return
+		}
+	}
+	if !p.checkAccess(w, r, rule.Access, remoteIP, country) {
 		return
 	}
-
-	proxy := httputil.NewSingleHostReverseProxy(targetURL)
-
-	// Update the request headers
-	r.URL.Host = targetURL.Host
-	r.URL.Scheme = targetURL.Scheme
-	r.Header.Set("X-Real-IP", remoteIP)
-	r.Header.Set("X-Forwarded-Host", r.Header.Get("Host"))
-	r.Header.Set("X-Forwarded-For", appendForwardedFor(r.Header.Get("X-Forwarded-For"), socketIP))
-	r.Host = targetURL.Host
-
-	clog.Infof("[proxy-forward] %s %s src=%s remote=%s xff=%q host=%s -> %s", r.Method, r.URL.Path, remoteIP, r.RemoteAddr, r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Forwarded-Host"), targetURL.Host)
-
-	proxy.ServeHTTP(w, r)
-}
-
-func serveMaintenanceStatic(w http.ResponseWriter, r *http.Request) bool {
-	if r.URL.Path != "/static/styles.css" {
-		return false
+	if rule.ForwardAuth != nil && !p.forwardAuth(w, r, rule, remoteIP) {
+		return
 	}
-
-	if r.Method != http.MethodGet && r.Method != http.MethodHead {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return true
+	if rule.OIDC != nil && !p.oidcAuth(w, r, rule.OIDC) {
+		return
+	}
+	if rule.JWT != nil && !p.checkJWT(w, r, rule.JWT, remoteIP) {
+		return
 	}
 
-	http.ServeFile(w, r, filepath.Clean("internal/panel/static/styles.css"))
-	return true
-}
-
-func clientIP(r *http.Request) string {
-	socketIP := remoteAddrIP(r.RemoteAddr)
+	if rule.Redirect != nil {
+		location := redirectLocation(rule.Redirect, r)
+		clog.Infof("[redirect] %s %s host=%s -> %s (%d)", r.Method, r.URL.Path, r.Host, location, rule.Redirect.Code)
+		http.Redirect(w, r, location, rule.Redirect.Code)
+		return
+	}
+	if location, code := rewriteURL(rule, r); code != 0 {
+		clog.Infof("[redirect] %s %s host=%s -> %s (%d)", r.Method, r.URL.Path, r.Host, location, code)
+		http.Redirect(w, r, location, code)
+		return
+	}
 
-	if ip := firstValidIP(r.Header.Get("CF-Connecting-IP")); ip != "" {
-		if isPublicIP(ip) || !isPublicIP(socketIP) {
-			return ip
+	if rule.MaxBodyBytes > 0 {
+		if r.ContentLength > rule.MaxBodyBytes {
+			p.bodyTooLarge(w, r, rule.MaxBodyBytes)
+			return
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = http.MaxBytesReader(w, r.Body, rule.MaxBodyBytes)
 		}
 	}
 
-	if ip := firstPublicIPFromXFF(r.Header.Get("X-Forwarded-For")); ip != "" {
-		return ip
+	if cw, ok := newCompressWriter(w, r, rule.Compression); ok {
+		defer cw.Close()
+		w = cw
+	}
+
+	if rule.Static != nil {
+		applyResponseHeaders(w.Header(), rule, vars)
+		serveStatic(w, r, rule.Static)
+		return
 	}
 
-	if ip := firstValidIP(r.Header.Get("X-Real-IP")); ip != "" {
-		if isPublicIP(ip) || !isPublicIP(socketIP) {
-			return ip
+	upstreams := p.upstreamOrder(rule)
+	if rule.Canary != nil {
+		variant := chooseVariant(w, r, rule.Canary)
+		p.stats.CanaryRequest(r.Host, variant.Name)
+		if variant.Target != "" {
+			upstreams = []string{variant.Target}
 		}
 	}
+	targetURL, err := upstreamURL(upstreams[0])
+	if err != nil {
+		clog.Errorf("Error parsing target URL for host %s: %v", r.Host, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
 
-	if isPublicIP(socketIP) {
-		return socketIP
+	// Variants may answer differently, and session-based auth answers per
+	// user while the cache key is shared, so those rules bypass the cache.
+	cacheable := p.Cache != nil && rule.Cache != nil && rule.Canary == nil && rule.OIDC == nil && rule.ForwardAuth == nil &&
+		liveConnKind(r) == "" && cache.Cacheable(r)
+	if cacheable && p.serveCached(w, r, rule, upstreams, remoteIP, vars) {
+		return
 	}
 
-	if ip := firstValidIPFromXFF(r.Header.Get("X-Forwarded-For")); ip != "" {
-		return ip
+	if liveConnKind(r) == "" {
+		if done := p.startMirror(r, rule, remoteIP, vars); done != nil {
+			rec := &statusRecorder{ResponseWriter: w, done: done}
+			defer rec.finish()
+			w = rec
+		}
 	}
 
-	if ip := firstValidIP(r.Header.Get("X-Real-IP")); ip != "" {
-		return ip
+	if kind := liveConnKind(r); kind != "" {
+		host := r.Host
+		live, ok := p.live.open(host, kind, rule.MaxConnections)
+		if !ok {
+			clog.Warnf("[live-conn-limit] %s %s host=%s remote=%s limit=%d", r.Method, r.URL.Path, host, remoteIP, rule.MaxConnections)
+			http.Error(w, "Too many connections", http.StatusServiceUnavailable)
+			return
+		}
+		// Idle and lifetime limits of the rule replace the listener timeouts.
+		extendDeadlines(w, time.Time{})
+		defer live.finish()
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		live.onClose(cancel)
+		r = r.WithContext(ctx)
+		w = &liveResponseWriter{ResponseWriter: w, conn: live}
+		live.watch(seconds(rule.IdleTimeoutSec), seconds(rule.MaxLifetimeSec))
+	} else if rule.RequestTimeoutSec > 0 {
+		deadline := time.Now().Add(seconds(rule.RequestTimeoutSec))
+		extendDeadlines(w, deadline.Add(time.Second))
+		ctx, cancel := context.WithDeadline(r.Context(), deadline)
+		defer cancel()
+		r = r.WithContext(ctx)
 	}
 
-	return socketIP
-}
+	proxy, r := p.reverseProxy(r, rule, upstreams, remoteIP, vars, cacheable)
+	clog.Infof("[proxy-forward] %s %s src=%s remote=%s xff=%q host=%s -> %s", r.Method, r.URL.Path, remoteIP, r.RemoteAddr, r.Header.Get("X-Forwarded-For"), r.Host, targetURL.Host)
 
-func remoteAddrIP(remoteAddr string) string {
-	host, _, err := net.SplitHostPort(remoteAddr)
-	if err != nil {
-		return strings.TrimSpace(remoteAddr)
-	}
-	return strings.TrimSpace(host)
+	proxy.ServeHTTP(w, r)
 }
 
-func firstPublicIPFromXFF(xff string) string {
-	parts := strings.Split(xff, ",")
-	for _, part := range parts {
-		ip := firstValidIP(part)
-		if ip == "" {
-			continue
-		}
-		if isPublicIP(ip) {
-			return ip
+// reverseProxy builds the upstream round trip for r. With cacheable set the
+// response is stored in the cache and stale entries cover upstream errors.
+func (p *Proxy) reverseProxy(r *http.Request, rule *storage.Rule, upstreams []string, remoteIP string, vars headerVars, cacheable bool) (*httputil.ReverseProxy, *http.Request) {
+	targetURL, _ := upstreamURL(upstreams[0]) // validated by the caller
+	headerPolicy := responseHeaderPolicy(rule, vars)
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(targetURL)
+			if rule.PreserveHost {
+				pr.Out.Host = pr.In.Host
+			}
+			setForwardingHeaders(pr.Out.Header, pr.In, rule, remoteIP)
+			applyHeaderOps(pr.Out.Header, rule.RequestHeaders, vars)
+			if cacheable {
+				// Let the transport negotiate and decode gzip so that one
+				// identity copy serves every client.
+				pr.Out.Header.Del("Accept-Encoding")
+			}
+		},
+		ModifyResponse: headerPolicy,
+	}
+	in := r
+	if cacheable {
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			p.cacheResponse(in, resp, rule.Cache)
+			if headerPolicy != nil {
+				return headerPolicy(resp)
+			}
+			return nil
 		}
 	}
-	return ""
+	// The error handler receives the outgoing request; report against the incoming one.
+	proxy.ErrorHandler = func(w http.ResponseWriter, _ *http.Request, err error) {
+		p.upstreamError(w, in, err, rule, vars, cacheable)
+	}
+	var transport http.RoundTripper = http.DefaultTransport
+	if pp, ok := p.ppTransports[proxyproto.NormalizeVersion(rule.ProxyProtocol)]; ok {
+		transport = pp
+		r = withClientAddr(r)
+	}
+	if rule.ResponseHeaderTimeoutSec > 0 {
+		transport = &headerTimeoutTransport{base: transport, timeout: seconds(rule.ResponseHeaderTimeoutSec)}
+	}
+	if rule.Retry != nil {
+		transport = &retryTransport{base: transport, policy: rule.Retry, upstreams: upstreams, store: p.store}
+	}
+	proxy.Transport = transport
+	return proxy, r
 }
 
-func firstValidIPFromXFF(xff string) string {
-	parts := strings.Split(xff, ",")
-	for _, part := range parts {
-		if ip := firstValidIP(part); ip != "" {
-			return ip
+// upstreamError answers a failed round trip: 413 for an oversized body, 504
+// for timeouts, a stale cache entry when allowed and 502 otherwise.
+func (p *Proxy) upstreamError(w http.ResponseWriter, r *http.Request, err error, rule *storage.Rule, vars headerVars, cacheable bool) {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		p.bodyTooLarge(w, r, tooLarge.Limit)
+		return
+	case errors.Is(err, errUpstreamHeaderTimeout):
+		p.stats.LimitBreach(r.Host, stats.BreachUpstreamTimeout)
+	case errors.Is(r.Context().Err(), context.DeadlineExceeded):
+		p.stats.LimitBreach(r.Host, stats.BreachDeadline)
+	}
+	clog.Errorf("[proxy-error] %s %s host=%s: %v", r.Method, r.URL.Path, r.Host, err)
+	if cacheable {
+		if entry := p.Cache.Lookup(r); entry != nil && entry.CanServeOnError(time.Now()) {
+			writeCached(w, r, entry, rule, vars, "STALE")
+			return
 		}
 	}
-	return ""
+	if errors.Is(err, errUpstreamHeaderTimeout) || errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+		return
+	}
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+func (p *Proxy) bodyTooLarge(w http.ResponseWriter, r *http.Request, limit int64) {
+	clog.Warnf("[body-limit] %s %s host=%s limit=%d", r.Method, r.URL.Path, r.Host, limit)
+	p.stats.LimitBreach(r.Host, stats.BreachBodyTooLarge)
+	w.Header().Set("Connection", "close")
+	http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
 }
 
-func firstValidIP(value string) string {
-	ip := strings.TrimSpace(value)
-	if ip == "" {
-		return ""
+// RuleChanged drains long-lived connections of a rule that was removed or put
+// into maintenance. An empty host refers to the global maintenance switch.
+func (p *Proxy) RuleChanged(host string) {
+	if host == "" {
+		if p.store.MaintenanceMode {
+			p.live.drain("")
+		}
+		return
 	}
-	parsed := net.ParseIP(ip)
-	if parsed == nil {
-		return ""
+	rule, ok := p.store.GetRule(host)
+	if !ok || rule.Maintenance {
+		p.live.drain(host)
 	}
-	return parsed.String()
 }
 
-func isPublicIP(ip string) bool {
-	parsed := net.ParseIP(strings.TrimSpace(ip))
-	if parsed == nil {
+func seconds(n int) time.Duration {
+	return time.Duration(n) * time.Second
+}
+
+func serveMaintenanceStatic(w http.ResponseWriter, r *http.Request) bool {
+	if r.URL.Path != "/static/styles.css" {
 		return false
 	}
-	if parsed.IsLoopback() || parsed.IsPrivate() || parsed.IsLinkLocalMulticast() || parsed.IsLinkLocalUnicast() || parsed.IsMulticast() || parsed.IsUnspecified() {
-		return false
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return true
 	}
+
+	http.ServeFile(w, r, filepath.Clean("internal/panel/static/styles.css"))
 	return true
 }
 
@@ -231,14 +366,3 @@ func appendForwardedFor(existing, remoteIP string) string {
 	}
 	return existing + ", " + remoteIP
 }
-
-func suspiciousPath(path string) bool {
-	path = strings.ToLower(path)
-	probes := []string{".env", "wp-admin", "wp-login", "phpmyadmin", "adminer", "/etc/passwd", "/.git"}
-	for _, p := range probes {
-		if strings.Contains(path, p) {
-			return true
-		}
-	}
-	return false
-}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"router/internal/proxyproto"
+	"time"
+)
+
+type clientAddrKey struct{}
+
+// withClientAddr stores the client socket address for the upstream dialer.
+func withClientAddr(r *http.Request) *http.Request {
+	ap, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return r
+	}
+	ctx := context.WithValue(r.Context(), clientAddrKey{}, net.Addr(net.TCPAddrFromAddrPort(ap)))
+	return r.WithContext(ctx)
+}
+
+// newProxyProtocolTransport returns a transport that prefixes every upstream
+// connection with a PROXY protocol header. Keep-alives are disabled because
+// each upstream connection carries exactly one client's address.
+func newProxyProtocolTransport(version string) *http.Transport {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return &http.Transport{
+		DisableKeepAlives:     true,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			src, _ := ctx.Value(clientAddrKey{}).(net.Addr)
+			dst, _ := ctx.Value(http.LocalAddrContextKey).(net.Addr)
+			if err := proxyproto.WriteHeader(conn, version, src, dst); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		},
+	}
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"router/internal/clog"
+	"router/internal/storage"
+	"slices"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// maxRetryBody is the largest request body buffered so that it can be re-sent.
+const maxRetryBody = 1 << 20
+
+func upstreamURL(target string) (*url.URL, error) {
+	return url.Parse("http://" + target)
+}
+
+// upstreamOrder returns the rule's upstreams in the order they should be
+// tried: healthy targets rotated round-robin, then the ones marked down.
+func (p *Proxy) upstreamOrder(rule *storage.Rule) []string {
+	upstreams := rule.Upstreams()
+	if len(upstreams) < 2 {
+		return upstreams
+	}
+	counter, _ := p.balance.LoadOrStore(rule.Target, new(atomic.Uint64))
+	start := int(counter.(*atomic.Uint64).Add(1)-1) % len(upstreams)
+	rotated := append(slices.Clone(upstreams[start:]), upstreams[:start]...)
+
+	ordered := make([]string, 0, len(rotated))
+	var down []string
+	for _, target := range rotated {
+		if p.store.TargetDown(target) {
+			down = append(down, target)
+		} else {
+			ordered = append(ordered, target)
+		}
+	}
+	return append(ordered, down...)
+}
+
+// retryAllowed reports whether the policy may re-send r.
+func retryAllowed(r *http.Request, policy *storage.RetryPolicy) bool {
+	if policy.NonIdempotent || r.Header.Get("Idempotency-Key") != "" {
+		return true
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// isConnectError reports whether the request failed before the upstream
+// answered: the dial failed or the connection was reset.
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// retryTransport re-sends failed requests according to a rule's RetryPolicy,
+// moving through upstreams in order. Upstreams that refuse connections are
+// marked down so that other requests avoid them until the next health check.
+type retryTransport struct {
+	base      http.RoundTripper
+	policy    *storage.RetryPolicy
+	upstreams []string
+	store     *storage.RuleStore
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !retryAllowed(req, t.policy) || !rewindable(req) {
+		return t.base.RoundTrip(req)
+	}
+	for attempt := 1; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if err != nil && isConnectError(err) && t.store != nil {
+			t.store.MarkTargetDown(req.URL.Host)
+		}
+		if attempt >= t.policy.MaxAttempts || !t.shouldRetry(resp, err) {
+			return resp, err
+		}
+		reason := retryReason(resp, err)
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+
+		backoff := time.Duration(t.policy.BackoffMs) * time.Millisecond << (attempt - 1)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		next := req.Clone(req.Context())
+		if target, err := upstreamURL(t.upstreams[attempt%len(t.upstreams)]); err == nil {
+			next.URL.Host = target.Host
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			next.Body = body
+		}
+		clog.Warnf("[retry] %s %s attempt %d/%d -> %s after %s", req.Method, req.URL.Path, attempt+1, t.policy.MaxAttempts, next.URL.Host, reason)
+		req = next
+	}
+}
+
+func (t *retryTransport) shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return t.policy.OnConnectError && isConnectError(err)
+	}
+	return slices.Contains(t.policy.OnStatus, resp.StatusCode)
+}
+
+func retryReason(resp *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return resp.Status
+}
+
+// rewindable makes a small request body replayable; larger or streamed bodies
+// are sent once.
+func rewindable(req *http.Request) bool {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return true
+	}
+	if req.ContentLength <= 0 || req.ContentLength > maxRetryBody {
+		return false
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		req.Body = io.NopCloser(errReader{err})
+		return false
+	}
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.Body, _ = req.GetBody()
+	return true
+}
+
+// errReader replays a body read error to the transport.
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"router/internal/storage"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// deadAddr returns an address that refuses connections.
+func deadAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestRetryMovesToHealthyTarget(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	host := "retry.example.com"
+	dead := deadAddr(t)
+	p, store, _ := newRuleTestProxy(t, host, dead, storage.Rule{
+		Targets: []string{strings.TrimPrefix(backend.URL, "http://")},
+		Retry:   &storage.RetryPolicy{MaxAttempts: 2, OnConnectError: true},
+	})
+
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+			t.Fatalf("request %d: status %d body %q", i, rec.Code, rec.Body.String())
+		}
+	}
+	if !store.TargetDown(dead) {
+		t.Fatal("refusing target was not marked down")
+	}
+	rule, _ := store.GetRule(host)
+	if order := p.upstreamOrder(rule); order[0] == dead {
+		t.Fatalf("down target is tried first: %v", order)
+	}
+}
+
+func TestRetryOnStatusRespectsIdempotency(t *testing.T) {
+	var calls atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if calls.Add(1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(body)
+	}))
+	defer backend.Close()
+
+	host := "status.example.com"
+	p, _, _ := newRuleTestProxy(t, host, strings.TrimPrefix(backend.URL, "http://"), storage.Rule{
+		Retry: &storage.RetryPolicy{MaxAttempts: 3, BackoffMs: 1, OnStatus: []int{503}},
+	})
+	send := func(method string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://"+host+"/", strings.NewReader("payload"))
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := send(http.MethodPut, nil); rec.Code != http.StatusOK || rec.Body.String() != "payload" {
+		t.Fatalf("PUT: status %d body %q", rec.Code, rec.Body.String())
+	}
+	calls.Store(0)
+	if rec := send(http.MethodPost, nil); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("POST without idempotency key: status %d, want 503", rec.Code)
+	}
+	calls.Store(0)
+	if rec := send(http.MethodPost, http.Header{"Idempotency-Key": {"abc"}}); rec.Code != http.StatusOK || rec.Body.String() != "payload" {
+		t.Fatalf("POST with idempotency key: status %d body %q", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"router/internal/storage"
+	"strings"
+)
+
+// redirectLocation returns where a redirect rule sends the request.
+func redirectLocation(redirect *storage.RedirectPolicy, r *http.Request) string {
+	location := redirect.To
+	if redirect.PreservePath {
+		location += r.URL.EscapedPath()
+	}
+	if redirect.PreserveQuery && r.URL.RawQuery != "" {
+		location += "?" + r.URL.RawQuery
+	}
+	return location
+}
+
+// rewriteURL applies path rewrites and query operations to r in place. When a
+// rewrite is configured as a redirect it returns the location and status code
+// instead, and r is left untouched.
+func rewriteURL(rule *storage.Rule, r *http.Request) (string, int) {
+	path := r.URL.Path
+	query := r.URL.RawQuery
+	for _, rw := range rule.Rewrites {
+		re := compilePattern(rw.Pattern)
+		if re == nil {
+			continue
+		}
+		if rw.Redirect != 0 {
+			// The Location goes back to the client, so keep the path escaped:
+			// a decoded %2F or %3F would turn into a host or a query.
+			escaped := r.URL.EscapedPath()
+			if path != r.URL.Path {
+				escaped = (&url.URL{Path: path}).EscapedPath()
+			}
+			if !re.MatchString(escaped) {
+				continue
+			}
+			location := safeLocation(re.ReplaceAllString(escaped, rw.Replacement))
+			if query != "" {
+				location += joinQuery(location, query)
+			}
+			return location, rw.Redirect
+		}
+		if !re.MatchString(path) {
+			continue
+		}
+		path, query = splitRewrite(re.ReplaceAllString(path, rw.Replacement), query)
+	}
+
+	if len(rule.Query) > 0 {
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			values = url.Values{}
+		}
+		for _, op := range rule.Query {
+			switch op.Action {
+			case storage.HeaderSet:
+				values.Set(op.Name, op.Value)
+			case storage.HeaderAppend:
+				values.Add(op.Name, op.Value)
+			case storage.HeaderDelete:
+				values.Del(op.Name)
+			}
+		}
+		query = values.Encode()
+	}
+
+	if path != r.URL.Path {
+		r.URL.Path = path
+		r.URL.RawPath = ""
+	}
+	r.URL.RawQuery = query
+	return "", 0
+}
+
+// safeLocation collapses leading slashes and backslashes of a relative
+// location: browsers read "//host" and "/\host" as another host.
+func safeLocation(location string) string {
+	if len(location) < 2 || location[0] != '/' || (location[1] != '/' && location[1] != '\\') {
+		return location
+	}
+	return "/" + strings.TrimLeft(location, "/\\")
+}
+
+// splitRewrite separates a query string carried by the replacement and merges
+// it with the original one; parameters from the replacement come first.
+func splitRewrite(rewritten, query string) (string, string) {
+	path, extra, found := strings.Cut(rewritten, "?")
+	if !found {
+		return rewritten, query
+	}
+	if query == "" {
+		return path, extra
+	}
+	if extra == "" {
+		return path, query
+	}
+	return path, extra + "&" + query
+}
+
+func joinQuery(location, query string) string {
+	if strings.Contains(location, "?") {
+		return "&" + query
+	}
+	return "?" + query
+}
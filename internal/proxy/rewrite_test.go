@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"router/internal/storage"
+	"strings"
+	"testing"
+)
+
+func TestProxyRedirectRule(t *testing.T) {
+	p, _, _ := newRuleTestProxy(t, "www.example.com", "", storage.Rule{
+		Redirect: &storage.RedirectPolicy{To: "https://example.com/", Code: 308, PreservePath: true, PreserveQuery: true},
+	})
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "http://www.example.com/a%20b/c?x=1", nil))
+	if rec.Code != http.StatusPermanentRedirect {
+		t.Fatalf("status = %d, want 308", rec.Code)
+	}
+	if got := rec.Header().Get("Location"); got != "https://example.com/a%20b/c?x=1" {
+		t.Fatalf("Location = %q", got)
+	}
+}
+
+func TestProxyRewritesPathAndQuery(t *testing.T) {
+	var gotURL string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotURL = r.URL.RequestURI()
+	}))
+	defer backend.Close()
+
+	p, _, _ := newRuleTestProxy(t, "app.test", strings.TrimPrefix(backend.URL, "http://"), storage.Rule{
+		Rewrites: []storage.PathRewrite{
+			{Pattern: `^/old/(\d+)$`, Replacement: "/new/$1", Redirect: 301},
+			{Pattern: `^/api/v1/(.*)$`, Replacement: "/v2/$1?compat=1"},
+		},
+		Query: []storage.QueryOp{
+			{Action: "delete", Name: "utm_source"},
+			{Action: "set", Name: "lang", Value: "en"},
+		},
+	})
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://app.test/api/v1/users/7?utm_source=x&page=2", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	if gotURL != "/v2/users/7?compat=1&lang=en&page=2" {
+		t.Fatalf("upstream URL = %q", gotURL)
+	}
+
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://app.test/old/42?ref=a", nil))
+	if rec.Code != http.StatusMovedPermanently {
+		t.Fatalf("status = %d, want 301", rec.Code)
+	}
+	if got := rec.Header().Get("Location"); got != "/new/42?ref=a" {
+		t.Fatalf("Location = %q", got)
+	}
+}
+
+func TestProxyRedirectRewriteKeepsPathEscaped(t *testing.T) {
+	p, _, _ := newRuleTestProxy(t, "app.test", "127.0.0.1:1", storage.Rule{
+		Rewrites: []storage.PathRewrite{
+			{Pattern: `^/old/(.*)$`, Replacement: "/$1", Redirect: 302},
+		},
+	})
+
+	for target, want := range map[string]string{
+		"http://app.test/old/docs":            "/docs",
+		"http://app.test/old/%2Fevil.com":     "/%2Fevil.com",
+		"http://app.test/old//evil.com":       "/evil.com",
+		"http://app.test/old/%5Cevil.com":     "/%5Cevil.com",
+		"http://app.test/old/a%3Fadmin=1?x=1": "/a%3Fadmin=1?x=1",
+		"http://app.test/old/a%20b?page=2":    "/a%20b?page=2",
+	} {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		if rec.Code != http.StatusFound {
+			t.Fatalf("%s: status = %d", target, rec.Code)
+		}
+		if got := rec.Header().Get("Location"); got != want {
+			t.Fatalf("%s: Location = %q, want %q", target, got, want)
+		}
+	}
+
+	if got := safeLocation(`/\evil.com`); got != "/evil.com" {
+		t.Fatalf(`safeLocation("/\evil.com") = %q`, got)
+	}
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"router/internal/storage"
+	"strconv"
+	"strings"
+)
+
+const defaultHTMLCacheControl = "no-cache"
+
+// precompressed lists the encodings looked up next to a file, best first.
+var precompressed = []struct {
+	encoding string
+	suffix   string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// serveStatic serves a file from the rule's static root. Dotfiles are never
+// served, directories are listed only when enabled, and unknown page routes
+// fall back to index.html for single page applications.
+func serveStatic(w http.ResponseWriter, r *http.Request, policy *storage.StaticPolicy) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+	if hasDotSegment(name) {
+		http.NotFound(w, r)
+		return
+	}
+	file := filepath.Join(policy.Root, filepath.FromSlash(name))
+
+	info, err := os.Stat(file)
+	if err == nil && info.IsDir() {
+		index := filepath.Join(file, "index.html")
+		if indexInfo, err := os.Stat(index); err == nil && !indexInfo.IsDir() {
+			serveStaticFile(w, r, index, indexInfo, policy)
+			return
+		}
+		if policy.Listing {
+			if !strings.HasSuffix(r.URL.Path, "/") {
+				http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+				return
+			}
+			http.FileServer(http.Dir(policy.Root)).ServeHTTP(w, r)
+			return
+		}
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		if policy.SPA && isPageRoute(r, name) {
+			index := filepath.Join(policy.Root, "index.html")
+			if indexInfo, err := os.Stat(index); err == nil && !indexInfo.IsDir() {
+				serveStaticFile(w, r, index, indexInfo, policy)
+				return
+			}
+		}
+		http.NotFound(w, r)
+		return
+	}
+	serveStaticFile(w, r, file, info, policy)
+}
+
+func serveStaticFile(w http.ResponseWriter, r *http.Request, file string, info os.FileInfo, policy *storage.StaticPolicy) {
+	ext := filepath.Ext(file)
+	h := w.Header()
+	contentType := mime.TypeByExtension(ext)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	h.Set("Content-Type", contentType)
+	if ext == ".html" {
+		cacheControl := policy.HTMLCacheControl
+		if cacheControl == "" {
+			cacheControl = defaultHTMLCacheControl
+		}
+		h.Set("Cache-Control", cacheControl)
+	} else if policy.CacheControl != "" {
+		h.Set("Cache-Control", policy.CacheControl)
+	}
+
+	servePath, serveInfo, encoding := file, info, ""
+	for _, variant := range precompressed {
+		if !acceptsEncoding(r.Header.Get("Accept-Encoding"), variant.encoding) {
+			continue
+		}
+		if variantInfo, err := os.Stat(file + variant.suffix); err == nil && !variantInfo.IsDir() {
+			servePath, serveInfo, encoding = file+variant.suffix, variantInfo, variant.encoding
+			break
+		}
+	}
+	if hasPrecompressedVariant(file) {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	if encoding != "" {
+		h.Set("Content-Encoding", encoding)
+	}
+	h.Set("ETag", staticETag(serveInfo, encoding))
+
+	f, err := os.Open(servePath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+func hasPrecompressedVariant(file string) bool {
+	for _, variant := range precompressed {
+		if _, err := os.Stat(file + variant.suffix); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// staticETag derives a strong validator from size and modification time; each
+// encoding gets its own tag because the bytes differ.
+func staticETag(info os.FileInfo, encoding string) string {
+	tag := fmt.Sprintf("%x-%x", info.ModTime().UnixNano(), info.Size())
+	if encoding != "" {
+		tag += "-" + encoding
+	}
+	return `"` + tag + `"`
+}
+
+// isPageRoute reports whether a missing path looks like a client-side route
+// rather than a missing asset, so that /app.js 404s instead of returning HTML.
+func isPageRoute(r *http.Request, name string) bool {
+	if path.Ext(name) == "" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func hasDotSegment(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") && segment != ".well-known" {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows encoding
+// with a non-zero quality. An explicit entry wins over the "*" wildcard.
+func acceptsEncoding(header, encoding string) bool {
+	wildcard := false
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.TrimSpace(name)
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.EqualFold(strings.TrimSpace(key), "q") {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if strings.EqualFold(name, encoding) {
+			return q > 0
+		}
+		if name == "*" {
+			wildcard = q > 0
+		}
+	}
+	return wildcard
+}
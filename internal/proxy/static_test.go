@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"router/internal/storage"
+	"testing"
+)
+
+func writeStaticTree(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	files := map[string]string{
+		"index.html":       "<!doctype html><title>app</title>",
+		"assets/app.js":    "console.log('app')",
+		"assets/app.js.br": "brotli-bytes",
+		"assets/style.css": "body{}",
+		".env":             "SECRET=1",
+		"docs/readme.txt":  "docs",
+	}
+	for name, body := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestServeStatic(t *testing.T) {
+	root := writeStaticTree(t)
+	policy := &storage.StaticPolicy{Root: root, SPA: true, CacheControl: "public, max-age=31536000, immutable"}
+
+	get := func(path string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		serveStatic(rec, req, policy)
+		return rec
+	}
+
+	rec := get("/assets/style.css", nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/css; charset=utf-8" {
+		t.Fatalf("css: %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if rec.Header().Get("Cache-Control") != policy.CacheControl || rec.Header().Get("Last-Modified") == "" {
+		t.Fatalf("css headers: %v", rec.Header())
+	}
+
+	etag := rec.Header().Get("ETag")
+	if rec = get("/assets/style.css", map[string]string{"If-None-Match": etag}); rec.Code != http.StatusNotModified {
+		t.Fatalf("conditional request: %d", rec.Code)
+	}
+
+	rec = get("/assets/app.js", map[string]string{"Accept-Encoding": "gzip, br"})
+	if rec.Header().Get("Content-Encoding") != "br" || rec.Body.String() != "brotli-bytes" {
+		t.Fatalf("precompressed: %q %q", rec.Header().Get("Content-Encoding"), rec.Body.String())
+	}
+	if rec.Header().Get("Vary") != "Accept-Encoding" || rec.Header().Get("Content-Type") != "text/javascript; charset=utf-8" {
+		t.Fatalf("precompressed headers: %v", rec.Header())
+	}
+	if rec = get("/assets/app.js", nil); rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != "console.log('app')" {
+		t.Fatalf("identity: %q", rec.Body.String())
+	}
+
+	rec = get("/dashboard/settings", map[string]string{"Accept": "text/html"})
+	if rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != defaultHTMLCacheControl {
+		t.Fatalf("spa fallback: %d %v", rec.Code, rec.Header())
+	}
+	if rec = get("/assets/missing.js", nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("missing asset: %d", rec.Code)
+	}
+	if rec = get("/.env", nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("dotfile: %d", rec.Code)
+	}
+	if rec = get("/../../etc/passwd", nil); rec.Code == http.StatusOK && rec.Body.String() != "<!doctype html><title>app</title>" {
+		t.Fatalf("path traversal served %q", rec.Body.String())
+	}
+
+	policy.SPA = false
+	if rec = get("/docs/", nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("listing should be off by default: %d", rec.Code)
+	}
+	policy.Listing = true
+	if rec = get("/docs/", nil); rec.Code != http.StatusOK {
+		t.Fatalf("listing: %d", rec.Code)
+	}
+}
+
+func TestProxyServesStaticRule(t *testing.T) {
+	root := writeStaticTree(t)
+	p, _, st := newRuleTestProxy(t, "static.test", "", storage.Rule{
+		Static:          &storage.StaticPolicy{Root: root},
+		SecurityHeaders: true,
+	})
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://static.test/", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Frame-Options") == "" {
+		t.Fatalf("static rule: %d %v", rec.Code, rec.Header())
+	}
+	if datasets := st.GetRequestData()["datasets"].([]map[string]interface{}); len(datasets) != 1 || datasets[0]["label"] != "static.test" {
+		t.Fatalf("static request not counted in stats")
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	cases := map[string]bool{
+		"gzip, br":     true,
+		"br;q=0, gzip": false,
+		"*":            true,
+		"*, br;q=0":    false,
+		"gzip;q=0.5":   false,
+		"":             false,
+	}
+	for header, want := range cases {
+		if got := acceptsEncoding(header, "br"); got != want {
+			t.Fatalf("acceptsEncoding(%q, br) = %v, want %v", header, got, want)
+		}
+	}
+}
@@ -0,0 +1,451 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"router/internal/clientip"
+	"router/internal/clog"
+	"router/internal/proxyproto"
+	"router/internal/stats"
+	"router/internal/storage"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	streamDialTimeout    = 10 * time.Second
+	streamHealthInterval = 1 * time.Minute
+	udpSessionIdle       = 2 * time.Minute
+	udpBufferSize        = 64 * 1024
+	defaultUDPSessions   = 1024
+	// udpEvictIdle is how long a session must be silent before a new
+	// client may take its place on a full listener.
+	udpEvictIdle = 10 * time.Second
+)
+
+// StreamManager runs TCP and UDP listeners for stream rules.
+type StreamManager struct {
+	store      *storage.StreamStore
+	stats      *stats.Stats
+	reputation *storage.IPReputationStore
+
+	// ProxyProtocolTrusted lists load balancer networks allowed to send
+	// inbound PROXY protocol headers on TCP stream listeners.
+	ProxyProtocolTrusted []netip.Prefix
+	// MaxUDPSessions caps the UDP sessions of one listener; each holds an
+	// upstream socket and a goroutine, and UDP sources are trivially
+	// spoofed. 0 disables the cap.
+	MaxUDPSessions int
+
+	mu      sync.Mutex
+	running map[string]*streamListener
+}
+
+// NewStreamManager creates a manager; call Sync to start listeners.
+func NewStreamManager(store *storage.StreamStore, stats *stats.Stats, reputation *storage.IPReputationStore) *StreamManager {
+	return &StreamManager{
+		store:          store,
+		stats:          stats,
+		reputation:     reputation,
+		running:        make(map[string]*streamListener),
+		MaxUDPSessions: envCount("STREAM_UDP_MAX_SESSIONS", defaultUDPSessions),
+	}
+}
+
+// Start launches listeners for all enabled stream rules and the health check loop.
+func (m *StreamManager) Start() {
+	m.Sync()
+	go func() {
+		for {
+			m.checkHealth()
+			time.Sleep(streamHealthInterval)
+		}
+	}()
+}
+
+// Sync reconciles running listeners with the stream rules in the store.
+func (m *StreamManager) Sync() {
+	desired := make(map[string]storage.StreamRule)
+	for _, rule := range m.store.List() {
+		if rule.Enabled {
+			desired[rule.ID] = rule
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, l := range m.running {
+		if rule, ok := desired[id]; ok && rule == l.rule {
+			continue
+		}
+		l.stop()
+		delete(m.running, id)
+		if m.stats != nil {
+			m.stats.RemoveStream(l.rule.Name)
+		}
+	}
+	for id, rule := range desired {
+		if _, ok := m.running[id]; ok {
+			continue
+		}
+		l, err := m.listen(rule)
+		if err != nil {
+			clog.Errorf("[stream] %s %s -> %s: listen failed: %v", rule.Protocol, rule.Listen, rule.Target, err)
+			continue
+		}
+		m.running[id] = l
+		clog.Infof("[stream] %s listening on %s -> %s (%s)", rule.Protocol, rule.Listen, rule.Target, rule.Name)
+	}
+}
+
+func (m *StreamManager) listen(rule storage.StreamRule) (*streamListener, error) {
+	l := &streamListener{rule: rule, manager: m, conns: make(map[net.Conn]struct{})}
+	if rule.Protocol == "udp" {
+		pc, err := net.ListenPacket("udp", rule.Listen)
+		if err != nil {
+			return nil, err
+		}
+		l.packet = pc
+		l.sessions = make(map[string]*udpSession)
+		go l.serveUDP()
+		return l, nil
+	}
+	ln, err := net.Listen("tcp", rule.Listen)
+	if err != nil {
+		return nil, err
+	}
+	l.listener = proxyproto.NewListener(ln, m.ProxyProtocolTrusted)
+	go l.serveTCP()
+	return l, nil
+}
+
+func (m *StreamManager) checkHealth() {
+	for _, rule := range m.store.List() {
+		if !rule.Enabled {
+			continue
+		}
+		healthy := probeStreamTarget(rule.Protocol, rule.Target)
+		if !healthy {
+			clog.Warnf("[stream] health check failed: %s %s -> %s", rule.Protocol, rule.Listen, rule.Target)
+		}
+		if m.stats != nil {
+			m.stats.SetStreamHealth(rule.Name, rule.Protocol, rule.Target, healthy)
+		}
+	}
+}
+
+// probeStreamTarget dials TCP targets. UDP has no handshake, so an empty
+// datagram is sent and only an ICMP "port unreachable" counts as down.
+func probeStreamTarget(protocol, target string) bool {
+	conn, err := net.DialTimeout(protocol, target, 5*time.Second)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	if protocol != "udp" {
+		return true
+	}
+	if _, err := conn.Write([]byte{}); err != nil {
+		return false
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1)
+	_, err = conn.Read(buf)
+	return !errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// allowed reports whether a client may use the stream and records blocked attempts.
+func (m *StreamManager) allowed(rule storage.StreamRule, remoteIP string) bool {
+	if m.reputation == nil || !m.reputation.IsBanned(remoteIP) {
+		return true
+	}
+	clog.Warnf("[blocked-ip] stream %s %s remote=%s", rule.Protocol, rule.Listen, remoteIP)
+	if m.stats != nil {
+		m.stats.StreamBlocked(rule.Name)
+	}
+	return false
+}
+
+type streamListener struct {
+	rule    storage.StreamRule
+	manager *StreamManager
+
+	listener net.Listener
+	packet   net.PacketConn
+
+	mu       sync.Mutex
+	closed   bool
+	conns    map[net.Conn]struct{}
+	sessions map[string]*udpSession
+}
+
+func (l *streamListener) stop() {
+	l.mu.Lock()
+	l.closed = true
+	conns := make([]net.Conn, 0, len(l.conns))
+	for conn := range l.conns {
+		conns = append(conns, conn)
+	}
+	sessions := make([]*udpSession, 0, len(l.sessions))
+	for _, session := range l.sessions {
+		sessions = append(sessions, session)
+	}
+	l.mu.Unlock()
+
+	if l.listener != nil {
+		l.listener.Close()
+	}
+	if l.packet != nil {
+		l.packet.Close()
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	for _, session := range sessions {
+		session.upstream.Close()
+	}
+}
+
+func (l *streamListener) track(conn net.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return false
+	}
+	l.conns[conn] = struct{}{}
+	return true
+}
+
+func (l *streamListener) untrack(conn net.Conn) {
+	l.mu.Lock()
+	delete(l.conns, conn)
+	l.mu.Unlock()
+}
+
+func (l *streamListener) serveTCP() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			clog.Warnf("[stream] accept on %s failed: %v", l.rule.Listen, err)
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		go l.handleTCP(conn)
+	}
+}
+
+func (l *streamListener) handleTCP(client net.Conn) {
+	defer client.Close()
+	rule := l.rule
+	st := l.manager.stats
+
+	remoteIP := clientip.SocketIP(client.RemoteAddr().String())
+	if !l.manager.allowed(rule, remoteIP) {
+		return
+	}
+	if !l.track(client) {
+		return
+	}
+	defer l.untrack(client)
+
+	upstream, err := net.DialTimeout("tcp", rule.Target, streamDialTimeout)
+	if err != nil {
+		clog.Errorf("[stream] dial %s for %s failed: %v", rule.Target, rule.Name, err)
+		if st != nil {
+			st.StreamFailed(rule.Name)
+		}
+		return
+	}
+	defer upstream.Close()
+	if !l.track(upstream) {
+		return
+	}
+	defer l.untrack(upstream)
+	if version := proxyproto.NormalizeVersion(rule.ProxyProtocol); version != "" {
+		if err := proxyproto.WriteHeader(upstream, version, client.RemoteAddr(), client.LocalAddr()); err != nil {
+			clog.Errorf("[stream] PROXY header to %s failed: %v", rule.Target, err)
+			if st != nil {
+				st.StreamFailed(rule.Name)
+			}
+			return
+		}
+	}
+
+	if st != nil {
+		st.StreamOpened(rule.Name)
+	}
+	clog.Debugf("[stream-forward] tcp %s remote=%s -> %s", rule.Listen, remoteIP, rule.Target)
+	in := &countingConn{Conn: client}
+	out := &countingConn{Conn: upstream}
+	pipe(in, out)
+	if st != nil {
+		st.StreamClosed(rule.Name, in.read.Load(), out.read.Load())
+	}
+}
+
+// countingConn counts bytes read from the wrapped connection.
+type countingConn struct {
+	net.Conn
+	read atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+type udpSession struct {
+	client     net.Addr
+	upstream   net.Conn
+	lastActive atomic.Int64
+	bytesIn    atomic.Int64
+	bytesOut   atomic.Int64
+}
+
+func (l *streamListener) serveUDP() {
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, addr, err := l.packet.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			clog.Warnf("[stream] udp read on %s failed: %v", l.rule.Listen, err)
+			continue
+		}
+		session := l.udpSession(addr)
+		if session == nil {
+			continue
+		}
+		session.lastActive.Store(time.Now().UnixNano())
+		session.bytesIn.Add(int64(n))
+		if _, err := session.upstream.Write(buf[:n]); err != nil {
+			clog.Debugf("[stream] udp write to %s failed: %v", l.rule.Target, err)
+		}
+	}
+}
+
+// udpSession returns the upstream session for a client address, creating it on first packet.
+func (l *streamListener) udpSession(addr net.Addr) *udpSession {
+	key := addr.String()
+	l.mu.Lock()
+	session, ok := l.sessions[key]
+	closed := l.closed
+	l.mu.Unlock()
+	if ok {
+		return session
+	}
+	if closed {
+		return nil
+	}
+
+	rule := l.rule
+	st := l.manager.stats
+	if !l.manager.allowed(rule, clientip.SocketIP(key)) {
+		return nil
+	}
+	if !l.udpRoom() {
+		clog.Debugf("[stream] udp %s: session limit reached, dropping packet from %s", rule.Listen, key)
+		return nil
+	}
+	upstream, err := net.DialTimeout("udp", rule.Target, streamDialTimeout)
+	if err != nil {
+		clog.Errorf("[stream] udp dial %s for %s failed: %v", rule.Target, rule.Name, err)
+		if st != nil {
+			st.StreamFailed(rule.Name)
+		}
+		return nil
+	}
+	session = &udpSession{client: addr, upstream: upstream}
+	session.lastActive.Store(time.Now().UnixNano())
+
+	l.mu.Lock()
+	l.sessions[key] = session
+	l.mu.Unlock()
+	if st != nil {
+		st.StreamOpened(rule.Name)
+	}
+	go l.relayUDP(key, session)
+	return session
+}
+
+// udpRoom makes room for a new UDP session. At the cap it evicts the least
+// recently active session when that one has been idle for udpEvictIdle and
+// refuses otherwise, so a flood of spoofed sources neither exhausts file
+// descriptors nor pushes out clients that are still talking.
+func (l *streamListener) udpRoom() bool {
+	limit := l.manager.MaxUDPSessions
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limit <= 0 || len(l.sessions) < limit {
+		return true
+	}
+	var oldestKey string
+	var oldest *udpSession
+	for key, session := range l.sessions {
+		if oldest == nil || session.lastActive.Load() < oldest.lastActive.Load() {
+			oldestKey, oldest = key, session
+		}
+	}
+	if time.Since(time.Unix(0, oldest.lastActive.Load())) < udpEvictIdle {
+		return false
+	}
+	delete(l.sessions, oldestKey)
+	oldest.upstream.Close() // ends its relayUDP
+	return true
+}
+
+// relayUDP copies upstream replies back to the client until the session goes idle.
+func (l *streamListener) relayUDP(key string, session *udpSession) {
+	defer func() {
+		session.upstream.Close()
+		l.mu.Lock()
+		if l.sessions[key] == session { // an evicted session may have been replaced
+			delete(l.sessions, key)
+		}
+		l.mu.Unlock()
+		if st := l.manager.stats; st != nil {
+			st.StreamClosed(l.rule.Name, session.bytesIn.Load(), session.bytesOut.Load())
+		}
+	}()
+
+	buf := make([]byte, udpBufferSize)
+	for {
+		_ = session.upstream.SetReadDeadline(time.Now().Add(udpSessionIdle))
+		n, err := session.upstream.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				idle := time.Since(time.Unix(0, session.lastActive.Load()))
+				if idle < udpSessionIdle {
+					continue
+				}
+			}
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && !(errors.As(err, &netErr) && netErr.Timeout()) {
+				clog.Debugf("[stream] udp relay from %s ended: %v", l.rule.Target, err)
+			}
+			return
+		}
+		session.lastActive.Store(time.Now().UnixNano())
+		session.bytesOut.Add(int64(n))
+		if _, err := l.packet.WriteTo(buf[:n], session.client); err != nil {
+			return
+		}
+	}
+}
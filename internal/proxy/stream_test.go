@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"router/internal/stats"
+	"router/internal/storage"
+	"testing"
+	"time"
+)
+
+func freeAddr(t *testing.T, network string) string {
+	t.Helper()
+	if network == "udp" {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		defer pc.Close()
+		return pc.LocalAddr().String()
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestStreamManagerForwardsTCP(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen backend: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				line, _ := bufio.NewReader(c).ReadString('\n')
+				_, _ = c.Write([]byte("echo:" + line))
+			}(conn)
+		}
+	}()
+
+	dir := t.TempDir()
+	store := storage.NewStreamStore(filepath.Join(dir, "streams.json"))
+	listen := freeAddr(t, "tcp")
+	if _, err := store.Upsert(storage.StreamRule{Name: "echo", Protocol: "tcp", Listen: listen, Target: backend.Addr().String(), Enabled: true}); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	st := stats.New()
+	manager := NewStreamManager(store, st, storage.NewIPReputationStore(filepath.Join(dir, "ip.json")))
+	manager.Sync()
+
+	conn, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatalf("dial stream: %v", err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = conn.Write([]byte("hello\n"))
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	conn.Close()
+	if err != nil || reply != "echo:hello\n" {
+		t.Fatalf("unexpected reply %q err=%v", reply, err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		rows := st.GetStreamData()
+		if len(rows) == 1 && rows[0]["total"] == 1 && rows[0]["active"] == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected stream stats: %#v", rows)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStreamManagerBlocksBannedIPAndStops(t *testing.T) {
+	dir := t.TempDir()
+	store := storage.NewStreamStore(filepath.Join(dir, "streams.json"))
+	listen := freeAddr(t, "tcp")
+	rule, err := store.Upsert(storage.StreamRule{Name: "blocked", Protocol: "tcp", Listen: listen, Target: "127.0.0.1:1", Enabled: true})
+	if err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	reputation := storage.NewIPReputationStore(filepath.Join(dir, "ip.json"))
+	reputation.Ban("127.0.0.1")
+	st := stats.New()
+	manager := NewStreamManager(store, st, reputation)
+	manager.Sync()
+
+	conn, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatalf("dial stream: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected banned connection to be closed")
+	}
+	conn.Close()
+	if rows := st.GetStreamData(); len(rows) != 1 || rows[0]["blocked"] != 1 {
+		t.Fatalf("expected one blocked connection, got %#v", rows)
+	}
+
+	store.Delete(rule.ID)
+	manager.Sync()
+	if _, err := net.DialTimeout("tcp", listen, time.Second); err == nil {
+		t.Fatalf("expected listener to be stopped after rule removal")
+	}
+}
+
+func TestStreamManagerForwardsUDP(t *testing.T) {
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen backend: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := backend.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = backend.WriteTo(append([]byte("echo:"), buf[:n]...), addr)
+		}
+	}()
+
+	dir := t.TempDir()
+	store := storage.NewStreamStore(filepath.Join(dir, "streams.json"))
+	listen := freeAddr(t, "udp")
+	if _, err := store.Upsert(storage.StreamRule{Name: "dns", Protocol: "udp", Listen: listen, Target: backend.LocalAddr().String(), Enabled: true}); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	manager := NewStreamManager(store, stats.New(), nil)
+	manager.Sync()
+
+	conn, err := net.Dial("udp", listen)
+	if err != nil {
+		t.Fatalf("dial stream: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = conn.Write([]byte("ping"))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "echo:ping" {
+		t.Fatalf("unexpected udp reply %q err=%v", buf[:n], err)
+	}
+}
+
+func TestStreamManagerCapsUDPSessions(t *testing.T) {
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen backend: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := backend.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = backend.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	store := storage.NewStreamStore(filepath.Join(t.TempDir(), "streams.json"))
+	listen := freeAddr(t, "udp")
+	rule, err := store.Upsert(storage.StreamRule{Name: "dns", Protocol: "udp", Listen: listen, Target: backend.LocalAddr().String(), Enabled: true})
+	if err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	manager := NewStreamManager(store, stats.New(), nil)
+	manager.MaxUDPSessions = 2
+	manager.Sync()
+	defer func() {
+		store.Delete(rule.ID)
+		manager.Sync()
+	}()
+
+	exchange := func(conn net.Conn) bool {
+		_ = conn.SetDeadline(time.Now().Add(300 * time.Millisecond))
+		_, _ = conn.Write([]byte("ping"))
+		buf := make([]byte, 16)
+		n, err := conn.Read(buf)
+		return err == nil && string(buf[:n]) == "ping"
+	}
+	var clients []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("udp", listen)
+		if err != nil {
+			t.Fatalf("dial stream: %v", err)
+		}
+		defer conn.Close()
+		clients = append(clients, conn)
+	}
+	if !exchange(clients[0]) || !exchange(clients[1]) {
+		t.Fatalf("sessions under the cap must be served")
+	}
+	if exchange(clients[2]) {
+		t.Fatalf("a third source must not get a session while the others are active")
+	}
+
+	// Once a session has been idle long enough, a new source takes its place.
+	manager.mu.Lock()
+	l := manager.running[rule.ID]
+	manager.mu.Unlock()
+	l.mu.Lock()
+	l.sessions[clients[0].LocalAddr().String()].lastActive.Store(time.Now().Add(-time.Minute).UnixNano())
+	l.mu.Unlock()
+	if !exchange(clients[2]) {
+		t.Fatalf("expected the idle session to be evicted for the new source")
+	}
+	l.mu.Lock()
+	count := len(l.sessions)
+	l.mu.Unlock()
+	if count != 2 {
+		t.Fatalf("sessions = %d, want 2", count)
+	}
+}
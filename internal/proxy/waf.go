@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"router/internal/clog"
+	"router/internal/notify"
+	"router/internal/storage"
+	"strings"
+	"time"
+)
+
+const (
+	// wafBodyPrefix is how much of the request body body signatures see.
+	wafBodyPrefix = 4 << 10
+	// maxTarpitsInFlight bounds connections held by the tarpit action; once
+	// it is reached, tarpitted requests are refused at once.
+	maxTarpitsInFlight = 64
+)
+
+var (
+	// tarpitDelay is how long the tarpit action holds a request (WAF_TARPIT_SEC).
+	tarpitDelay = envTimeout("WAF_TARPIT_SEC", 10*time.Second)
+	tarpitSlots = make(chan struct{}, maxTarpitsInFlight)
+
+	defaultSignatures = storage.DefaultSignatures()
+)
+
+// wafHit is the outcome of inspecting a request.
+type wafHit struct {
+	signature storage.Signature // the hit with the strongest action
+	score     int               // sum of the scores of hits that act beyond logging
+}
+
+// inspectRequest runs the request signatures against r and applies the
+// strongest action among the hits. It returns true when the request was
+// answered.
+func (p *Proxy) inspectRequest(w http.ResponseWriter, r *http.Request, remoteIP string) bool {
+	signatures := defaultSignatures
+	if p.Signatures != nil {
+		signatures = p.Signatures.Active()
+	}
+	hit, ok := p.matchSignatures(r, signatures)
+	if !ok {
+		return false
+	}
+	sig := hit.signature
+	reason := "signature " + sig.ID
+	if sig.Name != "" {
+		reason += " (" + sig.Name + ")"
+	}
+	clog.Warnf("[waf] %s %s host=%s remote=%s action=%s score=%d %s", r.Method, r.URL.Path, r.Host, remoteIP, sig.Action, hit.score, reason)
+	if sig.Action == storage.ActionLog {
+		return false
+	}
+
+	if p.reputation != nil {
+		p.markSuspicious(remoteIP, reason, hit.score)
+	}
+	if p.notifier != nil {
+		p.notifier.NotifyWithBanButton("suspicious_probe", "probe:"+remoteIP+":"+r.URL.Path, notify.BuildProxyAlert(r.Method, r.URL.Path, r.Host, remoteIP, "suspicious request: "+reason), remoteIP)
+	}
+
+	switch sig.Action {
+	case storage.ActionTarpit:
+		tarpit(r.Context())
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return true
+	case storage.ActionBlock:
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return true
+	}
+	return false
+}
+
+// matchSignatures returns the strongest hit among signatures. Hits are
+// counted in stats.
+func (p *Proxy) matchSignatures(r *http.Request, signatures []storage.Signature) (wafHit, bool) {
+	var (
+		hit      wafHit
+		matched  bool
+		body     []byte
+		bodyRead bool
+	)
+	path := r.URL.Path
+	query := r.URL.RawQuery
+	decodedQuery, err := url.QueryUnescape(query)
+	if err != nil {
+		decodedQuery = query
+	}
+
+	for _, sig := range signatures {
+		var values []string
+		switch sig.Target {
+		case storage.SignaturePath:
+			values = []string{path}
+		case storage.SignatureQuery:
+			values = []string{query, decodedQuery}
+		case storage.SignatureHeader:
+			values = r.Header.Values(sig.Header)
+		case storage.SignatureUserAgent:
+			values = []string{r.UserAgent()}
+		case storage.SignatureBody:
+			if !bodyRead {
+				body, bodyRead = peekBody(r), true
+			}
+			values = []string{string(body)}
+		}
+		if !signatureMatches(sig, values) {
+			continue
+		}
+		if p.stats != nil {
+			p.stats.WAFHit(sig.ID)
+		}
+		if sig.Action != storage.ActionLog {
+			hit.score += sig.Score
+		}
+		if !matched || storage.ActionRank(sig.Action) > storage.ActionRank(hit.signature.Action) {
+			hit.signature = sig
+		}
+		matched = true
+	}
+	return hit, matched
+}
+
+func signatureMatches(sig storage.Signature, values []string) bool {
+	var re *regexp.Regexp
+	switch sig.Match {
+	case storage.MatchRegex:
+		re = compilePattern("(?i)" + sig.Pattern)
+	case storage.MatchGlob:
+		re = compilePattern(globPattern(sig.Pattern))
+	}
+	pattern := strings.ToLower(sig.Pattern)
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		if re != nil {
+			if re.MatchString(value) {
+				return true
+			}
+		} else if sig.Match == storage.MatchSubstring && strings.Contains(strings.ToLower(value), pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// globPattern turns a glob into an anchored, case-insensitive regexp.
+func globPattern(glob string) string {
+	var b strings.Builder
+	b.WriteString("(?is)^")
+	for _, c := range glob {
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// peekBody returns up to wafBodyPrefix bytes of the request body and puts
+// them back in front of the rest of it.
+func peekBody(r *http.Request) []byte {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(r.Body, wafBodyPrefix))
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(buf), errOrBody(err, r.Body)), r.Body}
+	return buf
+}
+
+// tarpit holds the request for tarpitDelay, or returns at once when too many
+// requests are already held.
+func tarpit(ctx context.Context) {
+	select {
+	case tarpitSlots <- struct{}{}:
+	default:
+		return
+	}
+	defer func() { <-tarpitSlots }()
+	timer := time.NewTimer(tarpitDelay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
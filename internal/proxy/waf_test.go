@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"router/internal/storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInspectRequestAppliesSignatureActions(t *testing.T) {
+	var upstreamBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		upstreamBody = string(body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	p, _, st := newRuleTestProxy(t, "waf.test", strings.TrimPrefix(upstream.URL, "http://"), storage.Rule{})
+	p.reputation = storage.NewIPReputationStore(filepath.Join(t.TempDir(), "ip_reputation.json"))
+	p.Signatures = storage.NewSignatureStore(filepath.Join(t.TempDir(), "signatures.json"))
+	for _, sig := range []storage.Signature{
+		{Name: "admin api", Target: storage.SignaturePath, Match: storage.MatchGlob, Pattern: "/api/*/admin", Action: storage.ActionBlock, Enabled: true},
+		{Name: "debug header", Target: storage.SignatureHeader, Header: "X-Debug", Match: storage.MatchSubstring, Pattern: "on", Action: storage.ActionLog, Enabled: true},
+		{Name: "sql in body", Target: storage.SignatureBody, Match: storage.MatchRegex, Pattern: `union\s+select`, Action: storage.ActionBlock, Enabled: true},
+		{Name: "slow scanner", Target: storage.SignatureUserAgent, Match: storage.MatchSubstring, Pattern: "SlowBot", Action: storage.ActionTarpit, Enabled: true},
+	} {
+		if _, err := p.Signatures.Upsert(sig); err != nil {
+			t.Fatalf("upsert %q: %v", sig.Name, err)
+		}
+	}
+	defer func(delay time.Duration) { tarpitDelay = delay }(tarpitDelay)
+	tarpitDelay = 50 * time.Millisecond
+
+	serve := func(req *http.Request, remote string) int {
+		req.Host = "waf.test"
+		req.RemoteAddr = remote + ":40000"
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := serve(httptest.NewRequest(http.MethodGet, "/API/v2/Admin", nil), "10.0.0.1"); code != http.StatusForbidden {
+		t.Fatalf("glob block: expected 403, got %d", code)
+	}
+	if code := serve(httptest.NewRequest(http.MethodGet, "/api/v2/admin/users", nil), "10.0.0.2"); code != http.StatusOK {
+		t.Fatalf("glob is anchored: expected 200, got %d", code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Debug", "ON")
+	if code := serve(req, "10.0.0.3"); code != http.StatusOK {
+		t.Fatalf("log action must pass the request, got %d", code)
+	}
+
+	if code := serve(httptest.NewRequest(http.MethodPost, "/search", strings.NewReader("q=1 UNION  SELECT password")), "10.0.0.4"); code != http.StatusForbidden {
+		t.Fatalf("body block: expected 403, got %d", code)
+	}
+	if code := serve(httptest.NewRequest(http.MethodPost, "/search", strings.NewReader("q=hello")), "10.0.0.5"); code != http.StatusOK || upstreamBody != "q=hello" {
+		t.Fatalf("inspected body must reach upstream intact, got %d %q", code, upstreamBody)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("User-Agent", "slowbot/1.0")
+	start := time.Now()
+	if code := serve(req, "10.0.0.6"); code != http.StatusForbidden || time.Since(start) < tarpitDelay {
+		t.Fatalf("tarpit: expected delayed 403, got %d after %v", code, time.Since(start))
+	}
+
+	// Built-in packs still mark old-style probes without blocking them.
+	if code := serve(httptest.NewRequest(http.MethodGet, "/.env", nil), "10.0.0.7"); code != http.StatusOK {
+		t.Fatalf("built-in mark: expected 200, got %d", code)
+	}
+
+	marked := make(map[string]bool)
+	for _, entry := range p.reputation.List() {
+		marked[entry.IP] = true
+	}
+	for ip, want := range map[string]bool{"10.0.0.1": true, "10.0.0.2": false, "10.0.0.3": false, "10.0.0.4": true, "10.0.0.6": true, "10.0.0.7": true} {
+		if marked[ip] != want {
+			t.Fatalf("IP %s marked=%v, want %v", ip, marked[ip], want)
+		}
+	}
+
+	hits := make(map[string]int)
+	for _, row := range st.GetWAFData() {
+		hits[row["signature"].(string)] = row["hits"].(int)
+	}
+	if hits["secrets/dotenv"] != 1 {
+		t.Fatalf("expected a hit on the built-in .env signature, got %v", hits)
+	}
+}
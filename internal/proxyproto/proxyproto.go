@@ -0,0 +1,356 @@
+// Package proxyproto implements the HAProxy PROXY protocol (v1 and v2).
+//
+// Listener accepts headers only from trusted source networks (e.g. a cloud
+// TCP load balancer) and exposes the original client address through
+// RemoteAddr. Header builds the outbound header for upstreams that need the
+// real client address.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// V1 is the human-readable text header.
+	V1 = "v1"
+	// V2 is the binary header.
+	V2 = "v2"
+
+	v1MaxLength   = 107
+	headerTimeout = 5 * time.Second
+)
+
+var v2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// ErrInvalidHeader is returned for malformed PROXY protocol headers.
+var ErrInvalidHeader = errors.New("proxyproto: invalid header")
+
+// NormalizeVersion returns V1, V2 or "" (disabled) for a user supplied value.
+func NormalizeVersion(version string) string {
+	switch strings.ToLower(strings.TrimSpace(version)) {
+	case "v1", "1":
+		return V1
+	case "v2", "2":
+		return V2
+	default:
+		return ""
+	}
+}
+
+// ParseCIDRs parses a comma or whitespace separated list of CIDRs or single IPs.
+func ParseCIDRs(raw string) ([]netip.Prefix, error) {
+	fields := strings.FieldsFunc(raw, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\t'
+	})
+	out := make([]netip.Prefix, 0, len(fields))
+	for _, field := range fields {
+		if prefix, err := netip.ParsePrefix(field); err == nil {
+			out = append(out, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", field)
+		}
+		out = append(out, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return out, nil
+}
+
+// TrustedFromEnv reads trusted load balancer networks from PROXY_PROTOCOL_TRUSTED_CIDRS.
+// A malformed list is an error rather than an empty one, so a typo cannot
+// silently turn PROXY protocol off.
+func TrustedFromEnv() ([]netip.Prefix, error) {
+	prefixes, err := ParseCIDRs(os.Getenv("PROXY_PROTOCOL_TRUSTED_CIDRS"))
+	if err != nil {
+		return nil, fmt.Errorf("PROXY_PROTOCOL_TRUSTED_CIDRS: %w", err)
+	}
+	return prefixes, nil
+}
+
+// Listener wraps a net.Listener and reads PROXY protocol headers from trusted peers.
+type Listener struct {
+	net.Listener
+	Trusted []netip.Prefix
+}
+
+// NewListener wraps inner. With no trusted networks the listener is a no-op wrapper.
+func NewListener(inner net.Listener, trusted []netip.Prefix) net.Listener {
+	if len(trusted) == 0 {
+		return inner
+	}
+	return &Listener{Listener: inner, Trusted: trusted}
+}
+
+// Accept returns a connection that lazily parses the header on first use.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !isTrusted(conn.RemoteAddr(), l.Trusted) {
+		return conn, nil
+	}
+	return &Conn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+func isTrusted(addr net.Addr, trusted []netip.Prefix) bool {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := ap.Addr().Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection from a trusted peer that may start with a PROXY header.
+type Conn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once     sync.Once
+	source   net.Addr
+	dest     net.Addr
+	parseErr error
+}
+
+func (c *Conn) init() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(headerTimeout))
+		c.source, c.dest, c.parseErr = readHeader(c.reader)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+// Read reads application data after the header.
+func (c *Conn) Read(p []byte) (int, error) {
+	c.init()
+	if c.parseErr != nil {
+		return 0, c.parseErr
+	}
+	return c.reader.Read(p)
+}
+
+// RemoteAddr returns the client address announced in the header, if any.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.init()
+	if c.source != nil {
+		return c.source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address announced in the header, if any.
+func (c *Conn) LocalAddr() net.Addr {
+	c.init()
+	if c.dest != nil {
+		return c.dest
+	}
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite half-closes the underlying TCP connection when possible.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// readHeader consumes an optional v1 or v2 header. Connections without a
+// header are left untouched and report nil addresses.
+func readHeader(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	peek, err := r.Peek(1)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	switch peek[0] {
+	case 'P':
+		if prefix, err := r.Peek(6); err == nil && string(prefix) == "PROXY " {
+			return readV1(r)
+		}
+	case v2Signature[0]:
+		if prefix, err := r.Peek(len(v2Signature)); err == nil && bytes.Equal(prefix, v2Signature) {
+			return readV2(r)
+		}
+	}
+	return nil, nil, nil
+}
+
+func readV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	text := string(line)
+	if !strings.HasSuffix(text, "\r\n") {
+		return nil, nil, ErrInvalidHeader
+	}
+	fields := strings.Fields(strings.TrimSuffix(text, "\r\n"))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, ErrInvalidHeader
+	}
+	src, err := parseV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseV1Addr(ip, port string) (net.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, ErrInvalidHeader
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, ErrInvalidHeader
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
+
+func readV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, nil, err
+	}
+	if head[12]>>4 != 2 {
+		return nil, nil, ErrInvalidHeader
+	}
+	command := head[12] & 0x0F
+	family := head[13]
+	length := int(binary.BigEndian.Uint16(head[14:16]))
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	if command == 0x0 {
+		// LOCAL: health checks from the balancer itself.
+		return nil, nil, nil
+	}
+	if command != 0x1 {
+		return nil, nil, ErrInvalidHeader
+	}
+
+	var ipLen int
+	switch family >> 4 {
+	case 0x1:
+		ipLen = 4
+	case 0x2:
+		ipLen = 16
+	default:
+		// AF_UNSPEC / AF_UNIX: keep the socket addresses.
+		return nil, nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, ErrInvalidHeader
+	}
+	srcIP, _ := netip.AddrFromSlice(payload[:ipLen])
+	dstIP, _ := netip.AddrFromSlice(payload[ipLen : 2*ipLen])
+	srcPort := binary.BigEndian.Uint16(payload[2*ipLen:])
+	dstPort := binary.BigEndian.Uint16(payload[2*ipLen+2:])
+	src := net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP.Unmap(), srcPort))
+	dst := net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP.Unmap(), dstPort))
+	return src, dst, nil
+}
+
+// Header builds an outbound PROXY protocol header for a TCP connection from src to dst.
+func Header(version string, src, dst net.Addr) ([]byte, error) {
+	var srcAP, dstAP netip.AddrPort
+	known := false
+	if src != nil && dst != nil {
+		var srcErr, dstErr error
+		srcAP, srcErr = netip.ParseAddrPort(src.String())
+		dstAP, dstErr = netip.ParseAddrPort(dst.String())
+		known = srcErr == nil && dstErr == nil
+	}
+	if known {
+		srcAP = netip.AddrPortFrom(srcAP.Addr().Unmap(), srcAP.Port())
+		dstAP = netip.AddrPortFrom(dstAP.Addr().Unmap(), dstAP.Port())
+		if srcAP.Addr().Is4() != dstAP.Addr().Is4() {
+			// Mixed families cannot be expressed; map both to IPv6.
+			srcAP = netip.AddrPortFrom(netip.AddrFrom16(srcAP.Addr().As16()), srcAP.Port())
+			dstAP = netip.AddrPortFrom(netip.AddrFrom16(dstAP.Addr().As16()), dstAP.Port())
+		}
+	}
+
+	switch NormalizeVersion(version) {
+	case V1:
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		proto := "TCP4"
+		if !srcAP.Addr().Is4() {
+			proto = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, srcAP.Addr(), dstAP.Addr(), srcAP.Port(), dstAP.Port())), nil
+	case V2:
+		buf := bytes.NewBuffer(append([]byte{}, v2Signature...))
+		if !known {
+			buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+			return buf.Bytes(), nil
+		}
+		var payload []byte
+		family := byte(0x11)
+		if srcAP.Addr().Is4() {
+			s, d := srcAP.Addr().As4(), dstAP.Addr().As4()
+			payload = append(append(payload, s[:]...), d[:]...)
+		} else {
+			family = 0x21
+			s, d := srcAP.Addr().As16(), dstAP.Addr().As16()
+			payload = append(append(payload, s[:]...), d[:]...)
+		}
+		payload = binary.BigEndian.AppendUint16(payload, srcAP.Port())
+		payload = binary.BigEndian.AppendUint16(payload, dstAP.Port())
+		buf.Write([]byte{0x21, family})
+		_ = binary.Write(buf, binary.BigEndian, uint16(len(payload)))
+		buf.Write(payload)
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("proxyproto: unsupported version %q", version)
+	}
+}
+
+// WriteHeader writes a header for src -> dst to w.
+func WriteHeader(w io.Writer, version string, src, dst net.Addr) error {
+	header, err := Header(version, src, dst)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(header)
+	return err
+}
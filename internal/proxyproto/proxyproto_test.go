@@ -0,0 +1,116 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func tcpAddr(s string) net.Addr {
+	return net.TCPAddrFromAddrPort(netip.MustParseAddrPort(s))
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		version string
+		src     string
+		dst     string
+	}{
+		{V1, "198.51.100.7:51234", "10.0.0.1:443"},
+		{V1, "[2001:db8::1]:40000", "[2001:db8::2]:443"},
+		{V2, "198.51.100.7:51234", "10.0.0.1:443"},
+		{V2, "[2001:db8::1]:40000", "[2001:db8::2]:443"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version+" "+tt.src, func(t *testing.T) {
+			header, err := Header(tt.version, tcpAddr(tt.src), tcpAddr(tt.dst))
+			if err != nil {
+				t.Fatalf("Header() error: %v", err)
+			}
+			r := bufio.NewReader(io.MultiReader(bytes.NewReader(header), bytes.NewReader([]byte("GET / HTTP/1.1\r\n"))))
+			src, dst, err := readHeader(r)
+			if err != nil {
+				t.Fatalf("readHeader() error: %v", err)
+			}
+			if src.String() != tt.src || dst.String() != tt.dst {
+				t.Fatalf("got src=%s dst=%s, want %s %s", src, dst, tt.src, tt.dst)
+			}
+			rest, _ := io.ReadAll(r)
+			if string(rest) != "GET / HTTP/1.1\r\n" {
+				t.Fatalf("payload after header was consumed: %q", rest)
+			}
+		})
+	}
+}
+
+func TestReadHeaderWithoutProxyPrefix(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader([]byte("POST /login HTTP/1.1\r\n")))
+	src, dst, err := readHeader(r)
+	if err != nil || src != nil || dst != nil {
+		t.Fatalf("expected no header, got src=%v dst=%v err=%v", src, dst, err)
+	}
+	if line, _ := r.ReadString('\n'); line != "POST /login HTTP/1.1\r\n" {
+		t.Fatalf("request line was consumed: %q", line)
+	}
+}
+
+func TestReadHeaderRejectsMalformedV1(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader([]byte("PROXY TCP4 not-an-ip 10.0.0.1 1 2\r\n")))
+	if _, _, err := readHeader(r); err == nil {
+		t.Fatalf("expected malformed header error")
+	}
+}
+
+func TestListenerTrustsOnlyConfiguredNetworks(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer inner.Close()
+
+	run := func(trusted []netip.Prefix) (string, string) {
+		ln := NewListener(inner, trusted)
+		go func() {
+			conn, err := net.Dial("tcp", inner.Addr().String())
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			_ = WriteHeader(conn, V1, tcpAddr("203.0.113.9:1234"), tcpAddr("10.0.0.1:443"))
+			_, _ = conn.Write([]byte("hello\n"))
+		}()
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("accept: %v", err)
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		return conn.RemoteAddr().String(), line
+	}
+
+	trusted, _ := ParseCIDRs("127.0.0.0/8, 10.0.0.5")
+	remote, line := run(trusted)
+	if remote != "203.0.113.9:1234" || line != "hello\n" {
+		t.Fatalf("trusted peer: remote=%s line=%q", remote, line)
+	}
+
+	untrusted, _ := ParseCIDRs("192.0.2.0/24")
+	remote, line = run(untrusted)
+	if remote == "203.0.113.9:1234" || line == "hello\n" {
+		t.Fatalf("untrusted peer must not be able to set the client address: remote=%s line=%q", remote, line)
+	}
+}
+
+func TestTrustedFromEnvRejectsMalformedList(t *testing.T) {
+	t.Setenv("PROXY_PROTOCOL_TRUSTED_CIDRS", "10.0.0.0/8, not-a-cidr")
+	if trusted, err := TrustedFromEnv(); err == nil {
+		t.Fatalf("malformed list accepted: %v", trusted)
+	}
+	t.Setenv("PROXY_PROTOCOL_TRUSTED_CIDRS", "10.0.0.0/8")
+	if trusted, err := TrustedFromEnv(); err != nil || len(trusted) != 1 {
+		t.Fatalf("trusted = %v, %v", trusted, err)
+	}
+}
@@ -0,0 +1,57 @@
+package stats
+
+import "sort"
+
+type cacheCounters struct {
+	Hits   int
+	Stale  int
+	Misses int
+}
+
+// CacheResult records a cache lookup for host. result is "hit", "stale" or "miss".
+func (s *Stats) CacheResult(host, result string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counters, ok := s.cache[host]
+	if !ok {
+		counters = &cacheCounters{}
+		s.cache[host] = counters
+	}
+	switch result {
+	case "hit":
+		counters.Hits++
+	case "stale":
+		counters.Stale++
+	default:
+		counters.Misses++
+	}
+}
+
+// GetCacheData returns hit/miss counters and the hit ratio (stale counts as a hit) per host.
+func (s *Stats) GetCacheData() []map[string]interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	hosts := make([]string, 0, len(s.cache))
+	for host := range s.cache {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	rows := make([]map[string]interface{}, 0, len(hosts))
+	for _, host := range hosts {
+		c := s.cache[host]
+		ratio := 0.0
+		if total := c.Hits + c.Stale + c.Misses; total > 0 {
+			ratio = float64(c.Hits+c.Stale) / float64(total)
+		}
+		rows = append(rows, map[string]interface{}{
+			"host":     host,
+			"hits":     c.Hits,
+			"stale":    c.Stale,
+			"misses":   c.Misses,
+			"hitRatio": ratio,
+		})
+	}
+	return rows
+}
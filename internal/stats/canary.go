@@ -0,0 +1,40 @@
+package stats
+
+import "sort"
+
+// CanaryRequest counts a request routed to a canary variant of host.
+func (s *Stats) CanaryRequest(host, variant string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counters, ok := s.canary[host]
+	if !ok {
+		counters = make(map[string]int)
+		s.canary[host] = counters
+	}
+	counters[variant]++
+}
+
+// GetCanaryData returns requests per canary variant for every host.
+func (s *Stats) GetCanaryData() []map[string]interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	hosts := make([]string, 0, len(s.canary))
+	for host := range s.canary {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	rows := make([]map[string]interface{}, 0, len(hosts))
+	for _, host := range hosts {
+		variants := make(map[string]int, len(s.canary[host]))
+		for name, count := range s.canary[host] {
+			variants[name] = count
+		}
+		rows = append(rows, map[string]interface{}{
+			"host":     host,
+			"variants": variants,
+		})
+	}
+	return rows
+}
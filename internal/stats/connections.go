@@ -0,0 +1,90 @@
+package stats
+
+import "sort"
+
+type liveConnCounters struct {
+	WebSocket int
+	Streaming int
+	Total     int
+	Rejected  int
+	TimedOut  int
+	Drained   int
+}
+
+func (s *Stats) liveConnLocked(host string) *liveConnCounters {
+	counters, ok := s.liveConns[host]
+	if !ok {
+		counters = &liveConnCounters{}
+		s.liveConns[host] = counters
+	}
+	return counters
+}
+
+// LiveConnOpened records a new upgraded ("websocket") or streaming connection for host.
+func (s *Stats) LiveConnOpened(host, kind string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counters := s.liveConnLocked(host)
+	counters.Total++
+	if kind == "websocket" {
+		counters.WebSocket++
+	} else {
+		counters.Streaming++
+	}
+}
+
+// LiveConnClosed records the end of a long-lived connection. reason is
+// "idle", "lifetime", "drain" or empty for a normal close.
+func (s *Stats) LiveConnClosed(host, kind, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counters := s.liveConnLocked(host)
+	if kind == "websocket" {
+		if counters.WebSocket > 0 {
+			counters.WebSocket--
+		}
+	} else if counters.Streaming > 0 {
+		counters.Streaming--
+	}
+	switch reason {
+	case "idle", "lifetime":
+		counters.TimedOut++
+	case "drain":
+		counters.Drained++
+	}
+}
+
+// LiveConnRejected counts a connection refused by the per-rule connection cap.
+func (s *Stats) LiveConnRejected(host string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.liveConnLocked(host).Rejected++
+}
+
+// GetLiveConnData returns active long-lived connections per host.
+func (s *Stats) GetLiveConnData() []map[string]interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	hosts := make([]string, 0, len(s.liveConns))
+	for host := range s.liveConns {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	rows := make([]map[string]interface{}, 0, len(hosts))
+	for _, host := range hosts {
+		c := s.liveConns[host]
+		rows = append(rows, map[string]interface{}{
+			"host":      host,
+			"websocket": c.WebSocket,
+			"streaming": c.Streaming,
+			"active":    c.WebSocket + c.Streaming,
+			"total":     c.Total,
+			"rejected":  c.Rejected,
+			"timedOut":  c.TimedOut,
+			"drained":   c.Drained,
+		})
+	}
+	return rows
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net"
 	"net/http"
+	"router/internal/clientip"
 	"sort"
 	"strings"
 	"sync"
@@ -72,11 +73,14 @@ func CountryFromRequest(r *http.Request) string {
 		return unknownCountryCode
 	}
 
-	if code := countryFromHeaders(r); code != "" {
-		return NormalizeCountry(code)
+	// Country headers are only believed from trusted proxies (e.g. Cloudflare).
+	if clientip.TrustedPeer(r) {
+		if code := countryFromHeaders(r); code != "" {
+			return NormalizeCountry(code)
+		}
 	}
 
-	ip := clientIP(r)
+	ip := net.ParseIP(clientip.FromRequest(r))
 	if ip == nil {
 		return unknownCountryCode
 	}
@@ -130,32 +134,6 @@ func countryFromHeaders(r *http.Request) string {
 	return ""
 }
 
-func clientIP(r *http.Request) net.IP {
-	xff := strings.TrimSpace(r.Header.Get("X-Forwarded-For"))
-	if xff != "" {
-		parts := strings.Split(xff, ",")
-		for _, part := range parts {
-			ip := net.ParseIP(strings.TrimSpace(part))
-			if ip != nil {
-				return ip
-			}
-		}
-	}
-
-	if xrip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); xrip != nil {
-		return xrip
-	}
-
-	host, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
-	if err == nil {
-		if ip := net.ParseIP(host); ip != nil {
-			return ip
-		}
-	}
-
-	return net.ParseIP(strings.TrimSpace(r.RemoteAddr))
-}
-
 func isLocalIP(ip net.IP) bool {
 	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalMulticast() || ip.IsLinkLocalUnicast()
 }
@@ -0,0 +1,46 @@
+package stats
+
+import "sort"
+
+// Limit breach kinds reported by the proxy.
+const (
+	BreachBodyTooLarge    = "bodyTooLarge"
+	BreachUpstreamTimeout = "upstreamTimeout"
+	BreachDeadline        = "deadline"
+)
+
+// LimitBreach counts a request that hit one of the per-rule limits.
+func (s *Stats) LimitBreach(host, kind string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counters, ok := s.limits[host]
+	if !ok {
+		counters = make(map[string]int)
+		s.limits[host] = counters
+	}
+	counters[kind]++
+}
+
+// GetLimitData returns limit breaches per host.
+func (s *Stats) GetLimitData() []map[string]interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	hosts := make([]string, 0, len(s.limits))
+	for host := range s.limits {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	rows := make([]map[string]interface{}, 0, len(hosts))
+	for _, host := range hosts {
+		c := s.limits[host]
+		rows = append(rows, map[string]interface{}{
+			"host":                host,
+			BreachBodyTooLarge:    c[BreachBodyTooLarge],
+			BreachUpstreamTimeout: c[BreachUpstreamTimeout],
+			BreachDeadline:        c[BreachDeadline],
+		})
+	}
+	return rows
+}
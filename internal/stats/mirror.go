@@ -0,0 +1,106 @@
+package stats
+
+import (
+	"sort"
+	"time"
+)
+
+type mirrorSide struct {
+	Count   int
+	Errors  int // no response at all
+	Classes [6]int
+	Latency time.Duration
+	Max     time.Duration
+}
+
+func (m *mirrorSide) add(status int, latency time.Duration) {
+	m.Count++
+	if status <= 0 {
+		m.Errors++
+	} else if class := status / 100; class >= 1 && class <= 5 {
+		m.Classes[class]++
+	}
+	m.Latency += latency
+	if latency > m.Max {
+		m.Max = latency
+	}
+}
+
+func (m *mirrorSide) data() map[string]interface{} {
+	avg := 0.0
+	if m.Count > 0 {
+		avg = float64(m.Latency.Milliseconds()) / float64(m.Count)
+	}
+	return map[string]interface{}{
+		"count":  m.Count,
+		"errors": m.Errors,
+		"2xx":    m.Classes[2],
+		"3xx":    m.Classes[3],
+		"4xx":    m.Classes[4],
+		"5xx":    m.Classes[5],
+		"avgMs":  avg,
+		"maxMs":  m.Max.Milliseconds(),
+	}
+}
+
+type mirrorCounters struct {
+	Primary    mirrorSide
+	Shadow     mirrorSide
+	Mismatches int // requests where primary and shadow status differ
+	Skipped    int // not mirrored: body over the limit or too many in flight
+}
+
+func (s *Stats) mirrorLocked(host string) *mirrorCounters {
+	counters, ok := s.mirrors[host]
+	if !ok {
+		counters = &mirrorCounters{}
+		s.mirrors[host] = counters
+	}
+	return counters
+}
+
+// MirrorSample records one mirrored request: the status and time to response
+// headers of the primary and the shadow upstream. A status of 0 means the
+// upstream did not answer.
+func (s *Stats) MirrorSample(host string, primaryStatus int, primaryLatency time.Duration, shadowStatus int, shadowLatency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counters := s.mirrorLocked(host)
+	counters.Primary.add(primaryStatus, primaryLatency)
+	counters.Shadow.add(shadowStatus, shadowLatency)
+	if primaryStatus != shadowStatus {
+		counters.Mismatches++
+	}
+}
+
+// MirrorSkipped counts a request selected for mirroring that was not sent.
+func (s *Stats) MirrorSkipped(host string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mirrorLocked(host).Skipped++
+}
+
+// GetMirrorData returns the primary/shadow comparison per host.
+func (s *Stats) GetMirrorData() []map[string]interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	hosts := make([]string, 0, len(s.mirrors))
+	for host := range s.mirrors {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	rows := make([]map[string]interface{}, 0, len(hosts))
+	for _, host := range hosts {
+		c := s.mirrors[host]
+		rows = append(rows, map[string]interface{}{
+			"host":       host,
+			"primary":    c.Primary.data(),
+			"shadow":     c.Shadow.data(),
+			"mismatches": c.Mismatches,
+			"skipped":    c.Skipped,
+		})
+	}
+	return rows
+}
@@ -77,6 +77,13 @@ type Stats struct {
 	sshSessions     map[string]sshSessionState
 	deviceNames     map[string]string
 	countryStats    map[string]int
+	streams         map[string]*streamCounters
+	liveConns       map[string]*liveConnCounters
+	cache           map[string]*cacheCounters
+	limits          map[string]map[string]int
+	mirrors         map[string]*mirrorCounters
+	canary          map[string]map[string]int
+	wafHits         map[string]int
 	listConnections connectionFetcher
 }
 
@@ -91,6 +98,13 @@ func New() *Stats {
 		sshSessions:     make(map[string]sshSessionState),
 		deviceNames:     make(map[string]string),
 		countryStats:    make(map[string]int),
+		streams:         make(map[string]*streamCounters),
+		liveConns:       make(map[string]*liveConnCounters),
+		cache:           make(map[string]*cacheCounters),
+		limits:          make(map[string]map[string]int),
+		mirrors:         make(map[string]*mirrorCounters),
+		canary:          make(map[string]map[string]int),
+		wafHits:         make(map[string]int),
 		listConnections: netutil.Connections,
 	}
 }
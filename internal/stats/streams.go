@@ -0,0 +1,116 @@
+package stats
+
+import (
+	"sort"
+	"time"
+)
+
+type streamCounters struct {
+	Protocol    string
+	Target      string
+	Total       int
+	Active      int
+	Blocked     int
+	Failed      int
+	BytesIn     int64
+	BytesOut    int64
+	Healthy     bool
+	LastChecked time.Time
+}
+
+func (s *Stats) streamLocked(name string) *streamCounters {
+	counters, ok := s.streams[name]
+	if !ok {
+		counters = &streamCounters{}
+		s.streams[name] = counters
+	}
+	return counters
+}
+
+// StreamOpened records a new TCP connection or UDP session for a stream rule.
+func (s *Stats) StreamOpened(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counters := s.streamLocked(name)
+	counters.Total++
+	counters.Active++
+}
+
+// StreamClosed records the end of a connection with the bytes copied in each direction.
+func (s *Stats) StreamClosed(name string, bytesIn, bytesOut int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counters := s.streamLocked(name)
+	if counters.Active > 0 {
+		counters.Active--
+	}
+	counters.BytesIn += bytesIn
+	counters.BytesOut += bytesOut
+}
+
+// StreamBlocked counts a connection refused by the IP ban list.
+func (s *Stats) StreamBlocked(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streamLocked(name).Blocked++
+}
+
+// StreamFailed counts a connection that could not reach the target.
+func (s *Stats) StreamFailed(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streamLocked(name).Failed++
+}
+
+// SetStreamHealth stores the latest health check result of a stream rule.
+func (s *Stats) SetStreamHealth(name, protocol, target string, healthy bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counters := s.streamLocked(name)
+	counters.Protocol = protocol
+	counters.Target = target
+	counters.Healthy = healthy
+	counters.LastChecked = time.Now()
+}
+
+// RemoveStream drops counters of a deleted stream rule.
+func (s *Stats) RemoveStream(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, name)
+}
+
+// GetStreamData returns connection counters and health per stream rule.
+func (s *Stats) GetStreamData() []map[string]interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.streams))
+	for name := range s.streams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rows := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		c := s.streams[name]
+		lastChecked := ""
+		if !c.LastChecked.IsZero() {
+			lastChecked = c.LastChecked.Format("2006-01-02 15:04:05")
+		}
+		rows = append(rows, map[string]interface{}{
+			"name":        name,
+			"protocol":    c.Protocol,
+			"target":      c.Target,
+			"total":       c.Total,
+			"active":      c.Active,
+			"blocked":     c.Blocked,
+			"failed":      c.Failed,
+			"bytesIn":     c.BytesIn,
+			"bytesOut":    c.BytesOut,
+			"healthy":     c.Healthy,
+			"lastChecked": lastChecked,
+		})
+	}
+	return rows
+}
@@ -0,0 +1,36 @@
+package stats
+
+import "sort"
+
+// WAFHit counts a request that matched the signature with the given ID.
+func (s *Stats) WAFHit(signature string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.wafHits[signature]++
+}
+
+// GetWAFData returns hit counts per signature, most frequent first.
+func (s *Stats) GetWAFData() []map[string]interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := make([]string, 0, len(s.wafHits))
+	for id := range s.wafHits {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if s.wafHits[ids[i]] == s.wafHits[ids[j]] {
+			return ids[i] < ids[j]
+		}
+		return s.wafHits[ids[i]] > s.wafHits[ids[j]]
+	})
+
+	rows := make([]map[string]interface{}, 0, len(ids))
+	for _, id := range ids {
+		rows = append(rows, map[string]interface{}{
+			"signature": id,
+			"hits":      s.wafHits[id],
+		})
+	}
+	return rows
+}
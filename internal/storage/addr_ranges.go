@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"net/netip"
+	"slices"
+)
+
+// addrRange is an inclusive range of addresses of one family.
+type addrRange struct {
+	first, last netip.Addr
+}
+
+// addrRanges is a sorted list of disjoint address ranges. Unlike prefixTrie,
+// which spends a node per prefix bit, it stores two addresses per range, so
+// lists with hundreds of thousands of entries stay small.
+type addrRanges []addrRange
+
+// newAddrRanges sorts and merges prefixes; overlapping and adjacent prefixes
+// become one range.
+func newAddrRanges(prefixes []netip.Prefix) addrRanges {
+	ranges := make(addrRanges, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		prefix = prefix.Masked()
+		ranges = append(ranges, addrRange{first: prefix.Addr(), last: lastAddr(prefix)})
+	}
+	slices.SortFunc(ranges, func(a, b addrRange) int { return a.first.Compare(b.first) })
+
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 {
+			prev := &merged[n-1]
+			next := prev.last.Next() // invalid after the last address of the family
+			if prev.first.Is4() == r.first.Is4() && (!next.IsValid() || r.first.Compare(next) <= 0) {
+				if r.last.Compare(prev.last) > 0 {
+					prev.last = r.last
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return slices.Clip(merged)
+}
+
+// contains reports whether addr falls into one of the ranges.
+func (rs addrRanges) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	// The first range starting after addr; the candidate is the one before it.
+	i, _ := slices.BinarySearchFunc(rs, addr, func(r addrRange, a netip.Addr) int {
+		if r.first.Compare(a) <= 0 {
+			return -1
+		}
+		return 1
+	})
+	if i == 0 {
+		return false
+	}
+	r := rs[i-1]
+	return r.first.Is4() == addr.Is4() && addr.Compare(r.last) <= 0
+}
+
+// lastAddr returns the highest address of a masked prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Addr().As16()
+	offset := 0
+	if prefix.Addr().Is4() {
+		offset = 12
+	}
+	for bit := offset*8 + prefix.Bits(); bit < 128; bit++ {
+		bytes[bit/8] |= 0x80 >> (bit % 8)
+	}
+	addr := netip.AddrFrom16(bytes)
+	if prefix.Addr().Is4() {
+		return addr.Unmap()
+	}
+	return addr
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestAddrRangesMergeAndContain(t *testing.T) {
+	var prefixes []netip.Prefix
+	for _, raw := range []string{
+		"192.0.2.0/25", "192.0.2.128/25", // adjacent, merged into one /24
+		"192.0.2.10/32",             // inside
+		"10.0.0.0/8", "10.1.0.0/16", // nested
+		"255.255.255.255/32",
+		"::/128",
+		"2001:db8::/32",
+		"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff/128",
+	} {
+		prefixes = append(prefixes, netip.MustParsePrefix(raw))
+	}
+	ranges := newAddrRanges(prefixes)
+	if len(ranges) != 6 {
+		t.Fatalf("ranges = %v", ranges)
+	}
+
+	for addr, want := range map[string]bool{
+		"192.0.2.0":        true,
+		"192.0.2.255":      true,
+		"192.0.3.0":        false,
+		"192.0.1.255":      false,
+		"10.255.255.255":   true,
+		"11.0.0.0":         false,
+		"0.0.0.0":          false,
+		"255.255.255.255":  true,
+		"::ffff:192.0.2.7": true,
+		"::":               true,
+		"::1":              false,
+		"2001:db8:ffff::1": true,
+		"2001:db9::":       false,
+		"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff": true,
+	} {
+		if got := ranges.contains(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("contains(%s) = %v, want %v", addr, got, want)
+		}
+	}
+	if addrRanges(nil).contains(netip.MustParseAddr("192.0.2.1")) {
+		t.Fatalf("empty ranges must not match")
+	}
+}
@@ -0,0 +1,360 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultBlocklistRefresh = 24 * 60 // minutes
+	minBlocklistRefresh     = 5
+)
+
+var (
+	maxBlocklistBytes   int64 = 64 << 20
+	blocklistTagPattern       = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,39}$`)
+	blocklistHTTPClient       = &http.Client{Timeout: 60 * time.Second}
+)
+
+// BlocklistSource is an external list of IPs and CIDR ranges, one per line,
+// such as FireHOL or Spamhaus DROP. Source is a local file path or an
+// http(s) URL.
+type BlocklistSource struct {
+	Tag            string    `json:"tag"`
+	Source         string    `json:"source"`
+	Enabled        bool      `json:"enabled"`
+	RefreshMinutes int       `json:"refreshMinutes"`
+	LastRefresh    time.Time `json:"lastRefresh,omitempty"`
+	LastError      string    `json:"lastError,omitempty"`
+	Count          int       `json:"count"`          // entries loaded at the last refresh
+	Hits           int64     `json:"hits,omitempty"` // blocked lookups since start, not persisted
+}
+
+type blocklistData struct {
+	Sources []BlocklistSource `json:"sources"`
+}
+
+// blocklistAttempt tracks refreshes made by this process so failing sources
+// back off instead of being fetched on every tick.
+type blocklistAttempt struct {
+	at       time.Time
+	failures int // consecutive failed refreshes
+}
+
+// blocklistSet is the loaded content of one source.
+type blocklistSet struct {
+	ranges addrRanges
+	hits   atomic.Int64
+}
+
+// BlocklistStore keeps blocklist sources in a JSON file and their loaded
+// entries in memory. The entries are never written to ip_reputation.json.
+type BlocklistStore struct {
+	mu       sync.RWMutex
+	path     string
+	sources  []BlocklistSource
+	sets     map[string]*blocklistSet    // tag -> loaded entries
+	attempts map[string]blocklistAttempt // tag -> last refresh by this process
+	nowFn    func() time.Time
+}
+
+func NewBlocklistStore(path string) *BlocklistStore {
+	s := &BlocklistStore{
+		path:     path,
+		sets:     make(map[string]*blocklistSet),
+		attempts: make(map[string]blocklistAttempt),
+		nowFn:    time.Now,
+	}
+	s.load()
+	return s
+}
+
+func (s *BlocklistStore) load() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.path)
+	if err != nil || len(data) == 0 {
+		return
+	}
+	var parsed blocklistData
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return
+	}
+	for _, src := range parsed.Sources {
+		if normalized, err := normalizeBlocklistSource(src); err == nil {
+			s.sources = append(s.sources, normalized)
+		}
+	}
+}
+
+func (s *BlocklistStore) saveLocked() {
+	sources := slices.Clone(s.sources)
+	for i := range sources {
+		sources[i].Hits = 0
+	}
+	data, err := json.MarshalIndent(blocklistData{Sources: sources}, "", "  ")
+	if err != nil {
+		return
+	}
+	_ = os.WriteFile(s.path, data, 0644)
+}
+
+// List returns the sources with their hit counters.
+func (s *BlocklistStore) List() []BlocklistSource {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := slices.Clone(s.sources)
+	for i := range out {
+		if set, ok := s.sets[out[i].Tag]; ok {
+			out[i].Hits = set.hits.Load()
+		}
+	}
+	return out
+}
+
+// Upsert adds a source or changes the source, state and refresh interval of
+// the one with the same tag.
+func (s *BlocklistStore) Upsert(src BlocklistSource) (BlocklistSource, error) {
+	src, err := normalizeBlocklistSource(src)
+	if err != nil {
+		return src, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idx := slices.IndexFunc(s.sources, func(existing BlocklistSource) bool { return existing.Tag == src.Tag })
+	if idx < 0 {
+		s.sources = append(s.sources, src)
+		s.saveLocked()
+		return src, nil
+	}
+	existing := &s.sources[idx]
+	if existing.Source != src.Source {
+		// New content: drop the old entries until the next refresh.
+		delete(s.sets, src.Tag)
+		delete(s.attempts, src.Tag)
+		existing.Count = 0
+		existing.LastRefresh = time.Time{}
+		existing.LastError = ""
+	}
+	existing.Source = src.Source
+	existing.Enabled = src.Enabled
+	existing.RefreshMinutes = src.RefreshMinutes
+	s.saveLocked()
+	return *existing, nil
+}
+
+// SetEnabled toggles a source; disabled sources keep their entries loaded
+// but do not block.
+func (s *BlocklistStore) SetEnabled(tag string, enabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idx := slices.IndexFunc(s.sources, func(src BlocklistSource) bool { return src.Tag == tag })
+	if idx < 0 {
+		return fmt.Errorf("unknown blocklist %q", tag)
+	}
+	s.sources[idx].Enabled = enabled
+	s.saveLocked()
+	return nil
+}
+
+// Remove deletes a source and its entries.
+func (s *BlocklistStore) Remove(tag string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idx := slices.IndexFunc(s.sources, func(src BlocklistSource) bool { return src.Tag == tag })
+	if idx < 0 {
+		return false
+	}
+	s.sources = slices.Delete(s.sources, idx, idx+1)
+	delete(s.sets, tag)
+	delete(s.attempts, tag)
+	s.saveLocked()
+	return true
+}
+
+// Match returns the tag of the first enabled list containing ip.
+func (s *BlocklistStore) Match(ip string) (string, bool) {
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return "", false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, src := range s.sources {
+		if !src.Enabled {
+			continue
+		}
+		if set, ok := s.sets[src.Tag]; ok && set.ranges.contains(addr) {
+			set.hits.Add(1)
+			return src.Tag, true
+		}
+	}
+	return "", false
+}
+
+// Refresh downloads or reads a source again and replaces its entries. On
+// failure the previous entries stay in force.
+func (s *BlocklistStore) Refresh(tag string) error {
+	s.mu.RLock()
+	idx := slices.IndexFunc(s.sources, func(src BlocklistSource) bool { return src.Tag == tag })
+	if idx < 0 {
+		s.mu.RUnlock()
+		return fmt.Errorf("unknown blocklist %q", tag)
+	}
+	source := s.sources[idx].Source
+	s.mu.RUnlock()
+
+	prefixes, err := fetchBlocklist(source)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idx = slices.IndexFunc(s.sources, func(src BlocklistSource) bool { return src.Tag == tag })
+	if idx < 0 || s.sources[idx].Source != source {
+		return nil // removed or changed while fetching
+	}
+	src := &s.sources[idx]
+	src.LastRefresh = s.nowFn()
+	if err != nil {
+		s.attempts[tag] = blocklistAttempt{at: src.LastRefresh, failures: s.attempts[tag].failures + 1}
+		src.LastError = err.Error()
+		s.saveLocked()
+		return err
+	}
+	s.attempts[tag] = blocklistAttempt{at: src.LastRefresh}
+	set := &blocklistSet{ranges: newAddrRanges(prefixes)}
+	if old, ok := s.sets[tag]; ok {
+		set.hits.Store(old.hits.Load())
+	}
+	s.sets[tag] = set
+	src.Count = len(prefixes)
+	src.LastError = ""
+	s.saveLocked()
+	return nil
+}
+
+// Start loads every enabled source and then refreshes them on their
+// intervals; it never returns.
+func (s *BlocklistStore) Start() {
+	for {
+		s.refreshDue()
+		time.Sleep(1 * time.Minute)
+	}
+}
+
+func (s *BlocklistStore) refreshDue() {
+	now := s.nowFn()
+	var due []string
+	s.mu.RLock()
+	for _, src := range s.sources {
+		if !src.Enabled {
+			continue
+		}
+		// Every source is loaded once per process; after that it waits for
+		// its interval, or for the retry delay while it keeps failing.
+		attempt, tried := s.attempts[src.Tag]
+		if !tried || now.Sub(attempt.at) >= blocklistRetryDelay(src, attempt.failures) {
+			due = append(due, src.Tag)
+		}
+	}
+	s.mu.RUnlock()
+	for _, tag := range due {
+		_ = s.Refresh(tag)
+	}
+}
+
+// blocklistRetryDelay is the refresh interval, shortened after failures to a
+// delay that starts at the minimum interval and doubles with each failure.
+func blocklistRetryDelay(src BlocklistSource, failures int) time.Duration {
+	interval := time.Duration(src.RefreshMinutes) * time.Minute
+	if failures == 0 {
+		return interval
+	}
+	delay := (time.Duration(minBlocklistRefresh) * time.Minute) << min(failures-1, 10)
+	return min(delay, interval)
+}
+
+func normalizeBlocklistSource(src BlocklistSource) (BlocklistSource, error) {
+	src.Tag = strings.ToLower(strings.TrimSpace(src.Tag))
+	src.Source = strings.TrimSpace(src.Source)
+	if !blocklistTagPattern.MatchString(src.Tag) {
+		return src, fmt.Errorf("invalid tag %q: use up to 40 lowercase letters, digits, '.', '_' or '-'", src.Tag)
+	}
+	if src.Source == "" {
+		return src, fmt.Errorf("source is required")
+	}
+	if strings.Contains(src.Source, "://") && !strings.HasPrefix(src.Source, "http://") && !strings.HasPrefix(src.Source, "https://") {
+		return src, fmt.Errorf("unsupported source %q: use a file path or an http(s) URL", src.Source)
+	}
+	if src.RefreshMinutes == 0 {
+		src.RefreshMinutes = defaultBlocklistRefresh
+	}
+	if src.RefreshMinutes < minBlocklistRefresh {
+		return src, fmt.Errorf("refresh interval must be at least %d minutes", minBlocklistRefresh)
+	}
+	src.Hits = 0
+	return src, nil
+}
+
+func fetchBlocklist(source string) ([]netip.Prefix, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return ParseBlocklist(f)
+	}
+	resp, err := blocklistHTTPClient.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", source, resp.Status)
+	}
+	return ParseBlocklist(resp.Body)
+}
+
+// ParseBlocklist reads one IP or CIDR per line. Text after '#' or ';' is a
+// comment, as in FireHOL and Spamhaus DROP lists; other malformed lines are
+// skipped. A list over maxBlocklistBytes is an error rather than being
+// loaded in part.
+func ParseBlocklist(r io.Reader) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	limited := &io.LimitedReader{R: r, N: maxBlocklistBytes + 1}
+	scanner := bufio.NewScanner(limited)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if prefix, ok := parseEntryKey(fields[0]); ok {
+			out = append(out, prefix.Masked())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if limited.N == 0 {
+		return nil, fmt.Errorf("blocklist is larger than %d MB", maxBlocklistBytes>>20)
+	}
+	return out, nil
+}
@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseBlocklistSkipsCommentsAndJunk(t *testing.T) {
+	input := `# FireHOL level1
+; Spamhaus DROP
+192.0.2.0/24 ; SBL123
+198.51.100.7
+2001:db8::/32
+not-an-ip
+
+203.0.113.9/33
+10.1.2.3/8 # masked to 10.0.0.0/8
+`
+	prefixes, err := ParseBlocklist(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	var got []string
+	for _, prefix := range prefixes {
+		got = append(got, prefix.String())
+	}
+	want := "192.0.2.0/24 198.51.100.7/32 2001:db8::/32 10.0.0.0/8"
+	if strings.Join(got, " ") != want {
+		t.Fatalf("got %v, want %s", got, want)
+	}
+}
+
+func TestParseBlocklistRejectsOversizedLists(t *testing.T) {
+	defer func(limit int64) { maxBlocklistBytes = limit }(maxBlocklistBytes)
+	maxBlocklistBytes = 32
+
+	if _, err := ParseBlocklist(strings.NewReader("192.0.2.0/24\n198.51.100.0/24\n")); err != nil {
+		t.Fatalf("list within the limit: %v", err)
+	}
+	prefixes, err := ParseBlocklist(strings.NewReader("192.0.2.0/24\n198.51.100.0/24\n203.0.113.0/24\n"))
+	if err == nil || prefixes != nil {
+		t.Fatalf("expected an oversized list to fail instead of loading %v", prefixes)
+	}
+}
+
+func TestBlocklistStoreLoadsFileAndURLSources(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "drop.txt")
+	if err := os.WriteFile(file, []byte("192.0.2.0/24\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("# level1\n198.51.100.0/24\n2001:db8::/48\n"))
+	}))
+	defer server.Close()
+
+	path := filepath.Join(dir, "blocklists.json")
+	store := NewBlocklistStore(path)
+	if _, err := store.Upsert(BlocklistSource{Tag: "Bad Tag", Source: file}); err == nil {
+		t.Fatalf("expected invalid tag to be rejected")
+	}
+	if _, err := store.Upsert(BlocklistSource{Tag: "ftp", Source: "ftp://example.com/list"}); err == nil {
+		t.Fatalf("expected unsupported scheme to be rejected")
+	}
+	if _, err := store.Upsert(BlocklistSource{Tag: "spamhaus-drop", Source: file, Enabled: true}); err != nil {
+		t.Fatalf("add file source: %v", err)
+	}
+	if _, err := store.Upsert(BlocklistSource{Tag: "firehol", Source: server.URL, Enabled: true, RefreshMinutes: 60}); err != nil {
+		t.Fatalf("add url source: %v", err)
+	}
+	store.refreshDue()
+
+	if tag, ok := store.Match("192.0.2.44"); !ok || tag != "spamhaus-drop" {
+		t.Fatalf("expected file list match, got %q %v", tag, ok)
+	}
+	if tag, ok := store.Match("2001:db8:0:1::5"); !ok || tag != "firehol" {
+		t.Fatalf("expected url list match, got %q %v", tag, ok)
+	}
+	if _, ok := store.Match("203.0.113.1"); ok {
+		t.Fatalf("unexpected match")
+	}
+
+	lists := store.List()
+	if len(lists) != 2 || lists[0].Count != 1 || lists[0].Hits != 1 || lists[1].Count != 2 || lists[0].RefreshMinutes != defaultBlocklistRefresh {
+		t.Fatalf("unexpected sources: %+v", lists)
+	}
+
+	if err := store.SetEnabled("firehol", false); err != nil {
+		t.Fatalf("toggle: %v", err)
+	}
+	if _, ok := store.Match("198.51.100.1"); ok {
+		t.Fatalf("disabled list must not match")
+	}
+
+	// A failed refresh keeps the previous entries.
+	os.Remove(file)
+	if err := store.Refresh("spamhaus-drop"); err == nil {
+		t.Fatalf("expected refresh of a missing file to fail")
+	}
+	if _, ok := store.Match("192.0.2.1"); !ok {
+		t.Fatalf("expected previous entries to stay after a failed refresh")
+	}
+
+	reloaded := NewBlocklistStore(path)
+	lists = reloaded.List()
+	if len(lists) != 2 || lists[0].LastError == "" || lists[1].Enabled || lists[0].Hits != 0 {
+		t.Fatalf("unexpected reloaded sources: %+v", lists)
+	}
+	if !reloaded.Remove("firehol") || reloaded.Remove("firehol") {
+		t.Fatalf("expected remove to succeed once")
+	}
+}
+
+func TestBlocklistStoreBacksOffFailingSources(t *testing.T) {
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	store := NewBlocklistStore(filepath.Join(t.TempDir(), "blocklists.json"))
+	store.nowFn = func() time.Time { return now }
+	if _, err := store.Upsert(BlocklistSource{Tag: "down", Source: server.URL, Enabled: true, RefreshMinutes: 60}); err != nil {
+		t.Fatalf("add source: %v", err)
+	}
+
+	// The first tick tries the never-loaded source, then it waits 5, 10,
+	// 20 and 40 minutes between attempts, capped at its 60 minute interval.
+	store.refreshDue()
+	for i, wait := range []int{5, 10, 20, 40, 60, 60} {
+		now = now.Add(time.Duration(wait)*time.Minute - time.Minute)
+		store.refreshDue()
+		if got := fetches.Load(); got != int32(i+1) {
+			t.Fatalf("attempt %d fetched early: %d fetches", i+2, got)
+		}
+		now = now.Add(time.Minute)
+		store.refreshDue()
+		if got := fetches.Load(); got != int32(i+2) {
+			t.Fatalf("attempt %d: %d fetches", i+2, got)
+		}
+	}
+}
+
+func TestIPReputationStoreBlocksBlocklistedIPs(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "drop.txt")
+	if err := os.WriteFile(file, []byte("192.0.2.0/24\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store := NewIPReputationStore(filepath.Join(dir, "ip_reputation.json"))
+	store.Blocklists = NewBlocklistStore(filepath.Join(dir, "blocklists.json"))
+	store.Blocklists.Upsert(BlocklistSource{Tag: "drop", Source: file, Enabled: true})
+	if err := store.Blocklists.Refresh("drop"); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+
+	if !store.IsBanned("192.0.2.10") {
+		t.Fatalf("expected blocklisted address to be banned")
+	}
+	if store.HasBan("192.0.2.10") || len(store.List()) != 0 {
+		t.Fatalf("blocklist entries must not be stored as reputation entries")
+	}
+
+	store.Allowlist = NewAllowlistStore(filepath.Join(dir, "ip_allowlist.json"))
+	store.Allowlist.Add("192.0.2.10", "partner")
+	if store.IsBanned("192.0.2.10") {
+		t.Fatalf("allowlist must override blocklists")
+	}
+	if !store.IsBanned("192.0.2.11") {
+		t.Fatalf("expected the rest of the range to stay banned")
+	}
+}
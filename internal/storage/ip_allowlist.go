@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AllowEntry is an address or CIDR range that is never tracked or banned.
+type AllowEntry struct {
+	Target  string    `json:"target"`
+	Comment string    `json:"comment,omitempty"`
+	AddedAt time.Time `json:"addedAt"`
+}
+
+type allowlistData struct {
+	Entries []AllowEntry `json:"entries"`
+}
+
+// AllowlistedError refuses a ban of an allowlisted address or range.
+type AllowlistedError struct {
+	Target string
+	Entry  AllowEntry
+}
+
+func (e *AllowlistedError) Error() string {
+	msg := e.Target + " is allowlisted"
+	if e.Entry.Target != e.Target {
+		msg += " by " + e.Entry.Target
+	}
+	if e.Entry.Comment != "" {
+		msg += " (" + e.Entry.Comment + ")"
+	}
+	return msg + "; remove it from the allowlist before banning"
+}
+
+// AllowlistStore keeps the allowlist in a JSON file and indexes it in a
+// prefix trie for per-request lookups.
+type AllowlistStore struct {
+	mu      sync.RWMutex
+	path    string
+	entries []AllowEntry
+	index   prefixTrie
+	nowFn   func() time.Time
+}
+
+func NewAllowlistStore(path string) *AllowlistStore {
+	s := &AllowlistStore{path: path, nowFn: time.Now}
+	s.load()
+	return s
+}
+
+func (s *AllowlistStore) load() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.path)
+	if err != nil || len(data) == 0 {
+		return
+	}
+	var parsed allowlistData
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return
+	}
+	for _, entry := range parsed.Entries {
+		if key, err := ParseBanTarget(entry.Target); err == nil {
+			entry.Target = key
+			s.entries = append(s.entries, entry)
+		}
+	}
+	s.reindexLocked()
+}
+
+func (s *AllowlistStore) saveLocked() {
+	data, err := json.MarshalIndent(allowlistData{Entries: s.entries}, "", "  ")
+	if err != nil {
+		return
+	}
+	_ = os.WriteFile(s.path, data, 0644)
+}
+
+func (s *AllowlistStore) reindexLocked() {
+	s.index = prefixTrie{}
+	for _, entry := range s.entries {
+		if prefix, ok := parseEntryKey(entry.Target); ok {
+			s.index.insert(prefix)
+		}
+	}
+}
+
+// List returns a copy of the allowlist.
+func (s *AllowlistStore) List() []AllowEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.entries)
+}
+
+// Add allowlists an address or CIDR range; adding an existing one updates
+// its comment.
+func (s *AllowlistStore) Add(target, comment string) (AllowEntry, error) {
+	key, err := ParseBanTarget(target)
+	if err != nil {
+		return AllowEntry{}, err
+	}
+	comment = strings.TrimSpace(comment)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if idx := slices.IndexFunc(s.entries, func(e AllowEntry) bool { return e.Target == key }); idx >= 0 {
+		s.entries[idx].Comment = comment
+		s.saveLocked()
+		return s.entries[idx], nil
+	}
+	entry := AllowEntry{Target: key, Comment: comment, AddedAt: s.nowFn()}
+	s.entries = append(s.entries, entry)
+	s.reindexLocked()
+	s.saveLocked()
+	return entry, nil
+}
+
+// Remove deletes an entry by its address or range.
+func (s *AllowlistStore) Remove(target string) bool {
+	key, err := ParseBanTarget(target)
+	if err != nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idx := slices.IndexFunc(s.entries, func(e AllowEntry) bool { return e.Target == key })
+	if idx < 0 {
+		return false
+	}
+	s.entries = slices.Delete(s.entries, idx, idx+1)
+	s.reindexLocked()
+	s.saveLocked()
+	return true
+}
+
+// Match returns the entry that allowlists the address ip.
+func (s *AllowlistStore) Match(ip string) (AllowEntry, bool) {
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return AllowEntry{}, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	matches := s.index.lookup(addr)
+	if len(matches) == 0 {
+		return AllowEntry{}, false
+	}
+	return s.entryLocked(matches[0])
+}
+
+// Overlapping returns an entry that shares addresses with target, an address
+// or CIDR range.
+func (s *AllowlistStore) Overlapping(target string) (AllowEntry, bool) {
+	key, err := ParseBanTarget(target)
+	if err != nil {
+		return AllowEntry{}, false
+	}
+	prefix, ok := parseEntryKey(key)
+	if !ok {
+		return AllowEntry{}, false
+	}
+	if prefix.IsSingleIP() {
+		return s.Match(key)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, entry := range s.entries {
+		if other, ok := parseEntryKey(entry.Target); ok && other.Overlaps(prefix) {
+			return entry, true
+		}
+	}
+	return AllowEntry{}, false
+}
+
+func (s *AllowlistStore) entryLocked(prefix netip.Prefix) (AllowEntry, bool) {
+	for _, entry := range s.entries {
+		if other, ok := parseEntryKey(entry.Target); ok && other == prefix {
+			return entry, true
+		}
+	}
+	return AllowEntry{}, false
+}
+
+// checkAllowed returns an *AllowlistedError when target overlaps the
+// allowlist; a nil store allows everything.
+func (s *AllowlistStore) checkAllowed(target string) error {
+	if s == nil {
+		return nil
+	}
+	if entry, ok := s.Overlapping(target); ok {
+		return &AllowlistedError{Target: target, Entry: entry}
+	}
+	return nil
+}
+
+// String formats an entry for chat replies.
+func (e AllowEntry) String() string {
+	if e.Comment == "" {
+		return e.Target
+	}
+	return fmt.Sprintf("%s — %s", e.Target, e.Comment)
+}
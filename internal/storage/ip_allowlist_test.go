@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAllowlistStorePersistsAndMatches(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ip_allowlist.json")
+	store := NewAllowlistStore(path)
+
+	if _, err := store.Add("not-an-ip", ""); err == nil {
+		t.Fatalf("expected invalid target to be rejected")
+	}
+	if _, err := store.Add("198.51.100.7/24", "office"); err != nil {
+		t.Fatalf("add range: %v", err)
+	}
+	if _, err := store.Add("2001:db8::10", "monitoring"); err != nil {
+		t.Fatalf("add ip: %v", err)
+	}
+	if entry, err := store.Add("198.51.100.0/24", "office VPN"); err != nil || entry.Comment != "office VPN" || len(store.List()) != 2 {
+		t.Fatalf("expected re-adding to update the comment, got %+v %v", entry, err)
+	}
+
+	reloaded := NewAllowlistStore(path)
+	if entry, ok := reloaded.Match("198.51.100.200"); !ok || entry.Target != "198.51.100.0/24" {
+		t.Fatalf("expected range match, got %+v %v", entry, ok)
+	}
+	if _, ok := reloaded.Match("2001:db8::11"); ok {
+		t.Fatalf("single IPv6 entry must not match its neighbour")
+	}
+	if _, ok := reloaded.Overlapping("198.51.0.0/16"); !ok {
+		t.Fatalf("expected a wider range to overlap the allowlisted /24")
+	}
+	if !reloaded.Remove("198.51.100.0/24") || reloaded.Remove("198.51.100.0/24") {
+		t.Fatalf("expected remove to succeed once")
+	}
+	if _, ok := reloaded.Match("198.51.100.200"); ok {
+		t.Fatalf("expected removed range not to match")
+	}
+}
+
+func TestIPReputationStoreRespectsAllowlist(t *testing.T) {
+	dir := t.TempDir()
+	store := NewIPReputationStore(filepath.Join(dir, "ip_reputation.json"))
+	store.Ban("192.0.2.10")
+	store.Allowlist = NewAllowlistStore(filepath.Join(dir, "ip_allowlist.json"))
+	store.Allowlist.Add("192.0.2.0/28", "uptime probes")
+
+	for i := 0; i < 10; i++ {
+		if banned, _ := store.MarkSuspicious("192.0.2.5", "unknown host"); banned {
+			t.Fatalf("allowlisted address must never be auto-banned")
+		}
+	}
+	for _, item := range store.List() {
+		if item.IP == "192.0.2.5" {
+			t.Fatalf("allowlisted address must not be tracked")
+		}
+	}
+	if store.IsBanned("192.0.2.10") {
+		t.Fatalf("an earlier ban must not apply once the address is allowlisted")
+	}
+
+	for _, target := range []string{"192.0.2.3", "192.0.2.0/24"} {
+		err := store.CheckBan(target)
+		var allowlisted *AllowlistedError
+		if !errors.As(err, &allowlisted) || !strings.Contains(err.Error(), "uptime probes") {
+			t.Fatalf("%s: expected an allowlist refusal, got %v", target, err)
+		}
+		if store.Ban(target) {
+			t.Fatalf("%s: expected ban to be refused", target)
+		}
+	}
+	if err := store.CheckBan("192.0.2.16"); err != nil || !store.Ban("192.0.2.16") {
+		t.Fatalf("addresses outside the allowlist must stay bannable: %v", err)
+	}
+}
@@ -2,32 +2,70 @@ package storage
 
 import (
 	"encoding/json"
+	"fmt"
+	"math"
+	"net/netip"
 	"os"
+	"slices"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 const (
-	defaultAutoBanWindow = 2 * time.Minute
-	defaultAutoBanHits   = 3
-	autoBanDuration      = 24 * time.Hour
+	// DefaultSuspicionPoints is what a suspicious event adds to an IP's score
+	// when its reason has no weight of its own.
+	DefaultSuspicionPoints = 40
+	defaultBanScore        = 100
+	defaultScoreHalfLife   = 10 * time.Minute
+	// maxScoreHistory bounds the scoring history kept per IP.
+	maxScoreHistory = 50
+	// defaultRangeBanHits is how many banned addresses of one range turn
+	// into a ban of the whole range.
+	defaultRangeBanHits = 5
+	ipv4RangeBits       = 24
+	ipv6RangeBits       = 64
+	// ipv6AggregateRangeBits is the escalation range of aggregated /64s.
+	ipv6AggregateRangeBits = 48
 )
 
-// SuspiciousIP describes an IP with suspicious activity metadata.
+// reasonWeights are the points of the known suspicious event reasons.
+var reasonWeights = map[string]int{
+	"unknown host":         40,
+	"repeated invalid JWT": 40,
+}
+
+// autoBanLadder holds the auto-ban lengths for the first, second, third and
+// later offences; zero means permanent.
+var autoBanLadder = []time.Duration{time.Hour, 24 * time.Hour, 7 * 24 * time.Hour, 0}
+
+// SuspiciousIP describes an IP with suspicious activity metadata. IP is
+// either a single address or a CIDR range.
 type SuspiciousIP struct {
-	IP          string    `json:"ip"`
-	Reason      string    `json:"reason"`
-	Count       int       `json:"count"`
-	FirstSeen   time.Time `json:"firstSeen"`
-	LastSeen    time.Time `json:"lastSeen"`
-	Banned      bool      `json:"banned"`
-	BannedAt    time.Time `json:"bannedAt,omitempty"`
-	BanUntil    time.Time `json:"banUntil,omitempty"`
-	AutoBanned  bool      `json:"autoBanned,omitempty"`
-	WindowStart time.Time `json:"windowStart,omitempty"`
-	WindowCount int       `json:"windowCount,omitempty"`
+	IP         string       `json:"ip"`
+	Reason     string       `json:"reason"`
+	Count      int          `json:"count"`
+	FirstSeen  time.Time    `json:"firstSeen"`
+	LastSeen   time.Time    `json:"lastSeen"`
+	Banned     bool         `json:"banned"`
+	BannedAt   time.Time    `json:"bannedAt,omitempty"`
+	BanUntil   time.Time    `json:"banUntil,omitempty"`
+	AutoBanned bool         `json:"autoBanned,omitempty"`
+	Score      float64      `json:"score"`
+	ScoredAt   time.Time    `json:"scoredAt,omitempty"`
+	Offenses   int          `json:"offenses,omitempty"` // auto-bans so far
+	History    []ScoreEvent `json:"history,omitempty"`
+}
+
+// ScoreEvent is one entry of an IP's scoring history.
+type ScoreEvent struct {
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+	Points int       `json:"points"`
+	Score  float64   `json:"score"`         // score right after the event
+	Ban    string    `json:"ban,omitempty"` // auto-ban length it triggered, e.g. "1h" or "permanent"
 }
 
 type ipReputationData struct {
@@ -35,13 +73,34 @@ type ipReputationData struct {
 }
 
 // IPReputationStore stores suspicious and banned IPs in a JSON file.
+//
+// Every suspicious event adds points to the IP's score, which halves every
+// scoreHalfLife. Reaching banScore auto-bans the IP for the next step of
+// autoBanLadder and resets the score.
+//
+// Entries may also be CIDR ranges: banned ranges are indexed in a prefix trie
+// so IsBanned does not scan the entries. With aggregateIPv6 the score of an
+// IPv6 client is kept for its /64. Once rangeBanHits addresses of a /24 (IPv4)
+// or /64 (IPv6; /48 when aggregating) are banned, the whole range is banned.
 type IPReputationStore struct {
 	mu            sync.RWMutex
 	path          string
 	entries       map[string]*SuspiciousIP
+	ranges        prefixTrie // banned range entries
 	nowFn         func() time.Time
-	autoBanWindow time.Duration
-	autoBanHits   int
+	banScore      float64
+	scoreHalfLife time.Duration
+	aggregateIPv6 bool
+	rangeBanHits  int
+
+	// OnRangeBan is called when a range is banned automatically; a zero
+	// until means permanent.
+	OnRangeBan func(prefix, reason string, until time.Time)
+	// Allowlist holds addresses that are never tracked or banned.
+	Allowlist *AllowlistStore
+	// Blocklists holds external lists whose addresses are blocked like
+	// manual bans without being stored as entries.
+	Blocklists *BlocklistStore
 }
 
 func NewIPReputationStore(path string) *IPReputationStore {
@@ -49,8 +108,10 @@ func NewIPReputationStore(path string) *IPReputationStore {
 		path:          path,
 		entries:       make(map[string]*SuspiciousIP),
 		nowFn:         time.Now,
-		autoBanWindow: envDurationSeconds("IP_AUTO_BAN_WINDOW_SEC", defaultAutoBanWindow),
-		autoBanHits:   envInt("IP_AUTO_BAN_HITS", defaultAutoBanHits),
+		banScore:      float64(envInt("IP_BAN_SCORE", defaultBanScore)),
+		scoreHalfLife: envDurationSeconds("IP_SCORE_HALF_LIFE_SEC", defaultScoreHalfLife),
+		aggregateIPv6: envBool("IP_AGGREGATE_IPV6"),
+		rangeBanHits:  envNonNegativeInt("IP_RANGE_BAN_HITS", defaultRangeBanHits),
 	}
 	s.load()
 	return s
@@ -74,6 +135,11 @@ func (s *IPReputationStore) load() {
 	if parsed.Entries != nil {
 		s.entries = parsed.Entries
 	}
+	for key, entry := range s.entries {
+		if prefix, err := netip.ParsePrefix(key); err == nil && entry.Banned {
+			s.ranges.insert(prefix)
+		}
+	}
 }
 
 func (s *IPReputationStore) saveLocked() {
@@ -84,143 +150,401 @@ func (s *IPReputationStore) saveLocked() {
 	_ = os.WriteFile(s.path, data, 0644)
 }
 
+// MarkSuspicious records a suspicious event weighted by its reason. It
+// reports whether the event auto-banned the IP and until when; a zero time
+// means the ban is permanent.
 func (s *IPReputationStore) MarkSuspicious(ip, reason string) (bool, time.Time) {
+	return s.AddSuspicion(ip, reason, 0)
+}
+
+// AddSuspicion is MarkSuspicious with explicit points; points <= 0 uses the
+// weight of the reason.
+func (s *IPReputationStore) AddSuspicion(ip, reason string, points int) (bool, time.Time) {
 	if ip == "" {
 		return false, time.Time{}
 	}
+	if points <= 0 {
+		points = ReasonWeight(reason)
+	}
+	if s.allowlisted(ip) {
+		return false, time.Time{}
+	}
+	key := s.suspicionKey(ip)
 	now := s.nowFn()
 
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	entry, ok := s.entries[ip]
+	entry, ok := s.entries[key]
 	if !ok {
-		entry = &SuspiciousIP{
-			IP:          ip,
-			Reason:      reason,
-			Count:       1,
-			FirstSeen:   now,
-			LastSeen:    now,
-			WindowStart: now,
-			WindowCount: 1,
-		}
-		s.entries[ip] = entry
-		s.saveLocked()
-		return false, time.Time{}
+		entry = &SuspiciousIP{IP: key, FirstSeen: now}
+		s.entries[key] = entry
 	}
-
 	entry.Count++
 	entry.LastSeen = now
 	if reason != "" {
 		entry.Reason = reason
 	}
+	entry.Score = s.decayedScore(entry, now) + float64(points)
+	entry.ScoredAt = now
+	event := ScoreEvent{Time: now, Reason: reason, Points: points, Score: entry.Score}
 
-	if entry.WindowStart.IsZero() || now.Sub(entry.WindowStart) > s.autoBanWindow {
-		entry.WindowStart = now
-		entry.WindowCount = 1
-	} else {
-		entry.WindowCount++
+	autoBanned := false
+	var rangeBan *SuspiciousIP
+	if !entry.Banned && entry.Score >= s.banScore {
+		event.Ban = s.autoBanLocked(key, entry, now)
+		entry.Score = 0
+		autoBanned = true
+		rangeBan = s.escalateLocked(key, now)
 	}
+	entry.addHistory(event)
+	until := entry.BanUntil
 
-	if !entry.Banned && entry.WindowCount >= s.autoBanHits {
-		entry.Banned = true
-		entry.AutoBanned = true
-		entry.BannedAt = now
-		entry.BanUntil = now.Add(autoBanDuration)
-		s.saveLocked()
-		return true, entry.BanUntil
+	s.saveLocked()
+	var ranged SuspiciousIP
+	if rangeBan != nil {
+		ranged = *rangeBan
 	}
+	s.mu.Unlock()
 
-	s.saveLocked()
-	return false, time.Time{}
+	if rangeBan != nil && s.OnRangeBan != nil {
+		s.OnRangeBan(ranged.IP, ranged.Reason, ranged.BanUntil)
+	}
+	return autoBanned, until
+}
+
+// autoBanLocked bans entry for the next step of the ladder and returns the
+// ban length for the history.
+func (s *IPReputationStore) autoBanLocked(key string, entry *SuspiciousIP, now time.Time) string {
+	length := autoBanLadder[min(entry.Offenses, len(autoBanLadder)-1)]
+	entry.Offenses++
+	entry.Banned = true
+	entry.AutoBanned = true
+	entry.BannedAt = now
+	entry.BanUntil = time.Time{}
+	if length > 0 {
+		entry.BanUntil = now.Add(length)
+	}
+	if prefix, err := netip.ParsePrefix(key); err == nil {
+		s.ranges.insert(prefix)
+	}
+	return BanLength(length)
+}
+
+// escalateLocked bans the range around key when enough of its addresses are
+// banned, and returns the range entry it banned.
+func (s *IPReputationStore) escalateLocked(key string, now time.Time) *SuspiciousIP {
+	if s.rangeBanHits <= 0 {
+		return nil
+	}
+	rng, ok := escalationRange(key)
+	if !ok {
+		return nil
+	}
+	rangeKey := rng.String()
+	if existing, ok := s.entries[rangeKey]; ok && existing.Banned {
+		return nil
+	}
+	if s.Allowlist.checkAllowed(rangeKey) != nil {
+		return nil
+	}
+
+	banned := 0
+	for k, e := range s.entries {
+		if !e.Banned || k == rangeKey || (!e.BanUntil.IsZero() && now.After(e.BanUntil)) {
+			continue
+		}
+		if inner, ok := parseEntryKey(k); ok && inner.Bits() > rng.Bits() && rng.Contains(inner.Addr()) {
+			banned++
+		}
+	}
+	if banned < s.rangeBanHits {
+		return nil
+	}
+
+	entry, ok := s.entries[rangeKey]
+	if !ok {
+		entry = &SuspiciousIP{IP: rangeKey, FirstSeen: now}
+		s.entries[rangeKey] = entry
+	}
+	entry.Reason = "range escalation: " + strconv.Itoa(banned) + " banned addresses"
+	entry.Count = banned
+	entry.LastSeen = now
+	ban := s.autoBanLocked(rangeKey, entry, now)
+	entry.addHistory(ScoreEvent{Time: now, Reason: entry.Reason, Ban: ban})
+	return entry
+}
+
+func (e *SuspiciousIP) addHistory(event ScoreEvent) {
+	e.History = append(e.History, event)
+	if len(e.History) > maxScoreHistory {
+		e.History = e.History[len(e.History)-maxScoreHistory:]
+	}
+}
+
+// suspicionKey returns the entry key that collects the score of ip.
+func (s *IPReputationStore) suspicionKey(ip string) string {
+	key, err := ParseBanTarget(ip)
+	if err != nil {
+		return ip
+	}
+	if addr, err := netip.ParseAddr(key); err == nil && s.aggregateIPv6 && addr.Is6() {
+		return netip.PrefixFrom(addr, ipv6RangeBits).Masked().String()
+	}
+	return key
+}
+
+// ParseBanTarget normalizes an IP address or CIDR range to its entry key.
+func ParseBanTarget(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if strings.Contains(raw, "/") {
+		prefix, err := netip.ParsePrefix(raw)
+		if err != nil {
+			return "", fmt.Errorf("invalid CIDR %q", raw)
+		}
+		prefix = prefix.Masked()
+		if prefix.Bits() == prefix.Addr().BitLen() {
+			return prefix.Addr().String(), nil
+		}
+		return prefix.String(), nil
+	}
+	addr, err := netip.ParseAddr(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid IP address %q", raw)
+	}
+	return addr.Unmap().String(), nil
+}
+
+// parseEntryKey returns an entry key as a prefix; single addresses are full
+// length prefixes.
+func parseEntryKey(key string) (netip.Prefix, bool) {
+	if prefix, err := netip.ParsePrefix(key); err == nil {
+		return prefix, true
+	}
+	addr, err := netip.ParseAddr(key)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), true
+}
+
+// escalationRange is the range an entry escalates to: /24 for IPv4, /64 for
+// IPv6 and /48 for aggregated IPv6 /64s.
+func escalationRange(key string) (netip.Prefix, bool) {
+	prefix, ok := parseEntryKey(key)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	switch {
+	case prefix.Addr().Is4() && prefix.Bits() == 32:
+		return netip.PrefixFrom(prefix.Addr(), ipv4RangeBits).Masked(), true
+	case prefix.Addr().Is6() && prefix.Bits() == 128:
+		return netip.PrefixFrom(prefix.Addr(), ipv6RangeBits).Masked(), true
+	case prefix.Addr().Is6() && prefix.Bits() == ipv6RangeBits:
+		return netip.PrefixFrom(prefix.Addr(), ipv6AggregateRangeBits).Masked(), true
+	}
+	return netip.Prefix{}, false
+}
+
+// ReasonWeight returns the points of a suspicious event reason.
+func ReasonWeight(reason string) int {
+	if points, ok := reasonWeights[reason]; ok {
+		return points
+	}
+	return DefaultSuspicionPoints
+}
+
+// BanLength formats an auto-ban length; zero is permanent.
+func BanLength(d time.Duration) string {
+	switch {
+	case d <= 0:
+		return "permanent"
+	case d%(24*time.Hour) == 0:
+		return strconv.Itoa(int(d/(24*time.Hour))) + "d"
+	default:
+		return strings.TrimSuffix(strings.TrimSuffix(d.String(), "0s"), "0m")
+	}
+}
+
+// decayedScore returns the entry's score halved for every scoreHalfLife
+// since it was last scored.
+func (s *IPReputationStore) decayedScore(entry *SuspiciousIP, now time.Time) float64 {
+	if entry.Score <= 0 || entry.ScoredAt.IsZero() || s.scoreHalfLife <= 0 {
+		return entry.Score
+	}
+	elapsed := now.Sub(entry.ScoredAt)
+	if elapsed <= 0 {
+		return entry.Score
+	}
+	return entry.Score * math.Exp2(-elapsed.Seconds()/s.scoreHalfLife.Seconds())
 }
 
+// CheckBan reports why ip, an address or CIDR range, cannot be banned: it is
+// malformed or overlaps the allowlist (an *AllowlistedError).
+func (s *IPReputationStore) CheckBan(ip string) error {
+	key, err := ParseBanTarget(ip)
+	if err != nil {
+		return err
+	}
+	return s.Allowlist.checkAllowed(key)
+}
+
+func (s *IPReputationStore) allowlisted(ip string) bool {
+	if s.Allowlist == nil {
+		return false
+	}
+	_, ok := s.Allowlist.Match(ip)
+	return ok
+}
+
+// Ban bans an IP address or CIDR range until it is unbanned. Allowlisted
+// addresses are refused; see CheckBan.
 func (s *IPReputationStore) Ban(ip string) bool {
-	if ip == "" {
+	if s.CheckBan(ip) != nil {
 		return false
 	}
+	key, _ := ParseBanTarget(ip)
 	now := s.nowFn()
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	entry, ok := s.entries[ip]
+	entry, ok := s.entries[key]
 	if !ok {
-		s.entries[ip] = &SuspiciousIP{IP: ip, Reason: "manual ban", Count: 1, FirstSeen: now, LastSeen: now, Banned: true, BannedAt: now}
-		s.saveLocked()
-		return true
-	}
-	if entry.Banned {
+		entry = &SuspiciousIP{IP: key, Reason: "manual ban", Count: 1, FirstSeen: now, LastSeen: now}
+		s.entries[key] = entry
+	} else if entry.Banned {
 		return false
 	}
 	entry.Banned = true
 	entry.AutoBanned = false
 	entry.BanUntil = time.Time{}
 	entry.BannedAt = now
+	if prefix, err := netip.ParsePrefix(key); err == nil {
+		s.ranges.insert(prefix)
+	}
 	s.saveLocked()
 	return true
 }
 
 func (s *IPReputationStore) Unban(ip string) bool {
-	if ip == "" {
+	key, err := ParseBanTarget(ip)
+	if err != nil {
 		return false
 	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	entry, ok := s.entries[ip]
+	entry, ok := s.entries[key]
 	if !ok || !entry.Banned {
 		return false
 	}
 
-	entry.Banned = false
-	entry.AutoBanned = false
-	entry.BannedAt = time.Time{}
-	entry.BanUntil = time.Time{}
+	s.liftBanLocked(key, entry)
 	s.saveLocked()
 	return true
 }
 
 func (s *IPReputationStore) Remove(ip string) bool {
-	if ip == "" {
+	key, err := ParseBanTarget(ip)
+	if err != nil {
 		return false
 	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if _, ok := s.entries[ip]; !ok {
+	if _, ok := s.entries[key]; !ok {
 		return false
 	}
 
-	delete(s.entries, ip)
+	if prefix, err := netip.ParsePrefix(key); err == nil {
+		s.ranges.remove(prefix)
+	}
+	delete(s.entries, key)
 	s.saveLocked()
 	return true
 }
 
+// IsBanned reports whether ip is banned on its own or by a banned range.
+// Allowlisted addresses are never banned; addresses on an enabled blocklist
+// are banned.
 func (s *IPReputationStore) IsBanned(ip string) bool {
+	key, err := ParseBanTarget(ip)
+	if err != nil || s.allowlisted(key) {
+		return false
+	}
+	if s.bannedEntry(key) {
+		return true
+	}
+	if s.Blocklists == nil {
+		return false
+	}
+	_, ok := s.Blocklists.Match(key)
+	return ok
+}
+
+// HasBan is IsBanned without the external blocklists: it reports only bans
+// stored in ip_reputation.json.
+func (s *IPReputationStore) HasBan(ip string) bool {
+	key, err := ParseBanTarget(ip)
+	if err != nil || s.allowlisted(key) {
+		return false
+	}
+	return s.bannedEntry(key)
+}
+
+// bannedEntry reports whether key or a range containing it is banned in the
+// stored entries.
+func (s *IPReputationStore) bannedEntry(key string) bool {
+	now := s.nowFn()
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	entry, ok := s.entries[ip]
-	if !ok {
+
+	if entry, ok := s.entries[key]; ok && s.activeBanLocked(key, entry, now) {
+		return true
+	}
+	addr, err := netip.ParseAddr(key)
+	if err != nil {
 		return false
 	}
-	if entry.Banned && !entry.BanUntil.IsZero() && s.nowFn().After(entry.BanUntil) {
-		entry.Banned = false
-		entry.AutoBanned = false
-		entry.BannedAt = time.Time{}
-		entry.BanUntil = time.Time{}
+	for _, prefix := range s.ranges.lookup(addr) {
+		rangeKey := prefix.String()
+		if entry, ok := s.entries[rangeKey]; ok && s.activeBanLocked(rangeKey, entry, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// activeBanLocked reports whether entry is banned, lifting an expired ban.
+func (s *IPReputationStore) activeBanLocked(key string, entry *SuspiciousIP, now time.Time) bool {
+	if entry.Banned && !entry.BanUntil.IsZero() && now.After(entry.BanUntil) {
+		s.liftBanLocked(key, entry)
 		s.saveLocked()
 	}
 	return entry.Banned
 }
 
+func (s *IPReputationStore) liftBanLocked(key string, entry *SuspiciousIP) {
+	entry.Banned = false
+	entry.AutoBanned = false
+	entry.BannedAt = time.Time{}
+	entry.BanUntil = time.Time{}
+	if prefix, err := netip.ParsePrefix(key); err == nil {
+		s.ranges.remove(prefix)
+	}
+}
+
+// List returns copies of all entries with their scores decayed to now.
 func (s *IPReputationStore) List() []SuspiciousIP {
+	now := s.nowFn()
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	out := make([]SuspiciousIP, 0, len(s.entries))
 	for _, e := range s.entries {
-		out = append(out, *e)
+		item := *e
+		item.Score = math.Round(s.decayedScore(e, now)*10) / 10
+		item.History = slices.Clone(e.History)
+		out = append(out, item)
 	}
 	sort.Slice(out, func(i, j int) bool {
 		if out[i].Banned != out[j].Banned {
@@ -257,6 +581,23 @@ func envInt(key string, fallback int) int {
 	return v
 }
 
+func envNonNegativeInt(key string, fallback int) int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil || v < 0 {
+		return fallback
+	}
+	return v
+}
+
+func envBool(key string) bool {
+	v, _ := strconv.ParseBool(os.Getenv(key))
+	return v
+}
+
 func envDurationSeconds(key string, fallback time.Duration) time.Duration {
 	raw := os.Getenv(key)
 	if raw == "" {
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -107,8 +108,146 @@ func TestIPReputationStoreAutoBanAndExpire(t *testing.T) {
 		t.Fatalf("expected one auto-banned ip")
 	}
 
-	now = now.Add(25 * time.Hour)
+	now = now.Add(61 * time.Minute)
 	if store.IsBanned("10.20.30.40") {
-		t.Fatalf("expected auto-ban to expire after 24h")
+		t.Fatalf("expected first auto-ban to expire after 1h")
+	}
+}
+
+func TestIPReputationStoreScoreDecays(t *testing.T) {
+	now := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	store := NewIPReputationStore(filepath.Join(t.TempDir(), "ip_reputation.json"))
+	store.nowFn = func() time.Time { return now }
+
+	// Two probes an hour apart never add up to a ban.
+	for i := 0; i < 5; i++ {
+		if banned, _ := store.MarkSuspicious("10.0.0.1", "unknown host"); banned {
+			t.Fatalf("slow probes must decay before reaching the ban score (probe %d)", i)
+		}
+		now = now.Add(time.Hour)
+	}
+	items := store.List()
+	if len(items) != 1 || items[0].Score >= 1 || len(items[0].History) != 5 {
+		t.Fatalf("unexpected decayed entry: %+v", items)
+	}
+
+	if banned, _ := store.AddSuspicion("10.0.0.2", "custom", 60); banned {
+		t.Fatalf("60 points must not ban")
+	}
+	now = now.Add(10 * time.Minute) // one half-life: 30 points left
+	if banned, _ := store.AddSuspicion("10.0.0.2", "custom", 60); banned {
+		t.Fatalf("90 points must not ban")
+	}
+	if banned, _ := store.AddSuspicion("10.0.0.2", "custom", 10); !banned {
+		t.Fatalf("100 points must ban")
+	}
+}
+
+func TestIPReputationStoreEscalatesRepeatOffenders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ip_reputation.json")
+	now := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	store := NewIPReputationStore(path)
+	store.nowFn = func() time.Time { return now }
+
+	for i, want := range []time.Duration{time.Hour, 24 * time.Hour, 7 * 24 * time.Hour, 0, 0} {
+		if i == 4 {
+			// A permanent ban is lifted only by the operator.
+			now = now.Add(365 * 24 * time.Hour)
+			if !store.IsBanned("10.0.0.9") {
+				t.Fatalf("expected permanent ban to stay")
+			}
+			store.Unban("10.0.0.9")
+		}
+		banned, until := store.AddSuspicion("10.0.0.9", "probe", 100)
+		if !banned {
+			t.Fatalf("offence %d: expected auto-ban", i+1)
+		}
+		if want == 0 {
+			if !until.IsZero() {
+				t.Fatalf("offence %d: expected permanent ban, got until %v", i+1, until)
+			}
+			continue
+		}
+		if got := until.Sub(now); got != want {
+			t.Fatalf("offence %d: expected ban for %v, got %v", i+1, want, got)
+		}
+		now = until.Add(time.Second)
+		if store.IsBanned("10.0.0.9") {
+			t.Fatalf("offence %d: expected ban to expire", i+1)
+		}
+	}
+
+	reloaded := NewIPReputationStore(path)
+	items := reloaded.List()
+	if len(items) != 1 || items[0].Offenses != 5 {
+		t.Fatalf("expected offences to persist: %+v", items)
+	}
+	var bans []string
+	for _, event := range items[0].History {
+		bans = append(bans, event.Ban)
+	}
+	if got := strings.Join(bans, ","); got != "1h,1d,7d,permanent,permanent" {
+		t.Fatalf("unexpected ban history: %s", got)
+	}
+}
+
+func TestIPReputationStoreRangeBans(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ip_reputation.json")
+	store := NewIPReputationStore(path)
+
+	if store.Ban("203.0.113.0/33") {
+		t.Fatalf("expected invalid CIDR to be rejected")
+	}
+	if !store.Ban("203.0.113.77/24") {
+		t.Fatalf("expected range ban to succeed")
+	}
+	if !store.IsBanned("203.0.113.5") || store.IsBanned("203.0.114.5") {
+		t.Fatalf("expected only addresses of 203.0.113.0/24 to be banned")
+	}
+	if !store.Ban("2001:db8:aa::/48") || !store.IsBanned("2001:db8:aa:1::1") {
+		t.Fatalf("expected IPv6 range ban to cover its addresses")
+	}
+
+	reloaded := NewIPReputationStore(path)
+	if !reloaded.IsBanned("203.0.113.200") {
+		t.Fatalf("expected range ban to persist")
+	}
+	if !reloaded.Unban("203.0.113.0/24") || reloaded.IsBanned("203.0.113.200") {
+		t.Fatalf("expected range unban to lift the ban")
+	}
+}
+
+func TestIPReputationStoreAggregatesIPv6AndEscalatesRanges(t *testing.T) {
+	t.Setenv("IP_AGGREGATE_IPV6", "true")
+	t.Setenv("IP_RANGE_BAN_HITS", "3")
+	now := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	store := NewIPReputationStore(filepath.Join(t.TempDir(), "ip_reputation.json"))
+	store.nowFn = func() time.Time { return now }
+	var rangeBans []string
+	store.OnRangeBan = func(prefix, reason string, until time.Time) { rangeBans = append(rangeBans, prefix) }
+
+	// Rotating through a /64 still adds up to one score.
+	store.MarkSuspicious("2001:db8:1:2::1", "unknown host")
+	store.MarkSuspicious("2001:db8:1:2::2", "unknown host")
+	if banned, _ := store.MarkSuspicious("2001:db8:1:2::3", "unknown host"); !banned {
+		t.Fatalf("expected the /64 to be banned")
+	}
+	if !store.IsBanned("2001:db8:1:2::ffff") || store.IsBanned("2001:db8:1:3::1") {
+		t.Fatalf("expected the ban to cover exactly the /64")
+	}
+
+	// Three banned IPv4 addresses of one /24 ban the whole /24.
+	for _, ip := range []string{"198.51.100.1", "198.51.100.2", "198.51.100.3"} {
+		store.AddSuspicion(ip, "probe", 100)
+	}
+	if len(rangeBans) != 1 || rangeBans[0] != "198.51.100.0/24" {
+		t.Fatalf("expected a /24 range ban, got %v", rangeBans)
+	}
+	if !store.IsBanned("198.51.100.250") {
+		t.Fatalf("expected the escalated range to be banned")
+	}
+	now = now.Add(2 * time.Hour)
+	if store.IsBanned("198.51.100.250") {
+		t.Fatalf("expected the first range auto-ban to expire after 1h")
 	}
 }
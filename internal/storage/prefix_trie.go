@@ -0,0 +1,83 @@
+package storage
+
+import "net/netip"
+
+// prefixTrie is a binary trie of IP prefixes with separate IPv4 and IPv6
+// roots. Lookups walk at most 32 or 128 nodes regardless of how many
+// prefixes are stored.
+type prefixTrie struct {
+	v4, v6 *trieNode
+}
+
+type trieNode struct {
+	child  [2]*trieNode
+	prefix netip.Prefix
+	set    bool
+}
+
+func (t *prefixTrie) root(addr netip.Addr, create bool) **trieNode {
+	if addr.Is4() {
+		if t.v4 == nil && create {
+			t.v4 = &trieNode{}
+		}
+		return &t.v4
+	}
+	if t.v6 == nil && create {
+		t.v6 = &trieNode{}
+	}
+	return &t.v6
+}
+
+// insert adds a masked prefix.
+func (t *prefixTrie) insert(prefix netip.Prefix) {
+	prefix = prefix.Masked()
+	node := *t.root(prefix.Addr(), true)
+	for i := 0; i < prefix.Bits(); i++ {
+		b := addrBit(prefix.Addr(), i)
+		if node.child[b] == nil {
+			node.child[b] = &trieNode{}
+		}
+		node = node.child[b]
+	}
+	node.prefix = prefix
+	node.set = true
+}
+
+// remove deletes a masked prefix; empty branches are left in place, they
+// are cheap and get reused.
+func (t *prefixTrie) remove(prefix netip.Prefix) {
+	prefix = prefix.Masked()
+	node := *t.root(prefix.Addr(), false)
+	for i := 0; node != nil && i < prefix.Bits(); i++ {
+		node = node.child[addrBit(prefix.Addr(), i)]
+	}
+	if node != nil {
+		node.set = false
+		node.prefix = netip.Prefix{}
+	}
+}
+
+// lookup returns every stored prefix that contains addr, shortest first.
+func (t *prefixTrie) lookup(addr netip.Addr) []netip.Prefix {
+	addr = addr.Unmap()
+	node := *t.root(addr, false)
+	var out []netip.Prefix
+	for i := 0; node != nil; i++ {
+		if node.set {
+			out = append(out, node.prefix)
+		}
+		if i == addr.BitLen() {
+			break
+		}
+		node = node.child[addrBit(addr, i)]
+	}
+	return out
+}
+
+func addrBit(addr netip.Addr, i int) int {
+	b := addr.As16()
+	if addr.Is4() {
+		i += 96
+	}
+	return int(b[i/8]>>(7-i%8)) & 1
+}
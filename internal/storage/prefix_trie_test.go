@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestPrefixTrieLookup(t *testing.T) {
+	var trie prefixTrie
+	for _, raw := range []string{"10.0.0.0/8", "10.1.2.0/24", "2001:db8::/32", "2001:db8:1:2::/64", "0.0.0.0/0"} {
+		trie.insert(netip.MustParsePrefix(raw))
+	}
+
+	cases := map[string][]string{
+		"10.1.2.3":            {"0.0.0.0/0", "10.0.0.0/8", "10.1.2.0/24"},
+		"10.9.9.9":            {"0.0.0.0/0", "10.0.0.0/8"},
+		"192.0.2.1":           {"0.0.0.0/0"},
+		"::ffff:10.1.2.3":     {"0.0.0.0/0", "10.0.0.0/8", "10.1.2.0/24"},
+		"2001:db8:1:2::5":     {"2001:db8::/32", "2001:db8:1:2::/64"},
+		"2001:db9::1":         nil,
+		"2001:db8:ffff::abcd": {"2001:db8::/32"},
+	}
+	for addr, want := range cases {
+		got := trie.lookup(netip.MustParseAddr(addr))
+		if len(got) != len(want) {
+			t.Fatalf("%s: got %v, want %v", addr, got, want)
+		}
+		for i := range want {
+			if got[i].String() != want[i] {
+				t.Fatalf("%s: got %v, want %v", addr, got, want)
+			}
+		}
+	}
+
+	trie.remove(netip.MustParsePrefix("10.0.0.0/8"))
+	trie.remove(netip.MustParsePrefix("0.0.0.0/0"))
+	if got := trie.lookup(netip.MustParseAddr("10.9.9.9")); len(got) != 0 {
+		t.Fatalf("expected removed prefixes not to match, got %v", got)
+	}
+	if got := trie.lookup(netip.MustParseAddr("10.1.2.3")); len(got) != 1 {
+		t.Fatalf("expected the /24 to remain, got %v", got)
+	}
+}
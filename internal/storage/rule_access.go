@@ -0,0 +1,422 @@
+package storage
+
+import (
+	"fmt"
+	"net/netip"
+	"net/textproto"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Access policy modes for combining network and password checks.
+const (
+	SatisfyAll = "all" // the client must pass both the network lists and basic auth
+	SatisfyAny = "any" // an allowed network or country skips basic auth
+)
+
+// AccessPolicy restricts who may reach a rule. Deny lists always win; a
+// non-empty allow list admits only matching clients. Countries are ISO codes
+// as reported by the country lookup ("LOCAL" for private addresses).
+type AccessPolicy struct {
+	AllowCIDRs     []string   `json:"allowCidrs,omitempty"`
+	DenyCIDRs      []string   `json:"denyCidrs,omitempty"`
+	AllowCountries []string   `json:"allowCountries,omitempty"`
+	DenyCountries  []string   `json:"denyCountries,omitempty"`
+	BasicAuth      *BasicAuth `json:"basicAuth,omitempty"`
+	// Satisfy is "all" (default) or "any"; with "any" clients from the allow
+	// lists are let in without a password and everyone else must log in.
+	Satisfy string `json:"satisfy,omitempty"`
+}
+
+// BasicAuth asks for HTTP basic credentials checked against bcrypt hashes.
+type BasicAuth struct {
+	Realm string          `json:"realm,omitempty"`
+	Users []BasicAuthUser `json:"users"`
+}
+
+// BasicAuthUser is one login. Password is accepted from the panel, hashed
+// into PasswordHash on validation and never stored.
+type BasicAuthUser struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"passwordHash,omitempty"`
+	Password     string `json:"password,omitempty"`
+}
+
+// ForwardAuthPolicy delegates authentication to an external service, like
+// nginx auth_request: every request is first sent to URL with its method and
+// headers (no body) and the original URI in X-Forwarded-Uri. A 2xx answer
+// lets the request through, 401 and 403 are returned to the client.
+type ForwardAuthPolicy struct {
+	URL string `json:"url"`
+	// CopyHeaders are copied from the auth response to the upstream request,
+	// e.g. X-User; clients cannot set them themselves.
+	CopyHeaders []string `json:"copyHeaders,omitempty"`
+	TimeoutSec  int      `json:"timeoutSec,omitempty"` // 5 seconds when zero
+}
+
+// Defaults of OIDCPolicy.
+const (
+	DefaultOIDCCallbackPath = "/oauth2/callback"
+	DefaultOIDCGroupsClaim  = "groups"
+	DefaultOIDCSessionSec   = 8 * 3600
+)
+
+// OIDCPolicy puts a rule behind OpenID Connect login (authorization code
+// flow). Unauthenticated browsers are redirected to Issuer; after login the
+// ID token is verified against the issuer's JWKS and the user is kept in an
+// encrypted session cookie. The email, subject and groups are passed to the
+// upstream as X-Auth-Request-Email, X-Auth-Request-User and
+// X-Auth-Request-Groups.
+type OIDCPolicy struct {
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"clientId"`
+	ClientSecret string   `json:"clientSecret"`
+	Scopes       []string `json:"scopes,omitempty"`       // "openid email profile" when empty
+	CallbackPath string   `json:"callbackPath,omitempty"` // "/oauth2/callback" when empty
+	// AllowedDomains and AllowedGroups restrict who may log in; anyone with a
+	// verified account at the issuer when both are empty.
+	AllowedDomains []string `json:"allowedDomains,omitempty"`
+	AllowedGroups  []string `json:"allowedGroups,omitempty"`
+	GroupsClaim    string   `json:"groupsClaim,omitempty"`   // "groups" when empty
+	SessionTTLSec  int      `json:"sessionTtlSec,omitempty"` // 8 hours when zero
+}
+
+// JWTPolicy requires a valid bearer JWT on every request. Keys come from
+// JWKSURL or KeyFile (a JWKS document, PEM public keys, or a shared HMAC
+// secret). RequiredClaims entries are a claim name, which must be present, or
+// "name=value", which must match (or be contained in an array claim).
+type JWTPolicy struct {
+	Algorithms     []string      `json:"algorithms,omitempty"` // HS256, RS256 and ES256 when empty
+	JWKSURL        string        `json:"jwksUrl,omitempty"`
+	KeyFile        string        `json:"keyFile,omitempty"`
+	Issuer         string        `json:"issuer,omitempty"`
+	Audiences      []string      `json:"audiences,omitempty"`
+	RequiredClaims []string      `json:"requiredClaims,omitempty"`
+	ClaimHeaders   []ClaimHeader `json:"claimHeaders,omitempty"`
+	LeewaySec      int           `json:"leewaySec,omitempty"` // allowed clock skew for exp/nbf
+	// AllowMissingExp accepts tokens without an exp claim, which never
+	// expire; by default they are rejected.
+	AllowMissingExp bool `json:"allowMissingExp,omitempty"`
+}
+
+// ClaimHeader copies a token claim to an upstream request header. Array
+// claims are joined with commas.
+type ClaimHeader struct {
+	Claim  string `json:"claim"`
+	Header string `json:"header"`
+}
+
+// DefaultJWTAlgorithms are accepted when a JWT policy lists none.
+var DefaultJWTAlgorithms = []string{"HS256", "RS256", "ES256"}
+
+var jwtAlgorithms = []string{"HS256", "HS384", "HS512", "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+func validateAccess(rule *Rule) error {
+	policy := rule.Access
+	if policy == nil {
+		return nil
+	}
+	var err error
+	if policy.AllowCIDRs, err = normalizeCIDRs(policy.AllowCIDRs); err != nil {
+		return err
+	}
+	if policy.DenyCIDRs, err = normalizeCIDRs(policy.DenyCIDRs); err != nil {
+		return err
+	}
+	if policy.AllowCountries, err = normalizeCountries(policy.AllowCountries); err != nil {
+		return err
+	}
+	if policy.DenyCountries, err = normalizeCountries(policy.DenyCountries); err != nil {
+		return err
+	}
+	if err := validateBasicAuth(policy); err != nil {
+		return err
+	}
+	policy.Satisfy = strings.ToLower(strings.TrimSpace(policy.Satisfy))
+	switch policy.Satisfy {
+	case "", SatisfyAll:
+		policy.Satisfy = ""
+	case SatisfyAny:
+		if policy.BasicAuth == nil || len(policy.AllowCIDRs)+len(policy.AllowCountries) == 0 {
+			return fmt.Errorf(`satisfy "any" needs basic auth and an allow list`)
+		}
+	default:
+		return fmt.Errorf("unsupported satisfy mode %q", policy.Satisfy)
+	}
+	if len(policy.AllowCIDRs)+len(policy.DenyCIDRs)+len(policy.AllowCountries)+len(policy.DenyCountries) == 0 && policy.BasicAuth == nil {
+		rule.Access = nil
+	}
+	return nil
+}
+
+// normalizeCIDRs turns bare addresses into single-host prefixes and masks
+// host bits, so that the proxy can parse the list without surprises.
+func normalizeCIDRs(list []string) ([]string, error) {
+	var out []string
+	for _, raw := range list {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		prefix, err := parsePrefix(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", raw)
+		}
+		out = append(out, prefix.String())
+	}
+	return out, nil
+}
+
+// parsePrefix parses a CIDR or a single address into a masked prefix.
+func parsePrefix(raw string) (netip.Prefix, error) {
+	if !strings.Contains(raw, "/") {
+		addr, err := netip.ParseAddr(raw)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(raw)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if prefix.Addr().Is4In6() {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked(), nil
+}
+
+func normalizeCountries(list []string) ([]string, error) {
+	var out []string
+	for _, raw := range list {
+		code := strings.ToUpper(strings.TrimSpace(raw))
+		if code == "" {
+			continue
+		}
+		if code != "LOCAL" && (len(code) != 2 || code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z') {
+			return nil, fmt.Errorf("invalid country code %q", raw)
+		}
+		out = append(out, code)
+	}
+	return out, nil
+}
+
+func validateBasicAuth(policy *AccessPolicy) error {
+	auth := policy.BasicAuth
+	if auth == nil {
+		return nil
+	}
+	auth.Realm = strings.TrimSpace(auth.Realm)
+	if strings.ContainsAny(auth.Realm, "\"\r\n") {
+		return fmt.Errorf("invalid basic auth realm %q", auth.Realm)
+	}
+	users := auth.Users[:0]
+	seen := make(map[string]bool)
+	for _, user := range auth.Users {
+		user.Username = strings.TrimSpace(user.Username)
+		if user.Username == "" && user.Password == "" {
+			continue
+		}
+		if user.Username == "" || strings.Contains(user.Username, ":") {
+			return fmt.Errorf("invalid basic auth username %q", user.Username)
+		}
+		if seen[user.Username] {
+			return fmt.Errorf("duplicate basic auth user %q", user.Username)
+		}
+		seen[user.Username] = true
+		if user.Password != "" {
+			hash, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+			if err != nil {
+				return fmt.Errorf("hash password of %q: %w", user.Username, err)
+			}
+			user.PasswordHash = string(hash)
+			user.Password = ""
+		}
+		if _, err := bcrypt.Cost([]byte(user.PasswordHash)); err != nil {
+			return fmt.Errorf("basic auth user %q needs a password", user.Username)
+		}
+		users = append(users, user)
+	}
+	if len(users) == 0 {
+		policy.BasicAuth = nil
+		return nil
+	}
+	auth.Users = users
+	return nil
+}
+
+func validateForwardAuth(rule *Rule) error {
+	policy := rule.ForwardAuth
+	if policy == nil {
+		return nil
+	}
+	policy.URL = strings.TrimSpace(policy.URL)
+	if policy.URL == "" {
+		rule.ForwardAuth = nil
+		return nil
+	}
+	u, err := url.Parse(policy.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("forward auth URL must be an absolute http(s) URL")
+	}
+	if policy.TimeoutSec < 0 || policy.TimeoutSec > 60 {
+		return fmt.Errorf("forward auth timeout must be between 0 and 60 seconds")
+	}
+	headers := policy.CopyHeaders[:0]
+	for _, name := range policy.CopyHeaders {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if strings.ContainsAny(name, " :\r\n") {
+			return fmt.Errorf("invalid forward auth header %q", name)
+		}
+		headers = append(headers, textproto.CanonicalMIMEHeaderKey(name))
+	}
+	policy.CopyHeaders = headers
+	return nil
+}
+
+func validateOIDC(rule *Rule) error {
+	policy := rule.OIDC
+	if policy == nil {
+		return nil
+	}
+	policy.Issuer = strings.TrimRight(strings.TrimSpace(policy.Issuer), "/")
+	policy.ClientID = strings.TrimSpace(policy.ClientID)
+	policy.ClientSecret = strings.TrimSpace(policy.ClientSecret)
+	if policy.Issuer == "" && policy.ClientID == "" {
+		rule.OIDC = nil
+		return nil
+	}
+	u, err := url.Parse(policy.Issuer)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("OIDC issuer must be an absolute http(s) URL")
+	}
+	if policy.ClientID == "" || policy.ClientSecret == "" {
+		return fmt.Errorf("OIDC client ID and secret are required")
+	}
+	policy.CallbackPath = strings.TrimSpace(policy.CallbackPath)
+	if policy.CallbackPath == "" {
+		policy.CallbackPath = DefaultOIDCCallbackPath
+	}
+	if !strings.HasPrefix(policy.CallbackPath, "/") || strings.ContainsAny(policy.CallbackPath, "?# ") {
+		return fmt.Errorf("invalid OIDC callback path %q", policy.CallbackPath)
+	}
+	scopes := []string{"openid"}
+	for _, scope := range policy.Scopes {
+		for _, item := range strings.Fields(scope) {
+			if item != "openid" {
+				scopes = append(scopes, item)
+			}
+		}
+	}
+	if len(scopes) == 1 {
+		scopes = append(scopes, "email", "profile")
+	}
+	policy.Scopes = scopes
+	domains := policy.AllowedDomains[:0]
+	for _, domain := range policy.AllowedDomains {
+		if domain = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "@")); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	policy.AllowedDomains = domains
+	groups := policy.AllowedGroups[:0]
+	for _, group := range policy.AllowedGroups {
+		if group = strings.TrimSpace(group); group != "" {
+			groups = append(groups, group)
+		}
+	}
+	policy.AllowedGroups = groups
+	policy.GroupsClaim = strings.TrimSpace(policy.GroupsClaim)
+	if policy.GroupsClaim == "" {
+		policy.GroupsClaim = DefaultOIDCGroupsClaim
+	}
+	if policy.SessionTTLSec < 0 || policy.SessionTTLSec > 30*24*3600 {
+		return fmt.Errorf("OIDC session TTL must be between 0 and 30 days")
+	}
+	if policy.SessionTTLSec == 0 {
+		policy.SessionTTLSec = DefaultOIDCSessionSec
+	}
+	return nil
+}
+
+func validateJWT(rule *Rule) error {
+	policy := rule.JWT
+	if policy == nil {
+		return nil
+	}
+	policy.JWKSURL = strings.TrimSpace(policy.JWKSURL)
+	policy.KeyFile = strings.TrimSpace(policy.KeyFile)
+	if policy.JWKSURL == "" && policy.KeyFile == "" {
+		return fmt.Errorf("JWT needs a JWKS URL or a key file")
+	}
+	if policy.JWKSURL != "" && policy.KeyFile != "" {
+		return fmt.Errorf("JWT keys come either from a JWKS URL or from a key file")
+	}
+	if policy.JWKSURL != "" {
+		u, err := url.Parse(policy.JWKSURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("JWKS URL must be an absolute http(s) URL")
+		}
+	}
+	if policy.KeyFile != "" {
+		if _, err := os.Stat(policy.KeyFile); err != nil {
+			return fmt.Errorf("JWT key file: %w", err)
+		}
+	}
+	algs := policy.Algorithms[:0]
+	for _, alg := range policy.Algorithms {
+		alg = strings.ToUpper(strings.TrimSpace(alg))
+		if alg == "" {
+			continue
+		}
+		if !slices.Contains(jwtAlgorithms, alg) {
+			return fmt.Errorf("unsupported JWT algorithm %q", alg)
+		}
+		algs = append(algs, alg)
+	}
+	policy.Algorithms = algs
+	policy.Issuer = strings.TrimSpace(policy.Issuer)
+	policy.Audiences = trimList(policy.Audiences)
+	policy.RequiredClaims = trimList(policy.RequiredClaims)
+	for _, claim := range policy.RequiredClaims {
+		if strings.HasPrefix(claim, "=") {
+			return fmt.Errorf("invalid required claim %q", claim)
+		}
+	}
+	headers := policy.ClaimHeaders[:0]
+	for _, ch := range policy.ClaimHeaders {
+		ch.Claim = strings.TrimSpace(ch.Claim)
+		ch.Header = strings.TrimSpace(ch.Header)
+		if ch.Claim == "" && ch.Header == "" {
+			continue
+		}
+		if ch.Claim == "" || ch.Header == "" || strings.ContainsAny(ch.Header, " :\r\n") {
+			return fmt.Errorf("invalid claim header mapping %q -> %q", ch.Claim, ch.Header)
+		}
+		ch.Header = textproto.CanonicalMIMEHeaderKey(ch.Header)
+		headers = append(headers, ch)
+	}
+	policy.ClaimHeaders = headers
+	if policy.LeewaySec < 0 || policy.LeewaySec > 600 {
+		return fmt.Errorf("JWT leeway must be between 0 and 600 seconds")
+	}
+	return nil
+}
+
+func trimList(list []string) []string {
+	out := list[:0]
+	for _, item := range list {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,570 @@
+package storage
+
+import (
+	"fmt"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Header operation actions.
+const (
+	HeaderSet     = "set"
+	HeaderAppend  = "append"
+	HeaderDelete  = "delete"
+	HeaderReplace = "replace"
+)
+
+// HeaderOp is one header rewrite step. Value may contain the templates
+// {client_ip}, {country}, {request_id} and {host}. For "replace" Pattern is a
+// regular expression applied to every existing value and Value is the
+// replacement ($1 refers to capture groups).
+type HeaderOp struct {
+	Action  string `json:"action"`
+	Name    string `json:"name"`
+	Value   string `json:"value,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// RedirectPolicy turns a rule into a redirect, e.g. www.example.com ->
+// https://example.com with the path kept.
+type RedirectPolicy struct {
+	To            string `json:"to"`   // absolute URL prefix, e.g. "https://example.com"
+	Code          int    `json:"code"` // 301, 302, 303, 307 or 308; 301 when zero
+	PreservePath  bool   `json:"preservePath,omitempty"`
+	PreserveQuery bool   `json:"preserveQuery,omitempty"`
+}
+
+// StaticPolicy serves a local build directory, e.g. a single page application.
+type StaticPolicy struct {
+	Root    string `json:"root"`
+	SPA     bool   `json:"spa,omitempty"`     // serve index.html for unknown page routes
+	Listing bool   `json:"listing,omitempty"` // directory listing, off by default
+	// CacheControl applies to assets, HTMLCacheControl to HTML pages ("no-cache" when empty).
+	CacheControl     string `json:"cacheControl,omitempty"`
+	HTMLCacheControl string `json:"htmlCacheControl,omitempty"`
+}
+
+// CompressionPolicy enables on-the-fly response compression.
+type CompressionPolicy struct {
+	Enabled bool `json:"enabled"`
+	// Encodings in order of preference: "br", "zstd", "gzip". All three when empty.
+	Encodings []string `json:"encodings,omitempty"`
+	// ContentTypes are media type prefixes worth compressing; a text/JSON/JS/SVG list when empty.
+	ContentTypes []string `json:"contentTypes,omitempty"`
+	// MinSize skips smaller responses; 1024 bytes when zero.
+	MinSize int `json:"minSize,omitempty"`
+}
+
+// CachePolicy enables the response cache. Upstream Cache-Control and Expires
+// take precedence; the durations here only fill in what the upstream omits.
+type CachePolicy struct {
+	Enabled bool `json:"enabled"`
+	// DefaultTTLSec applies to responses without freshness information; they are not cached when zero.
+	DefaultTTLSec int `json:"defaultTtlSec,omitempty"`
+	// StaleWhileRevalidateSec serves stale entries while one request refreshes them.
+	StaleWhileRevalidateSec int `json:"staleWhileRevalidateSec,omitempty"`
+	// StaleIfErrorSec serves stale entries when the upstream fails or the service is down.
+	StaleIfErrorSec int `json:"staleIfErrorSec,omitempty"`
+}
+
+// RetryPolicy re-sends a failed upstream request. Only idempotent methods
+// (GET, HEAD, OPTIONS, TRACE, PUT, DELETE) and requests carrying an
+// Idempotency-Key header are retried unless NonIdempotent is set.
+type RetryPolicy struct {
+	MaxAttempts int `json:"maxAttempts"` // including the first one; retries are off below 2
+	// BackoffMs is the pause before the first retry; it doubles with every attempt.
+	BackoffMs      int   `json:"backoffMs,omitempty"`
+	OnConnectError bool  `json:"onConnectError,omitempty"` // dial errors and connection resets
+	OnStatus       []int `json:"onStatus,omitempty"`       // e.g. 502, 503, 504
+	NonIdempotent  bool  `json:"nonIdempotent,omitempty"`
+}
+
+// MirrorPolicy sends a copy of Percent of the requests to Target. Requests
+// with a body larger than MaxBodyBytes (1 MB when zero) are not mirrored.
+type MirrorPolicy struct {
+	Target       string `json:"target"`
+	Percent      int    `json:"percent"`
+	MaxBodyBytes int64  `json:"maxBodyBytes,omitempty"`
+}
+
+// CanaryVariant is one version of the upstream. An empty Target means the
+// rule's own Target/Targets.
+type CanaryVariant struct {
+	Name   string `json:"name"`
+	Target string `json:"target,omitempty"`
+	Weight int    `json:"weight"`
+}
+
+// CanaryPolicy splits requests between variants by weight. A request can be
+// pinned to a variant by name through Header, Cookie or Query; with Sticky the
+// chosen variant is remembered in StickyCookie ("router_variant" when empty).
+type CanaryPolicy struct {
+	Variants     []CanaryVariant `json:"variants"`
+	Header       string          `json:"header,omitempty"`
+	Cookie       string          `json:"cookie,omitempty"`
+	Query        string          `json:"query,omitempty"`
+	Sticky       bool            `json:"sticky,omitempty"`
+	StickyCookie string          `json:"stickyCookie,omitempty"`
+	StickyTTLSec int             `json:"stickyTtlSec,omitempty"` // session cookie when zero
+}
+
+// CORSPolicy makes the router answer CORS preflight requests and add CORS
+// headers to responses. AllowedOrigins entries are "*", an exact origin
+// ("https://app.example.com") or a subdomain wildcard
+// ("https://*.example.com"). AllowedHeaders empty or "*" accepts whatever
+// the preflight asks for.
+type CORSPolicy struct {
+	AllowedOrigins   []string `json:"allowedOrigins"`
+	AllowedMethods   []string `json:"allowedMethods,omitempty"` // GET, HEAD, POST, PUT, PATCH, DELETE when empty
+	AllowedHeaders   []string `json:"allowedHeaders,omitempty"`
+	ExposedHeaders   []string `json:"exposedHeaders,omitempty"`
+	AllowCredentials bool     `json:"allowCredentials,omitempty"`
+	MaxAgeSec        int      `json:"maxAgeSec,omitempty"`
+	// StripUpstream drops CORS headers set by the upstream; otherwise the
+	// upstream's headers win where it sets them.
+	StripUpstream bool `json:"stripUpstream,omitempty"`
+}
+
+// DefaultCORSMethods are allowed when a CORS policy lists none.
+var DefaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// PathRewrite rewrites the request path with a regular expression. Replacement
+// may use capture groups ($1) and may carry a query string ("/search?q=$1").
+// A non-zero Redirect code sends the rewritten URL to the client instead.
+type PathRewrite struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+	Redirect    int    `json:"redirect,omitempty"`
+}
+
+// QueryOp changes one query parameter. Actions are "set", "append" and "delete",
+// as for headers.
+type QueryOp struct {
+	Action string `json:"action"`
+	Name   string `json:"name"`
+	Value  string `json:"value,omitempty"`
+}
+
+// ValidateRule normalizes user supplied rule settings and rejects invalid ones.
+func ValidateRule(rule *Rule) error {
+	rule.Target = strings.TrimSpace(rule.Target)
+	if err := validateTargets(rule); err != nil {
+		return err
+	}
+	if err := validateRetry(rule); err != nil {
+		return err
+	}
+	if err := validateMirror(rule); err != nil {
+		return err
+	}
+	if err := validateCanary(rule); err != nil {
+		return err
+	}
+	if err := validateAccess(rule); err != nil {
+		return err
+	}
+	if err := validateForwardAuth(rule); err != nil {
+		return err
+	}
+	if err := validateOIDC(rule); err != nil {
+		return err
+	}
+	if err := validateJWT(rule); err != nil {
+		return err
+	}
+	if err := validateRedirect(rule); err != nil {
+		return err
+	}
+	if err := validateStatic(rule); err != nil {
+		return err
+	}
+	if rule.Target == "" && rule.Redirect == nil && rule.Static == nil {
+		return fmt.Errorf("target is required")
+	}
+	rule.ProxyProtocol = strings.ToLower(strings.TrimSpace(rule.ProxyProtocol))
+	if rule.ProxyProtocol != "" && rule.ProxyProtocol != "v1" && rule.ProxyProtocol != "v2" {
+		return fmt.Errorf("unsupported PROXY protocol version %q", rule.ProxyProtocol)
+	}
+	if rule.MaxConnections < 0 || rule.IdleTimeoutSec < 0 || rule.MaxLifetimeSec < 0 {
+		return fmt.Errorf("connection limits must not be negative")
+	}
+	if rule.MaxBodyBytes < 0 || rule.ResponseHeaderTimeoutSec < 0 || rule.RequestTimeoutSec < 0 {
+		return fmt.Errorf("request limits must not be negative")
+	}
+	if err := validateHeaderOps("request", rule.RequestHeaders); err != nil {
+		return err
+	}
+	if err := validateHeaderOps("response", rule.ResponseHeaders); err != nil {
+		return err
+	}
+	if err := validateCORS(rule); err != nil {
+		return err
+	}
+	if err := validateCompression(rule); err != nil {
+		return err
+	}
+	if err := validateCache(rule); err != nil {
+		return err
+	}
+	if err := validateRewrites(rule.Rewrites); err != nil {
+		return err
+	}
+	return validateQueryOps(rule.Query)
+}
+
+func validateTargets(rule *Rule) error {
+	seen := map[string]bool{rule.Target: true}
+	targets := rule.Targets[:0]
+	for _, target := range rule.Targets {
+		target = strings.TrimSpace(target)
+		if target == "" || seen[target] {
+			continue
+		}
+		seen[target] = true
+		targets = append(targets, target)
+	}
+	if len(targets) > 0 && rule.Target == "" {
+		return fmt.Errorf("additional targets require a primary target")
+	}
+	rule.Targets = targets
+	return nil
+}
+
+func validateRetry(rule *Rule) error {
+	if rule.Retry == nil {
+		return nil
+	}
+	policy := rule.Retry
+	if policy.MaxAttempts < 2 {
+		rule.Retry = nil
+		return nil
+	}
+	if policy.MaxAttempts > 10 {
+		return fmt.Errorf("retry max attempts must not exceed 10")
+	}
+	if policy.BackoffMs < 0 || policy.BackoffMs > 10000 {
+		return fmt.Errorf("retry backoff must be between 0 and 10000 ms")
+	}
+	for _, code := range policy.OnStatus {
+		if code < 400 || code > 599 {
+			return fmt.Errorf("retry status %d is not an error status", code)
+		}
+	}
+	if !policy.OnConnectError && len(policy.OnStatus) == 0 {
+		return fmt.Errorf("retry needs a connect error or status condition")
+	}
+	return nil
+}
+
+func validateMirror(rule *Rule) error {
+	if rule.Mirror == nil {
+		return nil
+	}
+	policy := rule.Mirror
+	policy.Target = strings.TrimSpace(policy.Target)
+	if policy.Target == "" || policy.Percent == 0 {
+		rule.Mirror = nil
+		return nil
+	}
+	if policy.Percent < 0 || policy.Percent > 100 {
+		return fmt.Errorf("mirror percent must be between 1 and 100")
+	}
+	if policy.MaxBodyBytes < 0 {
+		return fmt.Errorf("mirror body limit must not be negative")
+	}
+	if policy.Target == rule.Target {
+		return fmt.Errorf("mirror target must differ from the primary target")
+	}
+	return nil
+}
+
+func validateCanary(rule *Rule) error {
+	if rule.Canary == nil {
+		return nil
+	}
+	policy := rule.Canary
+	variants := policy.Variants[:0]
+	seen := make(map[string]bool)
+	total := 0
+	for _, variant := range policy.Variants {
+		variant.Name = strings.TrimSpace(variant.Name)
+		variant.Target = strings.TrimSpace(variant.Target)
+		if variant.Name == "" && variant.Target == "" {
+			continue
+		}
+		if variant.Name == "" || strings.ContainsAny(variant.Name, " ;,=\"") {
+			return fmt.Errorf("invalid canary variant name %q", variant.Name)
+		}
+		if seen[variant.Name] {
+			return fmt.Errorf("duplicate canary variant %q", variant.Name)
+		}
+		if variant.Weight < 0 {
+			return fmt.Errorf("canary weight of %q must not be negative", variant.Name)
+		}
+		if variant.Target == "" && rule.Target == "" {
+			return fmt.Errorf("canary variant %q needs a target", variant.Name)
+		}
+		seen[variant.Name] = true
+		total += variant.Weight
+		variants = append(variants, variant)
+	}
+	if len(variants) == 0 {
+		rule.Canary = nil
+		return nil
+	}
+	if total == 0 {
+		return fmt.Errorf("at least one canary variant needs a positive weight")
+	}
+	policy.Variants = variants
+	policy.Header = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(policy.Header))
+	policy.Cookie = strings.TrimSpace(policy.Cookie)
+	policy.Query = strings.TrimSpace(policy.Query)
+	policy.StickyCookie = strings.TrimSpace(policy.StickyCookie)
+	if policy.StickyTTLSec < 0 {
+		return fmt.Errorf("sticky cookie TTL must not be negative")
+	}
+	return nil
+}
+
+func validRedirectCode(code int) bool {
+	switch code {
+	case 301, 302, 303, 307, 308:
+		return true
+	}
+	return false
+}
+
+func validateRedirect(rule *Rule) error {
+	if rule.Redirect == nil {
+		return nil
+	}
+	redirect := rule.Redirect
+	redirect.To = strings.TrimRight(strings.TrimSpace(redirect.To), "/")
+	if redirect.To == "" {
+		rule.Redirect = nil
+		return nil
+	}
+	u, err := url.Parse(redirect.To)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("redirect target %q must be an absolute http(s) URL", redirect.To)
+	}
+	if redirect.Code == 0 {
+		redirect.Code = 301
+	}
+	if !validRedirectCode(redirect.Code) {
+		return fmt.Errorf("unsupported redirect code %d", redirect.Code)
+	}
+	return nil
+}
+
+func validateStatic(rule *Rule) error {
+	if rule.Static == nil {
+		return nil
+	}
+	static := rule.Static
+	static.Root = strings.TrimSpace(static.Root)
+	if static.Root == "" {
+		rule.Static = nil
+		return nil
+	}
+	if !filepath.IsAbs(static.Root) {
+		return fmt.Errorf("static root %q must be an absolute path", static.Root)
+	}
+	static.Root = filepath.Clean(static.Root)
+	if info, err := os.Stat(static.Root); err != nil || !info.IsDir() {
+		return fmt.Errorf("static root %q is not a directory", static.Root)
+	}
+	static.CacheControl = strings.TrimSpace(static.CacheControl)
+	static.HTMLCacheControl = strings.TrimSpace(static.HTMLCacheControl)
+	if strings.ContainsAny(static.CacheControl+static.HTMLCacheControl, "\r\n") {
+		return fmt.Errorf("cache-control must not contain line breaks")
+	}
+	return nil
+}
+
+func validateCache(rule *Rule) error {
+	if rule.Cache == nil {
+		return nil
+	}
+	policy := rule.Cache
+	if !policy.Enabled {
+		rule.Cache = nil
+		return nil
+	}
+	if policy.DefaultTTLSec < 0 || policy.StaleWhileRevalidateSec < 0 || policy.StaleIfErrorSec < 0 {
+		return fmt.Errorf("cache durations must not be negative")
+	}
+	// Session-based auth makes responses per user while the cache key is not.
+	if rule.OIDC != nil || rule.ForwardAuth != nil {
+		return fmt.Errorf("cache cannot be combined with OIDC or forward auth")
+	}
+	return nil
+}
+
+func validateCORS(rule *Rule) error {
+	policy := rule.CORS
+	if policy == nil {
+		return nil
+	}
+	origins := policy.AllowedOrigins[:0]
+	for _, origin := range policy.AllowedOrigins {
+		origin = strings.TrimRight(strings.ToLower(strings.TrimSpace(origin)), "/")
+		if origin == "" {
+			continue
+		}
+		if origin != "*" {
+			u, err := url.Parse(strings.Replace(origin, "://*.", "://wildcard.", 1))
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || strings.Contains(u.Host, "*") {
+				return fmt.Errorf("invalid CORS origin %q", origin)
+			}
+		}
+		origins = append(origins, origin)
+	}
+	if len(origins) == 0 {
+		rule.CORS = nil
+		return nil
+	}
+	if policy.AllowCredentials && slices.Contains(origins, "*") {
+		return fmt.Errorf("CORS origin \"*\" cannot be combined with credentials; list the origins explicitly")
+	}
+	policy.AllowedOrigins = origins
+	methods := policy.AllowedMethods[:0]
+	for _, method := range policy.AllowedMethods {
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if method == "" {
+			continue
+		}
+		if strings.ContainsAny(method, " ,:") {
+			return fmt.Errorf("invalid CORS method %q", method)
+		}
+		methods = append(methods, method)
+	}
+	policy.AllowedMethods = methods
+	for _, list := range []*[]string{&policy.AllowedHeaders, &policy.ExposedHeaders} {
+		headers := (*list)[:0]
+		for _, name := range *list {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if strings.ContainsAny(name, " ,:\r\n") {
+				return fmt.Errorf("invalid CORS header %q", name)
+			}
+			if name != "*" {
+				name = textproto.CanonicalMIMEHeaderKey(name)
+			}
+			headers = append(headers, name)
+		}
+		*list = headers
+	}
+	if policy.MaxAgeSec < 0 || policy.MaxAgeSec > 86400 {
+		return fmt.Errorf("CORS max age must be between 0 and 86400 seconds")
+	}
+	return nil
+}
+
+func validateCompression(rule *Rule) error {
+	if rule.Compression == nil {
+		return nil
+	}
+	policy := rule.Compression
+	if !policy.Enabled {
+		rule.Compression = nil
+		return nil
+	}
+	if policy.MinSize < 0 {
+		return fmt.Errorf("compression min size must not be negative")
+	}
+	encodings := policy.Encodings[:0]
+	for _, encoding := range policy.Encodings {
+		encoding = strings.ToLower(strings.TrimSpace(encoding))
+		switch encoding {
+		case "":
+			continue
+		case "br", "zstd", "gzip":
+			encodings = append(encodings, encoding)
+		default:
+			return fmt.Errorf("unsupported compression encoding %q", encoding)
+		}
+	}
+	policy.Encodings = encodings
+	types := policy.ContentTypes[:0]
+	for _, contentType := range policy.ContentTypes {
+		if contentType = strings.ToLower(strings.TrimSpace(contentType)); contentType != "" {
+			types = append(types, contentType)
+		}
+	}
+	policy.ContentTypes = types
+	return nil
+}
+
+func validateRewrites(rewrites []PathRewrite) error {
+	for i := range rewrites {
+		rw := &rewrites[i]
+		if rw.Pattern == "" {
+			return fmt.Errorf("rewrite #%d: pattern is required", i+1)
+		}
+		if _, err := regexp.Compile(rw.Pattern); err != nil {
+			return fmt.Errorf("rewrite #%d: invalid pattern: %v", i+1, err)
+		}
+		if strings.ContainsAny(rw.Replacement, "\r\n") {
+			return fmt.Errorf("rewrite #%d: replacement must not contain line breaks", i+1)
+		}
+		if rw.Redirect != 0 && !validRedirectCode(rw.Redirect) {
+			return fmt.Errorf("rewrite #%d: unsupported redirect code %d", i+1, rw.Redirect)
+		}
+		if rw.Redirect == 0 && !strings.HasPrefix(rw.Replacement, "/") {
+			return fmt.Errorf("rewrite #%d: replacement must start with /", i+1)
+		}
+	}
+	return nil
+}
+
+func validateQueryOps(ops []QueryOp) error {
+	for i := range ops {
+		op := &ops[i]
+		op.Action = strings.ToLower(strings.TrimSpace(op.Action))
+		op.Name = strings.TrimSpace(op.Name)
+		if op.Name == "" {
+			return fmt.Errorf("query operation #%d: name is required", i+1)
+		}
+		switch op.Action {
+		case HeaderSet, HeaderAppend, HeaderDelete:
+		default:
+			return fmt.Errorf("query parameter %s: unknown action %q", op.Name, op.Action)
+		}
+	}
+	return nil
+}
+
+func validateHeaderOps(kind string, ops []HeaderOp) error {
+	for i := range ops {
+		op := &ops[i]
+		op.Action = strings.ToLower(strings.TrimSpace(op.Action))
+		op.Name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(op.Name))
+		if op.Name == "" || strings.ContainsAny(op.Name, " \t\r\n:") {
+			return fmt.Errorf("%s header #%d: invalid name %q", kind, i+1, op.Name)
+		}
+		if strings.ContainsAny(op.Value, "\r\n") {
+			return fmt.Errorf("%s header %s: value must not contain line breaks", kind, op.Name)
+		}
+		switch op.Action {
+		case HeaderSet, HeaderAppend, HeaderDelete:
+		case HeaderReplace:
+			if op.Pattern == "" {
+				return fmt.Errorf("%s header %s: replace needs a pattern", kind, op.Name)
+			}
+			if _, err := regexp.Compile(op.Pattern); err != nil {
+				return fmt.Errorf("%s header %s: invalid pattern: %v", kind, op.Name, err)
+			}
+		default:
+			return fmt.Errorf("%s header %s: unknown action %q", kind, op.Name, op.Action)
+		}
+	}
+	return nil
+}
@@ -12,9 +12,64 @@ import (
 
 // Rule represents a routing rule with its status and last access time
 type Rule struct {
-	Host        string    `json:"-"` // Host is the map key, not stored in the struct's JSON
-	Target      string    `json:"target"`
-	Maintenance bool      `json:"maintenance"`
+	Host        string `json:"-"` // Host is the map key, not stored in the struct's JSON
+	Target      string `json:"target"`
+	Maintenance bool   `json:"maintenance"`
+	Passthrough bool   `json:"passthrough,omitempty"` // Splice raw TLS to Target without terminating it
+	// ProxyProtocol sends a PROXY protocol header ("v1" or "v2") to the upstream.
+	ProxyProtocol string `json:"proxyProtocol,omitempty"`
+	// PreserveHost sends the original Host header instead of the target host.
+	PreserveHost bool `json:"preserveHost,omitempty"`
+	// ForwardedHeader adds an RFC 7239 Forwarded header next to X-Forwarded-*.
+	ForwardedHeader bool `json:"forwardedHeader,omitempty"`
+
+	// Targets are additional upstreams; requests are balanced across Target and
+	// Targets, skipping the ones that failed their health check.
+	Targets []string `json:"targets,omitempty"`
+	// Retry re-sends failed upstream requests, moving to another target when possible.
+	Retry *RetryPolicy `json:"retry,omitempty"`
+	// Mirror copies a share of requests to a shadow upstream whose responses are discarded.
+	Mirror *MirrorPolicy `json:"mirror,omitempty"`
+	// Canary splits traffic between weighted variants with optional overrides and stickiness.
+	Canary *CanaryPolicy `json:"canary,omitempty"`
+	// Access limits clients by network, country and basic auth credentials.
+	Access *AccessPolicy `json:"access,omitempty"`
+	// ForwardAuth asks an external service whether to let each request through.
+	ForwardAuth *ForwardAuthPolicy `json:"forwardAuth,omitempty"`
+	// OIDC requires an OpenID Connect login before requests reach the upstream.
+	OIDC *OIDCPolicy `json:"oidc,omitempty"`
+	// JWT requires a valid bearer token and maps its claims to upstream headers.
+	JWT *JWTPolicy `json:"jwt,omitempty"`
+
+	// Limits for upgraded (WebSocket) and streaming connections. Zero means unlimited.
+	MaxConnections int `json:"maxConnections,omitempty"`
+	IdleTimeoutSec int `json:"idleTimeoutSec,omitempty"`
+	MaxLifetimeSec int `json:"maxLifetimeSec,omitempty"`
+
+	// Request limits. Zero means unlimited.
+	MaxBodyBytes             int64 `json:"maxBodyBytes,omitempty"`             // larger request bodies get 413
+	ResponseHeaderTimeoutSec int   `json:"responseHeaderTimeoutSec,omitempty"` // wait for upstream response headers
+	RequestTimeoutSec        int   `json:"requestTimeoutSec,omitempty"`        // total deadline for a proxied request
+
+	// Header policies applied to proxied requests and upstream responses.
+	RequestHeaders  []HeaderOp `json:"requestHeaders,omitempty"`
+	ResponseHeaders []HeaderOp `json:"responseHeaders,omitempty"`
+	SecurityHeaders bool       `json:"securityHeaders,omitempty"` // CSP, X-Frame-Options, Referrer-Policy preset
+	// CORS answers preflight requests and adds CORS headers to responses.
+	CORS *CORSPolicy `json:"cors,omitempty"`
+
+	// Redirect answers every request with a redirect instead of proxying; Target may be empty then.
+	Redirect *RedirectPolicy `json:"redirect,omitempty"`
+	// Compression compresses responses for clients that accept it.
+	Compression *CompressionPolicy `json:"compression,omitempty"`
+	// Cache stores upstream responses according to Cache-Control.
+	Cache *CachePolicy `json:"cache,omitempty"`
+	// Static serves files from a local directory instead of proxying; Target may be empty then.
+	Static *StaticPolicy `json:"static,omitempty"`
+	// Rewrites and Query are applied to the request URL before proxying.
+	Rewrites []PathRewrite `json:"rewrites,omitempty"`
+	Query    []QueryOp     `json:"query,omitempty"`
+
 	LastAccess  time.Time `json:"-"`
 	ServiceDown bool      `json:"-"`
 }
@@ -23,15 +78,23 @@ type Rule struct {
 type RuleStore struct {
 	mu              sync.RWMutex
 	rules           map[string]*Rule
+	downTargets     map[string]bool // upstream addresses that failed a health check
+	probeFn         func(target string) bool
 	storage         *Storage
 	MaintenanceMode bool `json:"maintenanceMode"`
+
+	// OnRuleChange is called after a rule is added, updated or removed, or its
+	// maintenance flag changes. host is empty for the global maintenance switch.
+	OnRuleChange func(host string)
 }
 
 // NewRuleStore creates a new RuleStore
 func NewRuleStore(storage *Storage) *RuleStore {
 	rs := &RuleStore{
-		rules:   make(map[string]*Rule), // Always initialize to a non-nil map
-		storage: storage,
+		rules:       make(map[string]*Rule), // Always initialize to a non-nil map
+		downTargets: make(map[string]bool),
+		probeFn:     probeTarget,
+		storage:     storage,
 	}
 
 	loadedRules, maintenanceMode, err := storage.Load()
@@ -49,21 +112,100 @@ func NewRuleStore(storage *Storage) *RuleStore {
 	return rs
 }
 
-// Add adds a new rule or updates an existing one
+// Add adds a new rule or changes the target of an existing one; the
+// existing rule keeps its access, auth and other policies.
 func (s *RuleStore) Add(host, target string) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	// The Host field is primarily for template display and is populated by the All() method.
-	s.rules[host] = &Rule{Target: target}
+	if existing, ok := s.rules[host]; ok {
+		// Swap in a fresh copy so in-flight requests keep a consistent view.
+		updated := *existing
+		updated.Target = target
+		s.rules[host] = &updated
+	} else {
+		// The Host field is primarily for template display and is populated by the All() method.
+		s.rules[host] = &Rule{Target: target}
+	}
+	s.storage.Save(s.rules, s.MaintenanceMode)
+	s.mu.Unlock()
+	s.notifyChange(host)
+}
+
+// Update replaces the settings of an existing rule after validating them.
+func (s *RuleStore) Update(host string, rule Rule) error {
+	if err := ValidateRule(&rule); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	existing, ok := s.rules[host]
+	if !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("rule %q not found", host)
+	}
+	// Swap in a fresh copy so in-flight requests keep a consistent view.
+	rule.Host = host
+	rule.LastAccess = existing.LastAccess
+	rule.ServiceDown = existing.ServiceDown
+	s.rules[host] = &rule
 	s.storage.Save(s.rules, s.MaintenanceMode)
+	s.mu.Unlock()
+	s.notifyChange(host)
+	return nil
+}
+
+// SetCanaryWeights changes variant weights of a rule in place of a full
+// update; unknown variant names are rejected.
+func (s *RuleStore) SetCanaryWeights(host string, weights map[string]int) error {
+	rule, ok := s.Snapshot(host)
+	if !ok {
+		return fmt.Errorf("rule %q not found", host)
+	}
+	if rule.Canary == nil {
+		return fmt.Errorf("rule %q has no canary variants", host)
+	}
+	canary := *rule.Canary
+	canary.Variants = append([]CanaryVariant(nil), canary.Variants...)
+	for name, weight := range weights {
+		found := false
+		for i := range canary.Variants {
+			if canary.Variants[i].Name == name {
+				canary.Variants[i].Weight = weight
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown variant %q", name)
+		}
+	}
+	rule.Canary = &canary
+	return s.Update(host, rule)
+}
+
+// Snapshot returns a copy of a rule for editing.
+func (s *RuleStore) Snapshot(host string) (Rule, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rule, ok := s.rules[host]
+	if !ok {
+		return Rule{}, false
+	}
+	copied := *rule
+	copied.Host = host
+	return copied, true
 }
 
 // Remove removes a rule
 func (s *RuleStore) Remove(host string) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	delete(s.rules, host)
 	s.storage.Save(s.rules, s.MaintenanceMode)
+	s.mu.Unlock()
+	s.notifyChange(host)
+}
+
+func (s *RuleStore) notifyChange(host string) {
+	if s.OnRuleChange != nil {
+		s.OnRuleChange(host)
+	}
 }
 
 // Get retrieves a rule
@@ -116,21 +258,48 @@ func (s *RuleStore) HostPolicy(ctx context.Context, host string) error {
 // SetMaintenanceMode sets the maintenance mode status
 func (s *RuleStore) SetMaintenanceMode(enabled bool) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	s.MaintenanceMode = enabled
 	s.storage.Save(s.rules, s.MaintenanceMode) // Save the updated state
+	s.mu.Unlock()
+	s.notifyChange("")
 }
 
 // SetRuleMaintenance updates maintenance mode for a specific rule.
 func (s *RuleStore) SetRuleMaintenance(host string, enabled bool) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	rule, ok := s.rules[host]
 	if !ok {
+		s.mu.Unlock()
 		return
 	}
 	rule.Maintenance = enabled
 	s.storage.Save(s.rules, s.MaintenanceMode)
+	s.mu.Unlock()
+	s.notifyChange(host)
+}
+
+// SetRulePassthrough toggles TLS passthrough (SNI routing) for a specific rule.
+func (s *RuleStore) SetRulePassthrough(host string, enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rule, ok := s.rules[host]
+	if !ok {
+		return
+	}
+	rule.Passthrough = enabled
+	s.storage.Save(s.rules, s.MaintenanceMode)
+}
+
+// SetRuleProxyProtocol sets the outbound PROXY protocol version ("", "v1" or "v2") for a rule.
+func (s *RuleStore) SetRuleProxyProtocol(host, version string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rule, ok := s.rules[host]
+	if !ok {
+		return
+	}
+	rule.ProxyProtocol = version
+	s.storage.Save(s.rules, s.MaintenanceMode)
 }
 
 // startHealthCheck periodically checks the health of the services
@@ -141,39 +310,97 @@ func (s *RuleStore) startHealthCheck() {
 	}
 }
 
-// checkServices attempts to connect to each service to check its status
+// checkServices attempts to connect to each service to check its status.
+// Probes run without the lock, since requests read the rules meanwhile.
 func (s *RuleStore) checkServices() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
+	s.mu.RLock()
+	var targets []string
+	seen := make(map[string]bool)
 	for _, rule := range s.rules {
-		// Clean up the target address for dialing
-		targetAddr := rule.Target
-		if strings.HasPrefix(targetAddr, "https://") {
-			targetAddr = strings.TrimPrefix(targetAddr, "https://")
-		} else if strings.HasPrefix(targetAddr, "http://") {
-			targetAddr = strings.TrimPrefix(targetAddr, "http://")
+		for _, target := range rule.Upstreams() {
+			if !seen[target] {
+				seen[target] = true
+				targets = append(targets, target)
+			}
 		}
+	}
+	s.mu.RUnlock()
 
-		// If the address has no port, Dial will fail. We need to split and check.
-		// This is a simplified health check.
-		_, _, err := net.SplitHostPort(targetAddr)
-		if err != nil {
-			// If splitting fails, it might be because there's no port.
-			// For a simple health check, we can just skip or assume a default port.
-			// For now, we'll log it and mark it as potentially down.
-			// A robust solution would be more complex.
-			clog.Warnf("Could not parse target for health check: %s. Assuming down.", rule.Target)
-			rule.ServiceDown = true
-			continue
+	down := make(map[string]bool)
+	for _, target := range targets {
+		if !s.probeFn(target) {
+			down[target] = true
 		}
+	}
 
-		conn, err := net.DialTimeout("tcp", targetAddr, 5*time.Second)
-		if err != nil {
-			rule.ServiceDown = true
-		} else {
-			rule.ServiceDown = false
-			conn.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rule := range s.rules {
+		upstreams := rule.Upstreams()
+		healthy := 0
+		for _, target := range upstreams {
+			// Targets added during the probe count as healthy until the next check.
+			if !down[target] {
+				healthy++
+			}
 		}
+		// Redirect-only rules have nothing to probe.
+		rule.ServiceDown = len(upstreams) > 0 && healthy == 0
+	}
+	s.downTargets = down
+}
+
+// probeTarget dials an upstream address to check that it accepts connections.
+func probeTarget(target string) bool {
+	// Clean up the target address for dialing
+	targetAddr := target
+	if strings.HasPrefix(targetAddr, "https://") {
+		targetAddr = strings.TrimPrefix(targetAddr, "https://")
+	} else if strings.HasPrefix(targetAddr, "http://") {
+		targetAddr = strings.TrimPrefix(targetAddr, "http://")
 	}
+
+	// If the address has no port, Dial will fail. We need to split and check.
+	// This is a simplified health check.
+	_, _, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		// If splitting fails, it might be because there's no port.
+		// For a simple health check, we can just skip or assume a default port.
+		// For now, we'll log it and mark it as potentially down.
+		// A robust solution would be more complex.
+		clog.Warnf("Could not parse target for health check: %s. Assuming down.", target)
+		return false
+	}
+
+	conn, err := net.DialTimeout("tcp", targetAddr, 5*time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// Upstreams returns Target followed by the additional Targets.
+func (r *Rule) Upstreams() []string {
+	upstreams := make([]string, 0, 1+len(r.Targets))
+	if r.Target != "" {
+		upstreams = append(upstreams, r.Target)
+	}
+	return append(upstreams, r.Targets...)
+}
+
+// TargetDown reports whether an upstream failed its last health check or was
+// marked down by the proxy since then.
+func (s *RuleStore) TargetDown(target string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.downTargets[target]
+}
+
+// MarkTargetDown records a failed connection to an upstream until the next
+// health check probes it again.
+func (s *RuleStore) MarkTargetDown(target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.downTargets[target] = true
 }
@@ -0,0 +1,359 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRuleStoreUpdateValidatesAndNotifies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	store := NewRuleStore(NewStorage(path))
+	var changed []string
+	store.OnRuleChange = func(host string) { changed = append(changed, host) }
+
+	store.Add("app.test", "127.0.0.1:3000")
+	if err := store.Update("app.test", Rule{Target: " 127.0.0.1:3001 ", MaxConnections: 5, IdleTimeoutSec: 30}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := store.Update("app.test", Rule{Target: "127.0.0.1:3001", MaxConnections: -1}); err == nil {
+		t.Fatalf("expected negative limit to be rejected")
+	}
+	if err := store.Update("missing.test", Rule{Target: "127.0.0.1:1"}); err == nil {
+		t.Fatalf("expected unknown host to be rejected")
+	}
+
+	reloaded := NewRuleStore(NewStorage(path))
+	rule, ok := reloaded.Snapshot("app.test")
+	if !ok || rule.Target != "127.0.0.1:3001" || rule.MaxConnections != 5 || rule.IdleTimeoutSec != 30 {
+		t.Fatalf("unexpected persisted rule: %+v", rule)
+	}
+
+	store.SetRuleMaintenance("app.test", true)
+	store.Remove("app.test")
+	store.SetMaintenanceMode(true)
+	want := []string{"app.test", "app.test", "app.test", "app.test", ""}
+	if len(changed) != len(want) {
+		t.Fatalf("changes = %q, want %q", changed, want)
+	}
+	for i := range want {
+		if changed[i] != want[i] {
+			t.Fatalf("changes = %q, want %q", changed, want)
+		}
+	}
+}
+
+func TestRuleStoreAddKeepsPolicies(t *testing.T) {
+	store := NewRuleStore(NewStorage(filepath.Join(t.TempDir(), "rules.json")))
+	store.Add("app.test", "127.0.0.1:3000")
+	if err := store.Update("app.test", Rule{Target: "127.0.0.1:3000", Access: &AccessPolicy{AllowCIDRs: []string{"10.0.0.0/8"}}}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	store.Add("app.test", "127.0.0.1:4000")
+	rule, _ := store.Snapshot("app.test")
+	if rule.Target != "127.0.0.1:4000" || rule.Access == nil || len(rule.Access.AllowCIDRs) != 1 {
+		t.Fatalf("re-added rule = %+v", rule)
+	}
+}
+
+func TestRuleStoreHealthCheckProbesWithoutLock(t *testing.T) {
+	store := NewRuleStore(NewStorage(filepath.Join(t.TempDir(), "rules.json")))
+	store.Add("app.test", "127.0.0.1:3000")
+	store.Add("multi.test", "127.0.0.1:3000")
+	if err := store.Update("multi.test", Rule{Target: "127.0.0.1:3000", Targets: []string{"127.0.0.1:3001"}}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	release := make(chan struct{})
+	probed := make(chan string, 4)
+	store.probeFn = func(target string) bool {
+		probed <- target
+		<-release
+		return target == "127.0.0.1:3001"
+	}
+
+	done := make(chan struct{})
+	go func() {
+		store.checkServices()
+		close(done)
+	}()
+	<-probed
+	if _, ok := store.GetRule("app.test"); !ok {
+		t.Fatalf("GetRule during the health check")
+	}
+	store.MarkTargetDown("127.0.0.1:9")
+	close(release)
+	<-done
+
+	if len(probed) != 1 {
+		t.Fatalf("each target must be probed once, got %d more probes", len(probed))
+	}
+	app, _ := store.GetRule("app.test")
+	multi, _ := store.GetRule("multi.test")
+	if !app.ServiceDown || multi.ServiceDown || !store.TargetDown("127.0.0.1:3000") || store.TargetDown("127.0.0.1:3001") {
+		t.Fatalf("health = app %v multi %v", app.ServiceDown, multi.ServiceDown)
+	}
+}
+
+func TestValidateRuleRejectsBadHeaderOps(t *testing.T) {
+	bad := []HeaderOp{
+		{Action: "rename", Name: "X-A"},
+		{Action: "set", Name: ""},
+		{Action: "replace", Name: "X-A", Pattern: "("},
+		{Action: "set", Name: "X-A", Value: "a\r\nInjected: 1"},
+	}
+	for _, op := range bad {
+		rule := Rule{Target: "127.0.0.1:1", RequestHeaders: []HeaderOp{op}}
+		if err := ValidateRule(&rule); err == nil {
+			t.Fatalf("expected %+v to be rejected", op)
+		}
+	}
+}
+
+func TestValidateRuleRedirects(t *testing.T) {
+	rule := Rule{Redirect: &RedirectPolicy{To: " https://example.com/ "}}
+	if err := ValidateRule(&rule); err != nil {
+		t.Fatalf("redirect rule without target: %v", err)
+	}
+	if rule.Redirect.To != "https://example.com" || rule.Redirect.Code != 301 {
+		t.Fatalf("unexpected normalized redirect: %+v", rule.Redirect)
+	}
+
+	rule = Rule{Redirect: &RedirectPolicy{To: ""}}
+	if err := ValidateRule(&rule); err == nil {
+		t.Fatalf("empty redirect without target must be rejected")
+	}
+
+	invalid := []Rule{
+		{Redirect: &RedirectPolicy{To: "example.com"}},
+		{Redirect: &RedirectPolicy{To: "https://example.com", Code: 200}},
+		{Target: "127.0.0.1:1", Rewrites: []PathRewrite{{Pattern: "(", Replacement: "/"}}},
+		{Target: "127.0.0.1:1", Rewrites: []PathRewrite{{Pattern: "^/a", Replacement: "b"}}},
+		{Target: "127.0.0.1:1", Query: []QueryOp{{Action: "rename", Name: "a"}}},
+	}
+	for _, r := range invalid {
+		if err := ValidateRule(&r); err == nil {
+			t.Fatalf("expected %+v to be rejected", r)
+		}
+	}
+}
+
+func TestValidateRuleTargetsAndRetry(t *testing.T) {
+	rule := Rule{Target: "a:80", Targets: []string{" b:80 ", "", "a:80", "b:80"}, Retry: &RetryPolicy{MaxAttempts: 1}}
+	if err := ValidateRule(&rule); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rule.Targets) != 1 || rule.Targets[0] != "b:80" {
+		t.Fatalf("targets = %v, want [b:80]", rule.Targets)
+	}
+	if rule.Retry != nil {
+		t.Fatal("single attempt should disable retries")
+	}
+	if got := rule.Upstreams(); len(got) != 2 || got[0] != "a:80" {
+		t.Fatalf("upstreams = %v", got)
+	}
+
+	bad := []Rule{
+		{Target: "a:80", Retry: &RetryPolicy{MaxAttempts: 3}},
+		{Target: "a:80", Retry: &RetryPolicy{MaxAttempts: 3, OnStatus: []int{200}}},
+		{Target: "a:80", Retry: &RetryPolicy{MaxAttempts: 30, OnConnectError: true}},
+		{Targets: []string{"b:80"}, Static: nil, Redirect: nil},
+	}
+	for i, rule := range bad {
+		if err := ValidateRule(&rule); err == nil {
+			t.Fatalf("case %d: expected an error", i)
+		}
+	}
+}
+
+func TestValidateRuleMirror(t *testing.T) {
+	rule := Rule{Target: "a:80", Mirror: &MirrorPolicy{Target: " ", Percent: 50}}
+	if err := ValidateRule(&rule); err != nil || rule.Mirror != nil {
+		t.Fatalf("empty mirror target should disable mirroring: %v %+v", err, rule.Mirror)
+	}
+	for _, policy := range []MirrorPolicy{
+		{Target: "b:80", Percent: 101},
+		{Target: "a:80", Percent: 10},
+		{Target: "b:80", Percent: 10, MaxBodyBytes: -1},
+	} {
+		rule := Rule{Target: "a:80", Mirror: &policy}
+		if err := ValidateRule(&rule); err == nil {
+			t.Fatalf("policy %+v: expected an error", policy)
+		}
+	}
+}
+
+func TestValidateRuleCanary(t *testing.T) {
+	rule := Rule{Target: "a:80", Canary: &CanaryPolicy{Variants: []CanaryVariant{{Name: " "}}}}
+	if err := ValidateRule(&rule); err != nil || rule.Canary != nil {
+		t.Fatalf("empty variants should disable canary: %v %+v", err, rule.Canary)
+	}
+	for _, variants := range [][]CanaryVariant{
+		{{Name: "a", Weight: 0}, {Name: "b", Target: "b:80", Weight: 0}},
+		{{Name: "a", Weight: 1}, {Name: "a", Target: "b:80", Weight: 1}},
+		{{Name: "a b", Weight: 1}},
+		{{Name: "a", Weight: -1}, {Name: "b", Weight: 2}},
+	} {
+		rule := Rule{Target: "a:80", Canary: &CanaryPolicy{Variants: variants}}
+		if err := ValidateRule(&rule); err == nil {
+			t.Fatalf("variants %+v: expected an error", variants)
+		}
+	}
+}
+
+func TestValidateRuleAccess(t *testing.T) {
+	rule := Rule{Target: "a:80", Access: &AccessPolicy{
+		AllowCIDRs:     []string{" 10.1.2.3/8 ", "192.0.2.7", ""},
+		AllowCountries: []string{"ru"},
+	}}
+	if err := ValidateRule(&rule); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if got := strings.Join(rule.Access.AllowCIDRs, ","); got != "10.0.0.0/8,192.0.2.7/32" {
+		t.Fatalf("normalized CIDRs = %q", got)
+	}
+	if rule.Access.AllowCountries[0] != "RU" {
+		t.Fatalf("normalized countries = %v", rule.Access.AllowCountries)
+	}
+
+	empty := Rule{Target: "a:80", Access: &AccessPolicy{BasicAuth: &BasicAuth{Users: []BasicAuthUser{{}}}}}
+	if err := ValidateRule(&empty); err != nil || empty.Access != nil {
+		t.Fatalf("empty policy should be dropped: %v %+v", err, empty.Access)
+	}
+
+	for _, policy := range []AccessPolicy{
+		{AllowCIDRs: []string{"10.0.0.0/33"}},
+		{DenyCountries: []string{"Russia"}},
+		{BasicAuth: &BasicAuth{Users: []BasicAuthUser{{Username: "qa"}}}},
+		{BasicAuth: &BasicAuth{Users: []BasicAuthUser{{Username: "a:b", Password: "x"}}}},
+		{AllowCIDRs: []string{"10.0.0.0/8"}, Satisfy: SatisfyAny},
+		{Satisfy: "some"},
+	} {
+		rule := Rule{Target: "a:80", Access: &policy}
+		if err := ValidateRule(&rule); err == nil {
+			t.Fatalf("policy %+v: expected an error", policy)
+		}
+	}
+}
+
+func TestValidateRuleForwardAuth(t *testing.T) {
+	rule := Rule{Target: "a:80", ForwardAuth: &ForwardAuthPolicy{URL: " http://auth:9000/check ", CopyHeaders: []string{" x-user ", ""}}}
+	if err := ValidateRule(&rule); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if rule.ForwardAuth.URL != "http://auth:9000/check" || len(rule.ForwardAuth.CopyHeaders) != 1 || rule.ForwardAuth.CopyHeaders[0] != "X-User" {
+		t.Fatalf("normalized policy = %+v", rule.ForwardAuth)
+	}
+	for _, policy := range []ForwardAuthPolicy{
+		{URL: "/auth"},
+		{URL: "ftp://auth/check"},
+		{URL: "http://auth/check", TimeoutSec: 61},
+		{URL: "http://auth/check", CopyHeaders: []string{"X User"}},
+	} {
+		rule := Rule{Target: "a:80", ForwardAuth: &policy}
+		if err := ValidateRule(&rule); err == nil {
+			t.Fatalf("policy %+v: expected an error", policy)
+		}
+	}
+}
+
+func TestValidateRuleOIDC(t *testing.T) {
+	rule := Rule{Target: "a:80", OIDC: &OIDCPolicy{
+		Issuer: "https://sso.example.com/realms/corp/", ClientID: "router", ClientSecret: "s",
+		Scopes: []string{"email groups"}, AllowedDomains: []string{"@Corp.Example", " "},
+	}}
+	if err := ValidateRule(&rule); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	policy := rule.OIDC
+	if policy.Issuer != "https://sso.example.com/realms/corp" || policy.CallbackPath != DefaultOIDCCallbackPath ||
+		strings.Join(policy.Scopes, " ") != "openid email groups" || strings.Join(policy.AllowedDomains, ",") != "corp.example" ||
+		policy.GroupsClaim != "groups" || policy.SessionTTLSec != DefaultOIDCSessionSec {
+		t.Fatalf("normalized policy = %+v", policy)
+	}
+	for _, policy := range []OIDCPolicy{
+		{Issuer: "sso.example.com", ClientID: "a", ClientSecret: "b"},
+		{Issuer: "https://sso.example.com", ClientID: "a"},
+		{Issuer: "https://sso.example.com", ClientID: "a", ClientSecret: "b", CallbackPath: "callback"},
+		{Issuer: "https://sso.example.com", ClientID: "a", ClientSecret: "b", SessionTTLSec: -1},
+	} {
+		rule := Rule{Target: "a:80", OIDC: &policy}
+		if err := ValidateRule(&rule); err == nil {
+			t.Fatalf("policy %+v: expected an error", policy)
+		}
+	}
+}
+
+func TestValidateRuleRejectsCacheWithSessionAuth(t *testing.T) {
+	for _, rule := range []Rule{
+		{Target: "a:80", OIDC: &OIDCPolicy{Issuer: "https://sso.example.com", ClientID: "a", ClientSecret: "b"}},
+		{Target: "a:80", ForwardAuth: &ForwardAuthPolicy{URL: "http://auth/check"}},
+	} {
+		rule.Cache = &CachePolicy{Enabled: true, DefaultTTLSec: 60}
+		if err := ValidateRule(&rule); err == nil {
+			t.Fatalf("rule %+v: expected cache with session auth to be rejected", rule)
+		}
+	}
+}
+
+func TestValidateRuleJWT(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(keyFile, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rule := Rule{Target: "a:80", JWT: &JWTPolicy{
+		KeyFile: keyFile, Algorithms: []string{" hs256 "},
+		ClaimHeaders: []ClaimHeader{{Claim: "sub", Header: "x-user"}, {}},
+	}}
+	if err := ValidateRule(&rule); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if rule.JWT.Algorithms[0] != "HS256" || len(rule.JWT.ClaimHeaders) != 1 || rule.JWT.ClaimHeaders[0].Header != "X-User" {
+		t.Fatalf("normalized policy = %+v", rule.JWT)
+	}
+	for _, policy := range []JWTPolicy{
+		{KeyFile: keyFile, JWKSURL: "https://idp/jwks"},
+		{JWKSURL: "idp/jwks"},
+		{KeyFile: filepath.Join(t.TempDir(), "missing")},
+		{KeyFile: keyFile, Algorithms: []string{"none"}},
+		{KeyFile: keyFile, ClaimHeaders: []ClaimHeader{{Claim: "sub"}}},
+		{KeyFile: keyFile, LeewaySec: -1},
+		{},
+		{Issuer: "https://idp", Audiences: []string{"api"}},
+	} {
+		rule := Rule{Target: "a:80", JWT: &policy}
+		if err := ValidateRule(&rule); err == nil {
+			t.Fatalf("policy %+v: expected an error", policy)
+		}
+	}
+}
+
+func TestValidateRuleCORS(t *testing.T) {
+	rule := Rule{Target: "a:80", CORS: &CORSPolicy{
+		AllowedOrigins: []string{" HTTPS://App.Example.com/ ", "https://*.example.com", ""},
+		AllowedMethods: []string{"get"},
+		AllowedHeaders: []string{"content-type"},
+	}}
+	if err := ValidateRule(&rule); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if got := strings.Join(rule.CORS.AllowedOrigins, " "); got != "https://app.example.com https://*.example.com" {
+		t.Fatalf("normalized origins = %q", got)
+	}
+	if rule.CORS.AllowedMethods[0] != "GET" || rule.CORS.AllowedHeaders[0] != "Content-Type" {
+		t.Fatalf("normalized policy = %+v", rule.CORS)
+	}
+	for _, policy := range []CORSPolicy{
+		{AllowedOrigins: []string{"app.example.com"}},
+		{AllowedOrigins: []string{"https://app.example.com/path"}},
+		{AllowedOrigins: []string{"https://a*.example.com"}},
+		{AllowedOrigins: []string{"*"}, MaxAgeSec: -1},
+		{AllowedOrigins: []string{"*"}, AllowedHeaders: []string{"X Bad"}},
+		{AllowedOrigins: []string{"https://app.example.com", " * "}, AllowCredentials: true},
+	} {
+		rule := Rule{Target: "a:80", CORS: &policy}
+		if err := ValidateRule(&rule); err == nil {
+			t.Fatalf("policy %+v: expected an error", policy)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package storage
+
+// builtinPacks are the signature packs shipped with the router. Built-in
+// signatures mark clients as suspicious by default, as the old hard-coded
+// probe list did; raise a pack's action to block or tarpit in the panel.
+var builtinPacks = []SignaturePack{
+	{
+		Name:        "wordpress",
+		Description: "WordPress login, admin and plugin probes",
+		Signatures: []Signature{
+			{ID: "wp-login", Name: "WordPress login", Target: SignaturePath, Match: MatchSubstring, Pattern: "wp-login", Score: 40},
+			{ID: "wp-admin", Name: "WordPress admin", Target: SignaturePath, Match: MatchSubstring, Pattern: "wp-admin", Score: 40},
+			{ID: "wp-content", Name: "WordPress plugins and themes", Target: SignaturePath, Match: MatchRegex, Pattern: `/wp-(content|includes)/`, Score: 20},
+			{ID: "xmlrpc", Name: "WordPress XML-RPC", Target: SignaturePath, Match: MatchSubstring, Pattern: "xmlrpc.php", Score: 40},
+		},
+	},
+	{
+		Name:        "php",
+		Description: "PHP admin tools, shells and config dumps",
+		Signatures: []Signature{
+			{ID: "phpmyadmin", Name: "phpMyAdmin", Target: SignaturePath, Match: MatchSubstring, Pattern: "phpmyadmin", Score: 40},
+			{ID: "adminer", Name: "Adminer", Target: SignaturePath, Match: MatchSubstring, Pattern: "adminer", Score: 40},
+			{ID: "phpinfo", Name: "phpinfo", Target: SignaturePath, Match: MatchGlob, Pattern: "*/phpinfo.php", Score: 40},
+			{ID: "php-shell", Name: "Web shells", Target: SignaturePath, Match: MatchRegex, Pattern: `/(shell|cmd|c99|r57|wso|alfa)\.php`, Score: 60},
+			{ID: "php-cgi", Name: "PHP-CGI argument injection", Target: SignaturePath, Match: MatchRegex, Pattern: `/php-cgi|/cgi-bin/php`, Score: 60},
+			{ID: "php-eval", Name: "PHP code in query", Target: SignatureQuery, Match: MatchRegex, Pattern: `(allow_url_include|auto_prepend_file|php://input)`, Score: 60},
+		},
+	},
+	{
+		Name:        "secrets",
+		Description: ".git, .env and other files that must never be public",
+		Signatures: []Signature{
+			{ID: "dotenv", Name: ".env file", Target: SignaturePath, Match: MatchSubstring, Pattern: ".env", Score: 40},
+			{ID: "git", Name: ".git repository", Target: SignaturePath, Match: MatchSubstring, Pattern: "/.git", Score: 40},
+			{ID: "vcs", Name: "Other VCS metadata", Target: SignaturePath, Match: MatchRegex, Pattern: `/\.(svn|hg|bzr)(/|$)`, Score: 40},
+			{ID: "backups", Name: "Backup and dump files", Target: SignaturePath, Match: MatchRegex, Pattern: `\.(sql|bak|old|swp)(\.gz|\.zip)?$`, Score: 40},
+			{ID: "aws-credentials", Name: "Cloud credentials", Target: SignaturePath, Match: MatchRegex, Pattern: `/\.(aws|ssh|docker)/`, Score: 40},
+		},
+	},
+	{
+		Name:        "traversal",
+		Description: "Path traversal and system file access",
+		Signatures: []Signature{
+			{ID: "etc-passwd", Name: "/etc/passwd", Target: SignaturePath, Match: MatchSubstring, Pattern: "/etc/passwd", Score: 60},
+			{ID: "dot-dot", Name: "Parent directory in path", Target: SignaturePath, Match: MatchRegex, Pattern: `(^|/)\.\.(/|$)`, Score: 50},
+			{ID: "encoded-dot-dot", Name: "Encoded traversal in query", Target: SignatureQuery, Match: MatchRegex, Pattern: `(\.\./|%2e%2e(%2f|/)|\.\.%2f)`, Score: 50},
+			{ID: "etc-in-query", Name: "System file in query", Target: SignatureQuery, Match: MatchRegex, Pattern: `/(etc/(passwd|shadow)|proc/self/environ)`, Score: 60},
+		},
+	},
+	{
+		Name:        "scanners",
+		Description: "User agents of common vulnerability scanners",
+		Signatures: []Signature{
+			{ID: "scanner-ua", Name: "Scanner user agent", Target: SignatureUserAgent, Match: MatchRegex, Pattern: `(sqlmap|nikto|nmap|masscan|zgrab|nuclei|wpscan|dirbuster|gobuster|acunetix|netsparker)`, Score: 50},
+		},
+	},
+}
+
+func builtinPack(name string) SignaturePack {
+	for _, pack := range builtinPacks {
+		if pack.Name == name {
+			return SignaturePack{Name: pack.Name, Description: pack.Description}
+		}
+	}
+	return SignaturePack{Name: name}
+}
+
+// packSignatures returns copies of a built-in pack's signatures with the pack
+// name, ID prefix and defaults filled in.
+func packSignatures(name string) []Signature {
+	for _, pack := range builtinPacks {
+		if pack.Name != name {
+			continue
+		}
+		out := make([]Signature, len(pack.Signatures))
+		for i, sig := range pack.Signatures {
+			sig.ID = pack.Name + "/" + sig.ID
+			sig.Pack = pack.Name
+			sig.Action = ActionMark
+			sig.Enabled = true
+			out[i] = sig
+		}
+		return out
+	}
+	return nil
+}
+
+// DefaultSignatures returns the signatures of every built-in pack, used when
+// no signature store is configured.
+func DefaultSignatures() []Signature {
+	var out []Signature
+	for _, pack := range builtinPacks {
+		out = append(out, packSignatures(pack.Name)...)
+	}
+	return out
+}
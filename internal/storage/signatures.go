@@ -0,0 +1,288 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signature match targets.
+const (
+	SignaturePath      = "path"
+	SignatureQuery     = "query"
+	SignatureHeader    = "header"
+	SignatureUserAgent = "userAgent"
+	SignatureBody      = "body" // the first bytes of the request body
+)
+
+// Signature match kinds. Matching is case-insensitive.
+const (
+	MatchSubstring = "substring"
+	MatchRegex     = "regex"
+	MatchGlob      = "glob" // * matches any run of characters, ? one character
+)
+
+// Signature actions, from mildest to strongest.
+const (
+	ActionLog    = "log"    // only log the hit
+	ActionMark   = "mark"   // count the client as suspicious in the IP reputation store
+	ActionBlock  = "block"  // mark and answer 403
+	ActionTarpit = "tarpit" // mark, hold the connection for a while, then answer 403
+)
+
+var signatureActions = []string{ActionLog, ActionMark, ActionBlock, ActionTarpit}
+
+// ActionRank orders actions by strength; unknown actions rank lowest.
+func ActionRank(action string) int {
+	return slices.Index(signatureActions, action)
+}
+
+// Signature is one probe/attack pattern of the request inspection engine.
+type Signature struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Pack    string `json:"pack,omitempty"` // built-in pack; empty for custom signatures
+	Target  string `json:"target"`
+	Header  string `json:"header,omitempty"` // header name for the "header" target
+	Match   string `json:"match"`
+	Pattern string `json:"pattern"`
+	Score   int    `json:"score"`
+	Action  string `json:"action"`
+	Enabled bool   `json:"enabled"`
+}
+
+// SignaturePack is a built-in group of signatures that is switched as a whole.
+// A non-empty Action overrides the action of every signature in the pack.
+type SignaturePack struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Enabled     bool        `json:"enabled"`
+	Action      string      `json:"action,omitempty"`
+	Signatures  []Signature `json:"signatures,omitempty"`
+}
+
+type packState struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	Action  string `json:"action,omitempty"`
+}
+
+type signatureState struct {
+	Packs      []packState `json:"packs"`
+	Signatures []Signature `json:"signatures"`
+}
+
+// SignatureStore keeps custom signatures and the state of the built-in packs
+// in a JSON file.
+type SignatureStore struct {
+	mu         sync.RWMutex
+	path       string
+	packs      []packState
+	signatures []Signature
+	active     []Signature
+}
+
+// NewSignatureStore loads path; without a file every built-in pack is enabled.
+func NewSignatureStore(path string) *SignatureStore {
+	s := &SignatureStore{path: path}
+	for _, pack := range builtinPacks {
+		s.packs = append(s.packs, packState{Name: pack.Name, Enabled: true})
+	}
+	s.load()
+	s.rebuildLocked()
+	return s
+}
+
+func (s *SignatureStore) load() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.path)
+	if err != nil || len(data) == 0 {
+		return
+	}
+	var st signatureState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return
+	}
+	for _, saved := range st.Packs {
+		for i := range s.packs {
+			if s.packs[i].Name == saved.Name && (saved.Action == "" || slices.Contains(signatureActions, saved.Action)) {
+				s.packs[i] = saved
+			}
+		}
+	}
+	for _, sig := range st.Signatures {
+		if normalized, err := normalizeSignature(sig); err == nil {
+			s.signatures = append(s.signatures, normalized)
+		}
+	}
+}
+
+func (s *SignatureStore) saveLocked() {
+	data, err := json.MarshalIndent(signatureState{Packs: s.packs, Signatures: s.signatures}, "", "  ")
+	if err != nil {
+		return
+	}
+	_ = os.WriteFile(s.path, data, 0644)
+}
+
+// rebuildLocked recomputes the list of signatures in force.
+func (s *SignatureStore) rebuildLocked() {
+	var active []Signature
+	for _, state := range s.packs {
+		if !state.Enabled {
+			continue
+		}
+		for _, sig := range packSignatures(state.Name) {
+			if state.Action != "" {
+				sig.Action = state.Action
+			}
+			active = append(active, sig)
+		}
+	}
+	for _, sig := range s.signatures {
+		if sig.Enabled {
+			active = append(active, sig)
+		}
+	}
+	s.active = active
+}
+
+// Active returns the enabled signatures with pack overrides applied. The
+// slice is shared and must not be modified.
+func (s *SignatureStore) Active() []Signature {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.active
+}
+
+// Packs returns the built-in packs with their state and signatures.
+func (s *SignatureStore) Packs() []SignaturePack {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]SignaturePack, 0, len(s.packs))
+	for _, state := range s.packs {
+		pack := builtinPack(state.Name)
+		pack.Enabled = state.Enabled
+		pack.Action = state.Action
+		pack.Signatures = packSignatures(state.Name)
+		out = append(out, pack)
+	}
+	return out
+}
+
+// List returns a copy of the custom signatures.
+func (s *SignatureStore) List() []Signature {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.signatures)
+}
+
+// SetPack enables or disables a built-in pack and sets its action override.
+func (s *SignatureStore) SetPack(name string, enabled bool, action string) error {
+	action = strings.TrimSpace(action)
+	if action != "" && !slices.Contains(signatureActions, action) {
+		return fmt.Errorf("unsupported action %q", action)
+	}
+	s.mu.Lock()
+	idx := slices.IndexFunc(s.packs, func(p packState) bool { return p.Name == name })
+	if idx < 0 {
+		s.mu.Unlock()
+		return fmt.Errorf("unknown signature pack %q", name)
+	}
+	s.packs[idx] = packState{Name: name, Enabled: enabled, Action: action}
+	s.rebuildLocked()
+	s.saveLocked()
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Upsert validates and stores a custom signature. An empty ID creates a new one.
+func (s *SignatureStore) Upsert(sig Signature) (Signature, error) {
+	sig, err := normalizeSignature(sig)
+	if err != nil {
+		return sig, err
+	}
+
+	s.mu.Lock()
+	if sig.ID == "" {
+		sig.ID = fmt.Sprintf("sig-%d", time.Now().UnixNano())
+		s.signatures = append(s.signatures, sig)
+	} else if idx := slices.IndexFunc(s.signatures, func(existing Signature) bool { return existing.ID == sig.ID }); idx >= 0 {
+		s.signatures[idx] = sig
+	} else {
+		s.signatures = append(s.signatures, sig)
+	}
+	s.rebuildLocked()
+	s.saveLocked()
+	s.mu.Unlock()
+
+	return sig, nil
+}
+
+// Delete removes a custom signature by ID.
+func (s *SignatureStore) Delete(id string) bool {
+	s.mu.Lock()
+	idx := slices.IndexFunc(s.signatures, func(sig Signature) bool { return sig.ID == id })
+	if idx < 0 {
+		s.mu.Unlock()
+		return false
+	}
+	s.signatures = slices.Delete(s.signatures, idx, idx+1)
+	s.rebuildLocked()
+	s.saveLocked()
+	s.mu.Unlock()
+
+	return true
+}
+
+func normalizeSignature(sig Signature) (Signature, error) {
+	sig.ID = strings.TrimSpace(sig.ID)
+	sig.Name = strings.TrimSpace(sig.Name)
+	sig.Pack = ""
+	switch sig.Target {
+	case SignaturePath, SignatureQuery, SignatureUserAgent, SignatureBody:
+		sig.Header = ""
+	case SignatureHeader:
+		sig.Header = strings.TrimSpace(sig.Header)
+		if sig.Header == "" || strings.ContainsAny(sig.Header, " :\r\n") {
+			return sig, fmt.Errorf("invalid header name %q", sig.Header)
+		}
+	default:
+		return sig, fmt.Errorf("unsupported signature target %q", sig.Target)
+	}
+	if sig.Pattern == "" {
+		return sig, fmt.Errorf("signature pattern is required")
+	}
+	switch sig.Match {
+	case "", MatchSubstring:
+		sig.Match = MatchSubstring
+	case MatchGlob:
+	case MatchRegex:
+		if _, err := regexp.Compile(sig.Pattern); err != nil {
+			return sig, fmt.Errorf("invalid regex %q: %v", sig.Pattern, err)
+		}
+	default:
+		return sig, fmt.Errorf("unsupported match kind %q", sig.Match)
+	}
+	if sig.Action == "" {
+		sig.Action = ActionMark
+	}
+	if !slices.Contains(signatureActions, sig.Action) {
+		return sig, fmt.Errorf("unsupported action %q", sig.Action)
+	}
+	if sig.Score < 0 || sig.Score > 1000 {
+		return sig, fmt.Errorf("signature score must be between 0 and 1000")
+	}
+	if sig.Name == "" {
+		sig.Name = sig.Target + " " + sig.Pattern
+	}
+	return sig, nil
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSignatureStoreDefaultsAndPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signatures.json")
+	store := NewSignatureStore(path)
+
+	if got, want := len(store.Active()), len(DefaultSignatures()); got != want {
+		t.Fatalf("expected every built-in signature to be active, got %d of %d", got, want)
+	}
+
+	if _, err := store.Upsert(Signature{Target: "cookie", Pattern: "x"}); err == nil {
+		t.Fatalf("expected unsupported target to be rejected")
+	}
+	if _, err := store.Upsert(Signature{Target: SignaturePath, Match: MatchRegex, Pattern: "("}); err == nil {
+		t.Fatalf("expected invalid regex to be rejected")
+	}
+	if _, err := store.Upsert(Signature{Target: SignatureHeader, Pattern: "x"}); err == nil {
+		t.Fatalf("expected header target without header name to be rejected")
+	}
+	if _, err := store.Upsert(Signature{Target: SignaturePath, Pattern: "x", Action: "drop"}); err == nil {
+		t.Fatalf("expected unsupported action to be rejected")
+	}
+
+	sig, err := store.Upsert(Signature{Target: SignaturePath, Match: MatchGlob, Pattern: "/api/*/admin", Score: 30, Enabled: true, Pack: "php"})
+	if err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	if sig.ID == "" || sig.Pack != "" || sig.Action != ActionMark || sig.Name == "" {
+		t.Fatalf("unexpected normalized signature: %+v", sig)
+	}
+
+	if err := store.SetPack("unknown", true, ""); err == nil {
+		t.Fatalf("expected unknown pack to be rejected")
+	}
+	if err := store.SetPack("wordpress", false, ""); err != nil {
+		t.Fatalf("disable pack: %v", err)
+	}
+	if err := store.SetPack("php", true, ActionBlock); err != nil {
+		t.Fatalf("override pack action: %v", err)
+	}
+
+	reloaded := NewSignatureStore(path)
+	if len(reloaded.List()) != 1 || reloaded.List()[0].ID != sig.ID {
+		t.Fatalf("custom signature was not persisted: %+v", reloaded.List())
+	}
+	var custom, wordpress, php int
+	for _, active := range reloaded.Active() {
+		switch {
+		case active.ID == sig.ID:
+			custom++
+		case active.Pack == "wordpress":
+			wordpress++
+		case active.Pack == "php":
+			php++
+			if active.Action != ActionBlock {
+				t.Fatalf("expected pack action override, got %+v", active)
+			}
+		}
+	}
+	if custom != 1 || wordpress != 0 || php == 0 {
+		t.Fatalf("unexpected active signatures: custom=%d wordpress=%d php=%d", custom, wordpress, php)
+	}
+
+	if !reloaded.Delete(sig.ID) || reloaded.Delete(sig.ID) {
+		t.Fatalf("expected delete to succeed once")
+	}
+}
+
+func TestDefaultSignaturesAreValid(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, sig := range DefaultSignatures() {
+		if seen[sig.ID] {
+			t.Fatalf("duplicate built-in signature ID %q", sig.ID)
+		}
+		seen[sig.ID] = true
+		if _, err := normalizeSignature(sig); err != nil {
+			t.Fatalf("built-in signature %q is invalid: %v", sig.ID, err)
+		}
+	}
+}
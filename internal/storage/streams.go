@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StreamRule forwards a raw TCP or UDP port to a target address.
+type StreamRule struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Protocol string `json:"protocol"` // "tcp" or "udp"
+	Listen   string `json:"listen"`   // listen address, e.g. ":5432"
+	Target   string `json:"target"`   // host:port
+	Enabled  bool   `json:"enabled"`
+	// ProxyProtocol sends a PROXY protocol header ("v1" or "v2") to TCP targets.
+	ProxyProtocol string `json:"proxyProtocol,omitempty"`
+}
+
+type streamState struct {
+	Streams []StreamRule `json:"streams"`
+}
+
+// StreamStore keeps stream rules in a JSON file.
+type StreamStore struct {
+	mu       sync.RWMutex
+	path     string
+	streams  []StreamRule
+	OnChange func()
+}
+
+func NewStreamStore(path string) *StreamStore {
+	s := &StreamStore{path: path, streams: []StreamRule{}}
+	s.load()
+	return s
+}
+
+func (s *StreamStore) load() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.path)
+	if err != nil || len(data) == 0 {
+		return
+	}
+	var st streamState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return
+	}
+	streams := make([]StreamRule, 0, len(st.Streams))
+	for _, rule := range st.Streams {
+		if normalized, err := normalizeStream(rule); err == nil {
+			streams = append(streams, normalized)
+		}
+	}
+	s.streams = streams
+}
+
+func (s *StreamStore) saveLocked() {
+	data, err := json.MarshalIndent(streamState{Streams: s.streams}, "", "  ")
+	if err != nil {
+		return
+	}
+	_ = os.WriteFile(s.path, data, 0644)
+}
+
+func normalizeStream(rule StreamRule) (StreamRule, error) {
+	rule.Protocol = strings.ToLower(strings.TrimSpace(rule.Protocol))
+	if rule.Protocol == "" {
+		rule.Protocol = "tcp"
+	}
+	if rule.Protocol != "tcp" && rule.Protocol != "udp" {
+		return rule, fmt.Errorf("unsupported protocol %q", rule.Protocol)
+	}
+	rule.Listen = strings.TrimSpace(rule.Listen)
+	if rule.Listen != "" && !strings.Contains(rule.Listen, ":") {
+		rule.Listen = ":" + rule.Listen
+	}
+	if _, _, err := net.SplitHostPort(rule.Listen); err != nil {
+		return rule, fmt.Errorf("invalid listen address %q", rule.Listen)
+	}
+	rule.Target = strings.TrimSpace(rule.Target)
+	if _, _, err := net.SplitHostPort(rule.Target); err != nil {
+		return rule, fmt.Errorf("invalid target %q: host:port expected", rule.Target)
+	}
+	rule.ProxyProtocol = strings.ToLower(strings.TrimSpace(rule.ProxyProtocol))
+	if rule.ProxyProtocol != "" && rule.ProxyProtocol != "v1" && rule.ProxyProtocol != "v2" {
+		return rule, fmt.Errorf("unsupported PROXY protocol version %q", rule.ProxyProtocol)
+	}
+	if rule.ProxyProtocol != "" && rule.Protocol == "udp" {
+		return rule, fmt.Errorf("PROXY protocol is supported for TCP streams only")
+	}
+	rule.Name = strings.TrimSpace(rule.Name)
+	if rule.Name == "" {
+		rule.Name = rule.Protocol + rule.Listen
+	}
+	return rule, nil
+}
+
+// List returns a copy of all stream rules.
+func (s *StreamStore) List() []StreamRule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]StreamRule, len(s.streams))
+	copy(out, s.streams)
+	return out
+}
+
+// Upsert validates and stores a stream rule. An empty ID creates a new rule.
+func (s *StreamStore) Upsert(rule StreamRule) (StreamRule, error) {
+	rule, err := normalizeStream(rule)
+	if err != nil {
+		return rule, err
+	}
+
+	s.mu.Lock()
+	for _, existing := range s.streams {
+		if existing.ID != rule.ID && existing.Protocol == rule.Protocol && existing.Listen == rule.Listen {
+			s.mu.Unlock()
+			return rule, fmt.Errorf("%s %s is already used by %q", rule.Protocol, rule.Listen, existing.Name)
+		}
+	}
+	if strings.TrimSpace(rule.ID) == "" {
+		rule.ID = fmt.Sprintf("stream-%d", time.Now().UnixNano())
+		s.streams = append(s.streams, rule)
+	} else {
+		replaced := false
+		for i := range s.streams {
+			if s.streams[i].ID == rule.ID {
+				s.streams[i] = rule
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			s.streams = append(s.streams, rule)
+		}
+	}
+	s.saveLocked()
+	s.mu.Unlock()
+
+	s.notifyChange()
+	return rule, nil
+}
+
+// Delete removes a stream rule by ID.
+func (s *StreamStore) Delete(id string) bool {
+	s.mu.Lock()
+	idx := -1
+	for i := range s.streams {
+		if s.streams[i].ID == id {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		s.mu.Unlock()
+		return false
+	}
+	s.streams = append(s.streams[:idx], s.streams[idx+1:]...)
+	s.saveLocked()
+	s.mu.Unlock()
+
+	s.notifyChange()
+	return true
+}
+
+func (s *StreamStore) notifyChange() {
+	if s.OnChange != nil {
+		s.OnChange()
+	}
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestStreamStoreUpsertValidatesAndPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "streams.json")
+	store := NewStreamStore(path)
+
+	changes := 0
+	store.OnChange = func() { changes++ }
+
+	if _, err := store.Upsert(StreamRule{Protocol: "sctp", Listen: ":5000", Target: "10.0.0.1:5000"}); err == nil {
+		t.Fatalf("expected unsupported protocol error")
+	}
+	if _, err := store.Upsert(StreamRule{Protocol: "tcp", Listen: ":5432", Target: "10.0.0.1"}); err == nil {
+		t.Fatalf("expected target without port to be rejected")
+	}
+
+	rule, err := store.Upsert(StreamRule{Name: "pg", Protocol: "TCP", Listen: "5432", Target: "10.0.0.1:5432", Enabled: true})
+	if err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	if rule.ID == "" || rule.Protocol != "tcp" || rule.Listen != ":5432" {
+		t.Fatalf("unexpected normalized rule: %+v", rule)
+	}
+	if _, err := store.Upsert(StreamRule{Protocol: "tcp", Listen: ":5432", Target: "10.0.0.2:5432"}); err == nil {
+		t.Fatalf("expected duplicate listen address to be rejected")
+	}
+	if _, err := store.Upsert(StreamRule{Protocol: "udp", Listen: ":5432", Target: "10.0.0.2:53"}); err != nil {
+		t.Fatalf("udp on the same port should be allowed: %v", err)
+	}
+	if changes != 2 {
+		t.Fatalf("expected 2 change notifications, got %d", changes)
+	}
+
+	reloaded := NewStreamStore(path)
+	if len(reloaded.List()) != 2 {
+		t.Fatalf("expected 2 persisted streams, got %d", len(reloaded.List()))
+	}
+	if !reloaded.Delete(rule.ID) || len(reloaded.List()) != 1 {
+		t.Fatalf("expected delete to remove one stream")
+	}
+}
@@ -3,17 +3,21 @@ package main
 import (
 	"crypto/tls"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strings"
 	"time"
 
+	"router/internal/cache"
+	"router/internal/clientip"
 	"router/internal/clog"
 	"router/internal/gpt"
 	"router/internal/logstream"
 	"router/internal/notify"
 	"router/internal/panel"
 	"router/internal/proxy"
+	"router/internal/proxyproto"
 	"router/internal/stats"
 	"router/internal/storage"
 
@@ -36,13 +40,34 @@ func main() {
 	broadcaster := logstream.New()
 	log.SetOutput(logstream.NewConsoleMux(os.Stderr, broadcaster))
 
+	// Client IP resolution: forwarding headers are trusted only from known proxies.
+	resolver, err := clientip.FromEnv()
+	if err != nil {
+		clog.Warnf("Client IP resolver: %v", err)
+	}
+	clientip.Configure(resolver)
+
 	// Suspicious IP reputation storage
 	ipReputation := storage.NewIPReputationStore("ip_reputation.json")
+	allowlist := storage.NewAllowlistStore("ip_allowlist.json")
+	ipReputation.Allowlist = allowlist
+	blocklists := storage.NewBlocklistStore("blocklists.json")
+	ipReputation.Blocklists = blocklists
+	go blocklists.Start()
 	backupStore := storage.NewBackupStore("backup_config.json")
 	notifyStore := storage.NewNotificationStore("notifications.json")
 	gptStore := storage.NewGPTStore("gpt.json")
+	streamStore := storage.NewStreamStore("streams.json")
+	signatureStore := storage.NewSignatureStore("signatures.json")
 	gptClient := gpt.NewClient(gptStore)
 	notifier := notify.NewTelegramNotifier(notifyStore)
+	ipReputation.OnRangeBan = func(prefix, reason string, until time.Time) {
+		untilText := "permanent"
+		if !until.IsZero() {
+			untilText = until.Format(time.RFC3339)
+		}
+		notifier.Notify("auto_ban", "auto-ban:"+prefix, "🤖 Range auto-ban activated\nrange: "+prefix+"\nreason: "+reason+"\nuntil: "+untilText)
+	}
 	backupStore.OnResult = func(err error, archivePath string) {
 		if err != nil {
 			notifier.Notify("backup_failure", "backup-failure", "❌ Backup failed\n"+err.Error())
@@ -80,10 +105,17 @@ func main() {
 	}
 	adminStore := storage.NewAdminStore("admin.json", adminUser, adminPass)
 
+	// Response cache for rules with a cache policy; falls back to memory only
+	// when the disk directory is unusable.
+	cacheStore, err := cache.FromEnv()
+	if err != nil {
+		clog.Warnf("Response cache disk tier disabled: %v", err)
+	}
+
 	// --- Admin Panel ---
 	go func() {
 		panelMux := http.NewServeMux()
-		panelHandler := panel.NewHandler(store, adminStore, stats, broadcaster, ipReputation, backupStore, notifyStore, gptStore, gptClient, notifier)
+		panelHandler := panel.NewHandler(store, adminStore, stats, broadcaster, ipReputation, backupStore, notifyStore, gptStore, gptClient, notifier, streamStore, cacheStore, signatureStore, allowlist)
 
 		// Serve static files
 		staticFS := http.FileServer(http.Dir("internal/panel/static"))
@@ -107,27 +139,65 @@ func main() {
 		panelMux.HandleFunc("/notifications/data", panelHandler.NotificationsData)
 		panelMux.HandleFunc("/notifications/config", panelHandler.SaveNotificationsConfig)
 		panelMux.HandleFunc("/notifications/test", panelHandler.TestNotification)
+		panelMux.HandleFunc("/waf", panelHandler.WAF)
+		panelMux.HandleFunc("/waf/data", panelHandler.WAFData)
+		panelMux.HandleFunc("/waf/signature", panelHandler.SaveWAFSignature)
+		panelMux.HandleFunc("/waf/signature/delete", panelHandler.DeleteWAFSignature)
+		panelMux.HandleFunc("/waf/pack", panelHandler.SetWAFPack)
 		panelMux.HandleFunc("/settings/data", panelHandler.SettingsData)
 		panelMux.HandleFunc("/settings/config", panelHandler.SaveSettingsConfig)
 		panelMux.HandleFunc("/telegram/webhook", panelHandler.TelegramWebhook)
 		panelMux.HandleFunc("/stats/ban", panelHandler.BanSuspiciousIP)
 		panelMux.HandleFunc("/stats/unban", panelHandler.UnbanSuspiciousIP)
 		panelMux.HandleFunc("/stats/remove", panelHandler.RemoveSuspiciousIP)
+		panelMux.HandleFunc("/stats/allow", panelHandler.AllowIP)
+		panelMux.HandleFunc("/stats/unallow", panelHandler.UnallowIP)
+		panelMux.HandleFunc("/stats/blocklists/save", panelHandler.SaveBlocklist)
+		panelMux.HandleFunc("/stats/blocklists/toggle", panelHandler.ToggleBlocklist)
+		panelMux.HandleFunc("/stats/blocklists/refresh", panelHandler.RefreshBlocklist)
+		panelMux.HandleFunc("/stats/blocklists/remove", panelHandler.RemoveBlocklist)
 		panelMux.HandleFunc("/ws/logs", panelHandler.Logs)
 		panelMux.HandleFunc("/add", panelHandler.AddRule)
 		panelMux.HandleFunc("/rule/maintenance", panelHandler.RuleMaintenance)
+		panelMux.HandleFunc("/rule/passthrough", panelHandler.RulePassthrough)
+		panelMux.HandleFunc("/rule/proxy-protocol", panelHandler.RuleProxyProtocol)
+		panelMux.HandleFunc("/rule/settings", panelHandler.RuleSettings)
+		panelMux.HandleFunc("/rule/data", panelHandler.RuleData)
+		panelMux.HandleFunc("/rule/config", panelHandler.SaveRuleConfig)
+		panelMux.HandleFunc("/rule/weights", panelHandler.SaveRuleWeights)
+		panelMux.HandleFunc("/cache/purge", panelHandler.PurgeCache)
 		panelMux.HandleFunc("/remove", panelHandler.RemoveRule)
+		panelMux.HandleFunc("/stream/add", panelHandler.AddStream)
+		panelMux.HandleFunc("/stream/remove", panelHandler.RemoveStream)
 		clog.Infof("Starting admin panel on %s", panelAddr)
 		if err := http.ListenAndServe(panelAddr, panelMux); err != nil {
 			clog.Fatalf("Failed to start admin panel: %v", err)
 		}
 	}()
 
+	// PROXY protocol is accepted only from trusted load balancer networks.
+	proxyProtocolTrusted, err := proxyproto.TrustedFromEnv()
+	if err != nil {
+		clog.Fatalf("PROXY protocol: %v", err)
+	}
+	if len(proxyProtocolTrusted) > 0 {
+		clog.Infof("Accepting PROXY protocol from %d trusted network(s)", len(proxyProtocolTrusted))
+	}
+
 	// --- Proxy (Ports 80 & 443) ---
 	proxyHandler := proxy.NewProxy(store, stats, ipReputation, notifier)
+	proxyHandler.Cache = cacheStore
+	proxyHandler.Signatures = signatureStore
+	store.OnRuleChange = proxyHandler.RuleChanged
 	proxyMux := http.NewServeMux()
 	proxyMux.Handle("/", proxyHandler)
 
+	// --- Stream rules (raw TCP/UDP ports) ---
+	streamManager := proxy.NewStreamManager(streamStore, stats, ipReputation)
+	streamManager.ProxyProtocolTrusted = proxyProtocolTrusted
+	streamStore.OnChange = streamManager.Sync
+	streamManager.Start()
+
 	// Autocert for automatic HTTPS certificates
 	certManager := &autocert.Manager{
 		Prompt:     autocert.AcceptTOS,
@@ -143,18 +213,32 @@ func main() {
 			GetCertificate: certManager.GetCertificate,
 		},
 	}
+	// Listener timeouts; WebSocket/streaming requests and rules with their own
+	// deadline lift them per request.
+	timeouts := proxy.TimeoutsFromEnv()
+	timeouts.Apply(server)
 
 	// HTTP server (for ACME challenge and redirecting to HTTPS)
 	go func() {
+		httpListener, err := net.Listen("tcp", ":80")
+		if err != nil {
+			clog.Fatalf("HTTP listener error: %v", err)
+		}
 		clog.Infof("Starting HTTP server on :80")
-		if err := http.ListenAndServe(":80", certManager.HTTPHandler(nil)); err != nil {
+		httpServer := &http.Server{Handler: certManager.HTTPHandler(nil)}
+		timeouts.Apply(httpServer)
+		if err := httpServer.Serve(proxyproto.NewListener(httpListener, proxyProtocolTrusted)); err != nil {
 			clog.Fatalf("HTTP server error: %v", err)
 		}
 	}()
 
-	// Start HTTPS server
+	// Start HTTPS server. Passthrough rules are spliced before TLS termination.
+	httpsListener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		clog.Fatalf("HTTPS listener error: %v", err)
+	}
 	clog.Infof("Starting HTTPS server on :443")
-	if err := server.ListenAndServeTLS("", ""); err != nil {
+	if err := server.ServeTLS(proxy.NewPassthroughListener(proxyproto.NewListener(httpsListener, proxyProtocolTrusted), store, stats, ipReputation), "", ""); err != nil {
 		clog.Fatalf("HTTPS server error: %v", err)
 	}
 }